@@ -0,0 +1,221 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/config"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// command - one-shot command run instead of the controller
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+// commands - commands by name, set in init as the commands look up their own usage
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"sync": {
+			usage:       "sync [flags] <domain>...",
+			description: "Fetch the domains from ZMS and apply their AthenzDomain CRs once.",
+			run:         runSync,
+		},
+		"diff": {
+			usage:       "diff [flags] <domain>...",
+			description: "Print the changes a sync would make to the AthenzDomain CRs of the domains, ignoring signatures.",
+			run:         runDiff,
+		},
+		"dump": {
+			usage:       "dump [flags]",
+			description: "Export all AthenzDomain CRs to yaml or json files.",
+			run:         runDump,
+		},
+		"validate-config": {
+			usage:       "validate-config [flags]",
+			description: "Validate the flags and the config file.",
+			run:         runValidateConfig,
+		},
+	}
+}
+
+// usage - usage of the controller, listing the commands
+func usage(fs *flag.FlagSet) func() {
+	return func() {
+		name := filepath.Base(os.Args[0])
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s [flags]\n       %s <command> [flags] [args]\n\nCommands:\n", name, name)
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "  %-16s %s\n", name, commands[name].description)
+		}
+		fmt.Fprintf(out, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+}
+
+// commandFlagSet - flag set of the command with the config flags
+func commandFlagSet(name string) (*flag.FlagSet, *config.Config, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	cfg, configFile := addFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n\n%s\n\nFlags:\n", filepath.Base(os.Args[0]), commands[name].usage, commands[name].description)
+		fs.PrintDefaults()
+	}
+	return fs, cfg, configFile
+}
+
+// parseCommand - parse the command line of the command, load the config and initialize the logger
+func parseCommand(fs *flag.FlagSet, cfg *config.Config, configFile *string, args []string) (*config.Config, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg, _, err := loadConfig(cfg, *configFile)
+	if err != nil {
+		return nil, err
+	}
+	log.InitLogger(cfg.LogLocation, cfg.LogMode)
+	return cfg, nil
+}
+
+// runSync - sync the AthenzDomain CRs of the domains given as arguments
+func runSync(args []string) error {
+	fs, cfg, configFile := commandFlagSet("sync")
+	cfg, err := parseCommand(fs, cfg, configFile, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("at least one domain is required")
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	s, err := newSyncer(cfg, stopCh)
+	if err != nil {
+		return err
+	}
+	if err := s.controller.WaitForCaches(stopCh); err != nil {
+		return err
+	}
+	failed := 0
+	for _, domain := range fs.Args() {
+		result, err := s.controller.SyncDomain(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", domain, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: %s\n", domain, result)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d domains failed to sync", failed, fs.NArg())
+	}
+	return nil
+}
+
+// runDiff - print the changes a sync would make to the AthenzDomain CRs of the domains given as arguments
+func runDiff(args []string) error {
+	fs, cfg, configFile := commandFlagSet("diff")
+	cfg, err := parseCommand(fs, cfg, configFile, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("at least one domain is required")
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	s, err := newSyncer(cfg, stopCh)
+	if err != nil {
+		return err
+	}
+	if err := s.controller.WaitForCaches(stopCh); err != nil {
+		return err
+	}
+	failed := 0
+	for _, domain := range fs.Args() {
+		diff, err := s.controller.DiffDomain(domain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", domain, err)
+			failed++
+			continue
+		}
+		data, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d domains failed to diff", failed, fs.NArg())
+	}
+	return nil
+}
+
+// runDump - export all AthenzDomain CRs to files
+func runDump(args []string) error {
+	fs, cfg, configFile := commandFlagSet("dump")
+	dir := fs.String("output-dir", "athenzdomains", "Directory the AthenzDomain CRs are written to, one file per CR")
+	format := fs.String("format", cr.FormatYAML, "Format of the files, yaml or json")
+	cfg, err := parseCommand(fs, cfg, configFile, args)
+	if err != nil {
+		return err
+	}
+	_, versiondClient, _, err := getClients(cfg.InClusterConfig, cfg.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	list, err := versiondClient.AthenzV1().AthenzDomains().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("Unable to list AthenzDomain CRs. Error: %v", err)
+	}
+	files, err := cr.DumpAthenzDomains(list.Items, *dir, *format)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d AthenzDomain CRs to %s\n", len(files), *dir)
+	return nil
+}
+
+// runValidateConfig - check that the flags and the config file are valid
+func runValidateConfig(args []string) error {
+	fs, cfg, configFile := commandFlagSet("validate-config")
+	if _, err := parseCommand(fs, cfg, configFile, args); err != nil {
+		return err
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
@@ -24,16 +24,24 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"strings"
+	"reflect"
 	"syscall"
-	"time"
 
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/authz"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/config"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/controller"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/cron"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/crypto"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/health"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/identity"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/istio"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/metrics"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/rbac"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/safety"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/util"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/verifier"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/zmsclient"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
@@ -45,36 +53,33 @@ import (
 )
 
 // getClients retrieve the Kubernetes cluster client and Athenz client
-func getClients(inClusterConfig *bool) (kubernetes.Interface, *athenzClientset.Clientset, error) {
-	var kubeconfig *string
-	if home := util.HomeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-	}
-	flag.Parse()
-	if *inClusterConfig {
-		emptystr := ""
-		kubeconfig = &emptystr
+func getClients(inClusterConfig bool, kubeconfig string) (kubernetes.Interface, *athenzClientset.Clientset, dynamic.Interface, error) {
+	if inClusterConfig {
+		kubeconfig = ""
 	}
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
-		log.Panicln(err.Error())
+		return nil, nil, nil, fmt.Errorf("Failed to build config from kubeconfig %s. Error: %v", kubeconfig, err)
 	}
 
 	// generate the client based off of the config
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to create k8s client from config. Error: %v", err)
+		return nil, nil, nil, fmt.Errorf("Failed to create k8s client from config. Error: %v", err)
 	}
 
 	versiondClient, err := athenzClientset.NewForConfig(config)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to create versiond client from config. Error: %v", err)
+		return nil, nil, nil, fmt.Errorf("Failed to create versiond client from config. Error: %v", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to create dynamic client from config. Error: %v", err)
 	}
 
 	log.Info("Successfully constructed k8s client")
-	return client, versiondClient, nil
+	return client, versiondClient, dynamicClient, nil
 }
 
 // createZMSClient - create client to zms to make zms calls
@@ -100,139 +105,258 @@ func createZMSClient(reloader *r.CertReloader, zmsURL, caCert string, disableKee
 	return &client, nil
 }
 
-// main code path
-func main() {
-	// command line arguments for athenz initial setup
-	key := flag.String("key", "/var/run/athenz/service.key.pem", "Athenz private key file")
-	cert := flag.String("cert", "/var/run/athenz/service.cert.pem", "Athenz certificate file")
-	caCert := flag.String("cacert", "", "Athenz CA certificate file")
-	zmsURL := flag.String("zms-url", "", "Athenz ZMS API URL")
-	updateCron := flag.String("update-cron", "1m0s", "Update cron sleep time")
-	athenzContactTimeCmNs := flag.String("athenz-contact-time-cm-ns", "kube-yahoo", "Namespace of ConfigMap to record the latest time that the Update Cron contacted Athenz")
-	athenzContactTimeCmName := flag.String("athenz-contact-time-cm-name", "athenzcall-config", "Name of ConfigMap to record the latest time that the Update Cron contacted Athenz")
-	athenzContactTimeCmKey := flag.String("athenz-contact-time-cm-key", "latest_contact", "Key of ConfigMap to record the latest time that the Update Cron contacted Athenz")
-	resyncCron := flag.String("resync-cron", "1h0m0s", "Cron full resync sleep time")
-	queueDelayInterval := flag.String("queue-delay-interval", "250ms", "Delay interval time for workqueue")
-	adminDomain := flag.String("admin-domain", "", "admin domain")
-	systemNamespaces := flag.String("system-namespaces", "", "list of cluster system namespaces")
-	disableKeepAlives := flag.Bool("disable-keep-alives", true, "Disable keep alive for zms client")
-	logLoc := flag.String("log-location", "/var/log/k8s-athenz-syncer/k8s-athenz-syncer.log", "log location")
-	logMode := flag.String("log-mode", "info", "logger mode")
-	identityKeyDir := flag.String("identity-key", "/var/run/keys/identity", "directory containing private keys for service identity")
-	useNToken := flag.Bool("use-ntoken", false, "use nToken for zms authentication")
-	serviceName := flag.String("service-name", "k8s-athenz-syncer", "service name")
-	domainName := flag.String("service-domain", "", "athenz domain that contains k8s-athenz-syncer")
-	secretName := flag.String("secret-name", "k8s-athenz-syncer", "secret name that contains private key")
-	header := flag.String("auth-header", "", "Authentication header field")
-	nTokenExpireTime := flag.String("ntoken-expiry", "1h0m0s", "Custom nToken expiration duration")
-	excludeNamespaces := flag.String("exclude-namespaces", "", "Namespaces to exclude from processing ex: 'kube-system,kube-public,acceptance-test'")
-	excludeMSDRules := flag.Bool("exclude-msd-rules", false, "Exclude MSD based role and policies when syncing Athenz domains")
+// addFlags - add the config flags and the config file flag shared by the controller and the commands
+func addFlags(fs *flag.FlagSet) (*config.Config, *string) {
+	cfg := config.NewConfig()
+	cfg.AddFlags(fs)
+	configFile := fs.String("config", "", "YAML config file with the same settings as the flags, taking precedence over them and reloaded when updated")
+	return cfg, configFile
+}
 
-	klog.InitFlags(nil)
-	flag.Set("logtostderr", "false")
-	flag.Set("logtostdout", "false")
-	flag.Parse()
-	// create new log
-	log.InitLogger(*logLoc, *logMode)
-	// get the Kubernetes and Athenz client for connectivity
-	inClusterConfig := flag.Bool("inClusterConfig", true, "Set to true to use in cluster config.")
-	k8sClient, versiondClient, err := getClients(inClusterConfig)
+// loadConfig - apply the config file on top of the flags and validate the result, the reloader is nil
+// without config file
+func loadConfig(cfg *config.Config, configFile string) (*config.Config, *config.Reloader, error) {
+	if configFile == "" {
+		if err := cfg.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("Invalid configuration. Error: %v", err)
+		}
+		return cfg, nil, nil
+	}
+	configReloader, err := config.NewReloader(configFile, cfg)
 	if err != nil {
-		log.Panicf("Error occurred when creating clients. Error: %v", err)
+		return nil, nil, err
 	}
+	return configReloader.Config(), configReloader, nil
+}
 
-	stopCh := make(chan struct{})
-	var zmsClient *zms.ZMSClient
-	if *useNToken {
-		client := zms.NewClient(*zmsURL, nil)
-		zmsClient = &client
-
-		// custom nToken expiration duration
-		nTokenPeriod, err := time.ParseDuration(*nTokenExpireTime)
-		if err != nil {
-			log.Panicf("NToken expiry duration input is invalid. Error: %v", err)
-		}
+// newZMSClient - create the zms client authenticating with an nToken or with the key and cert
+func newZMSClient(cfg *config.Config, stopCh <-chan struct{}) (*zms.ZMSClient, error) {
+	if cfg.UseNToken {
+		client := zms.NewClient(cfg.ZMSURL, nil)
+		zmsClient := &client
 
-		privateKeySource := crypto.NewPrivateKeySource(*identityKeyDir, *secretName)
+		privateKeySource := crypto.NewPrivateKeySource(cfg.IdentityKey, cfg.SecretName)
 		// create tokenProvider
-		_, err = identity.NewTokenProvider(identity.Config{
+		_, err := identity.NewTokenProvider(identity.Config{
 			Client:             zmsClient,
-			Header:             *header,
-			Domain:             *domainName,
-			Service:            *serviceName,
+			Header:             cfg.AuthHeader,
+			Domain:             cfg.ServiceDomain,
+			Service:            cfg.ServiceName,
 			PrivateKeyProvider: privateKeySource.SigningKey,
-			TokenExpiry:        nTokenPeriod,
+			TokenExpiry:        cfg.NTokenExpiry.Duration,
 		}, stopCh)
 		if err != nil {
-			log.Panicf("Could not create new Token Provider: %v", err)
+			return nil, fmt.Errorf("Could not create new Token Provider: %v", err)
 		}
 		log.Info("Sucessfully created ZMS Client with nToken authn")
-	} else {
-		// setup key cert reloader
-		certReloader, err := r.NewCertReloader(r.ReloadConfig{
-			KeyFile:  *key,
-			CertFile: *cert,
-		}, stopCh)
-		if err != nil {
-			log.Panicf("Error occurred when creating new reloader. Error: %v", err)
-		}
-		// use key and cert to create zmsClient for API calls
-		zmsClient, err = createZMSClient(certReloader, *zmsURL, *caCert, *disableKeepAlives)
-		if err != nil {
-			log.Panicf("Error occurred when creating zms client. Error: %v", err)
-		}
-		log.Info("Sucessfully created ZMS Client with certs authn")
+		return zmsClient, nil
 	}
+	// setup key cert reloader
+	certReloader, err := r.NewCertReloader(r.ReloadConfig{
+		KeyFile:  cfg.Key,
+		CertFile: cfg.Cert,
+	}, stopCh)
+	if err != nil {
+		return nil, fmt.Errorf("Error occurred when creating new reloader. Error: %v", err)
+	}
+	// use key and cert to create zmsClient for API calls
+	zmsClient, err := createZMSClient(certReloader, cfg.ZMSURL, cfg.CACert, cfg.DisableKeepAlives)
+	if err != nil {
+		return nil, fmt.Errorf("Error occurred when creating zms client. Error: %v", err)
+	}
+	log.Info("Sucessfully created ZMS Client with certs authn")
+	return zmsClient, nil
+}
 
-	// process system-namespaces input string and create new Util object
-	systemNSList := strings.Split(*systemNamespaces, ",")
-	processList := []string{}
-	for _, item := range systemNSList {
-		if item != "" {
-			processList = append(processList, item)
-		}
+// syncer - util and controller built from the config, shared by the controller and the commands
+type syncer struct {
+	util       *util.Util
+	controller *controller.Controller
+}
+
+// newSyncer - create the clients and construct the controller with its reconcilers
+func newSyncer(cfg *config.Config, stopCh <-chan struct{}) (*syncer, error) {
+	// get the Kubernetes and Athenz client for connectivity
+	k8sClient, versiondClient, dynamicClient, err := getClients(cfg.InClusterConfig, cfg.Kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error occurred when creating clients. Error: %v", err)
+	}
+	zmsClient, err := newZMSClient(cfg, stopCh)
+	if err != nil {
+		return nil, err
 	}
+	// the workers, the crons and the verifier share the ZMS request budget and pause together on Retry-After
+	zmsLimiter := zmsclient.NewLimiter(cfg.ZMSQPS, cfg.ZMSBurst)
+	zmsClient.Transport = zmsLimiter.Transport(zmsClient.Transport)
 
-	// process skip namespaces input string
-	excludeNSList := strings.Split(*excludeNamespaces, ",")
-	exclusionList := []string{}
-	for _, item := range excludeNSList {
-		item := strings.TrimSpace(item)
-		if item != "" {
-			exclusionList = append(exclusionList, item)
+	u := util.NewUtil(cfg.AdminDomain, cfg.SystemNamespaces, cfg.ExcludeNamespaces, cfg.ExcludeMSDRules)
+	namespaceFilter, err := cfg.NamespaceFilter()
+	if err != nil {
+		return nil, fmt.Errorf("Error occurred when parsing namespace filter. Error: %v", err)
+	}
+	u.SetNamespaceFilter(namespaceFilter)
+
+	cm := &cron.AthenzContactTimeConfigMap{
+		Namespace: cfg.ContactTimeCmNs,
+		Name:      cfg.ContactTimeCmName,
+		Key:       cfg.ContactTimeCmKey,
+		Horizon:   cfg.ContactTimeHorizon.Duration,
+	}
+
+	var signatureVerifier *verifier.Verifier
+	if cfg.VerifySignatures {
+		signatureVerifier, err = verifier.NewVerifier(zmsClient, cfg.ZMSPublicKeys)
+		if err != nil {
+			return nil, fmt.Errorf("Error occurred when creating signature verifier. Error: %v", err)
 		}
+		log.Info("ZMS signature verification is enabled")
 	}
-	util := util.NewUtil(*adminDomain, processList, exclusionList, *excludeMSDRules)
 
 	// construct the Controller object which has all of the necessary components to
 	// handle logging, connections, informing (listing and watching), the queue,
 	// and the handler
-	updatePeriod, err := time.ParseDuration(*updateCron)
-	if err != nil {
-		log.Panicf("Update Cron interval input is invalid. Error: %v", err)
+	c := controller.NewController(k8sClient, versiondClient, zmsClient, cfg.UpdateCron.Duration, cfg.ResyncCron.Duration, cfg.QueueDelayInterval.Duration, u, cm, signatureVerifier)
+	if cfg.DryRun {
+		log.Info("Dry run mode: AthenzDomain CRs are not written, the changes are logged instead")
+		c.SetDryRun(true)
+	}
+	c.SetCompressThreshold(cfg.CompressThreshold)
+	c.SetStatusUpdateInterval(cfg.StatusInterval.Duration)
+	c.SetZMSLimiter(zmsLimiter)
+	c.SetRetryBackoff(cfg.RetryBaseDelay.Duration, cfg.RetryMaxDelay.Duration)
+	c.SetDeletionPolicy(cfg.DeletionPolicy, cfg.OrphanTTL.Duration)
+	c.SetDeletionGuard(safety.NewGuard(safety.Config{
+		GraceChecks:        cfg.GraceChecks,
+		GraceInterval:      cfg.GraceInterval.Duration,
+		MaxDeletions:       cfg.MaxDeletions,
+		DeletionInterval:   cfg.DeletionInterval.Duration,
+		BreakerThreshold:   cfg.BreakerThreshold,
+		BreakerMinRequests: cfg.BreakerMinRequests,
+		BreakerWindow:      cfg.BreakerWindow.Duration,
+	}))
+
+	// generate RBAC objects from the synced policies
+	if cfg.GenerateRBAC {
+		rbacReconciler, err := rbac.NewReconciler(k8sClient, cfg.RBACResourceGrammar)
+		if err != nil {
+			return nil, fmt.Errorf("Error occurred when creating RBAC reconciler. Error: %v", err)
+		}
+		c.AddReconciler(rbacReconciler)
+		log.Info("RBAC generation is enabled")
+	}
+
+	// generate Istio AuthorizationPolicies from the synced policies
+	if cfg.GenerateIstioAuthz {
+		c.AddReconciler(istio.NewReconciler(dynamicClient, u, c.DomainNamespaces, cfg.IstioTrustDomain, cfg.IstioDryRun))
+		log.Infof("Istio AuthorizationPolicy generation is enabled, dry run: %t", cfg.IstioDryRun)
+	}
+
+	return &syncer{
+		util:       u,
+		controller: c,
+	}, nil
+}
+
+// main code path
+func main() {
+	// run a one-shot command instead of the controller
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command.run(os.Args[2:]); err != nil && err != flag.ErrHelp {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
-	resyncPeriod, err := time.ParseDuration(*resyncCron)
+
+	// command line arguments for athenz initial setup, all of them can also be set in the config file
+	cfg, configFile := addFlags(flag.CommandLine)
+	flag.Usage = usage(flag.CommandLine)
+
+	klog.InitFlags(nil)
+	flag.Set("logtostderr", "false")
+	flag.Set("logtostdout", "false")
+	flag.Parse()
+
+	cfg, configReloader, err := loadConfig(cfg, *configFile)
 	if err != nil {
-		log.Panicf("Full Resync Cron interval input is invalid. Error: %v", err)
+		panic(err)
 	}
-	delayInterval, err := time.ParseDuration(*queueDelayInterval)
+
+	// create new log
+	log.InitLogger(cfg.LogLocation, cfg.LogMode)
+	health.Configure(cfg.ZMSReadyWindow.Duration, cfg.StallTimeout.Duration)
+
+	stopCh := make(chan struct{})
+	s, err := newSyncer(cfg, stopCh)
 	if err != nil {
-		log.Panicf("Queue delay input is invalid. Error: %v", err)
+		log.Panicf("%v", err)
 	}
 
-	cm := &cron.AthenzContactTimeConfigMap{
-		Namespace: *athenzContactTimeCmNs,
-		Name:      *athenzContactTimeCmName,
-		Key:       *athenzContactTimeCmKey,
+	leConfig := controller.LeaderElectionConfig{
+		Namespace:     cfg.LeaderElectNamespace,
+		Name:          cfg.LeaderElectName,
+		Identity:      cfg.LeaderElectID,
+		LeaseDuration: cfg.LeaseDuration.Duration,
+		RenewDeadline: cfg.RenewDeadline.Duration,
+		RetryPeriod:   cfg.RetryPeriod.Duration,
+	}
+	if cfg.LeaderElect && leConfig.Identity == "" {
+		leConfig.Identity, err = os.Hostname()
+		if err != nil {
+			log.Panicf("Unable to get hostname for leader election identity. Error: %v", err)
+		}
 	}
 
-	controller := controller.NewController(k8sClient, versiondClient, zmsClient, updatePeriod, resyncPeriod, delayInterval, util, cm)
+	util, controller := s.util, s.controller
 
 	// use a channel to synchronize the finalization for a graceful shutdown
 	defer close(stopCh)
 
+	// apply the reloadable settings of an updated config file
+	if configReloader != nil {
+		err = configReloader.Run(func(old, new *config.Config) {
+			util.Reload(new.SystemNamespaces, new.ExcludeNamespaces, new.ExcludeMSDRules)
+			// the config file was validated so the filter parses
+			if namespaceFilter, err := new.NamespaceFilter(); err == nil {
+				util.SetNamespaceFilter(namespaceFilter)
+			}
+			controller.SetCronIntervals(new.UpdateCron.Duration, new.ResyncCron.Duration)
+			if !reflect.DeepEqual(old.SystemNamespaces, new.SystemNamespaces) ||
+				!reflect.DeepEqual(old.ExcludeNamespaces, new.ExcludeNamespaces) ||
+				old.IncludeNsSelector != new.IncludeNsSelector || old.ExcludeNsSelector != new.ExcludeNsSelector ||
+				old.IncludeNsRegex != new.IncludeNsRegex || old.ExcludeNsRegex != new.ExcludeNsRegex ||
+				old.ExcludeMSDRules != new.ExcludeMSDRules {
+				controller.Resync()
+			}
+		}, stopCh)
+		if err != nil {
+			log.Panicf("Error occurred when watching config file. Error: %v", err)
+		}
+	}
+
+	// serve prometheus metrics
+	if cfg.MetricsAddr != "" {
+		go metrics.Serve(cfg.MetricsAddr, stopCh)
+	}
+
+	// serve liveness and readiness probes
+	if cfg.HealthAddr != "" {
+		go health.Serve(cfg.HealthAddr, stopCh)
+	}
+
+	// serve access checks from the AthenzDomain CR cache
+	if cfg.AuthzAddr != "" {
+		go authz.Serve(cfg.AuthzAddr, authz.NewAuthorizer(controller.CRStore()), stopCh)
+	}
+
 	// run the controller loop to process items
-	go controller.Run(stopCh)
+	if cfg.LeaderElect {
+		go controller.RunWithLeaderElection(cfg.Workers, stopCh, leConfig)
+	} else {
+		go controller.Run(cfg.Workers, stopCh)
+	}
 
 	// use a channel to handle OS signals to terminate and gracefully shut
 	// down processing
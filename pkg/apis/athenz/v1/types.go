@@ -22,7 +22,6 @@ import (
 )
 
 // +genclient
-// +genclient:noStatus
 // +genclient:nonNamespaced
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
@@ -42,6 +41,10 @@ type AthenzDomain struct {
 // AthenzDomainSpec contains the SignedDomain object https://github.com/AthenZ/athenz/clients/go/zms
 type AthenzDomainSpec struct {
 	zms.SignedDomain `json:",inline"`
+	// CompressedDomain is the gzipped and base64 encoded json of the SignedDomain, set instead of the
+	// inline SignedDomain for domains too large to be stored as is. Use cr.SignedDomain to read either form.
+	// +optional
+	CompressedDomain string `json:"compressedDomain,omitempty"`
 }
 
 // DeepCopy copies the object and returns a clone
@@ -57,9 +60,36 @@ func (in *AthenzDomainSpec) DeepCopy() *AthenzDomainSpec {
 	return out
 }
 
+// Condition types reported on the AthenzDomain status
+const (
+	// ConditionSynced is true when the spec matches the latest domain data from ZMS
+	ConditionSynced = "Synced"
+	// ConditionSignatureVerified is true when the ZMS signatures of the domain data were verified
+	ConditionSignatureVerified = "SignatureVerified"
+	// ConditionZMSReachable is true when the last ZMS call for the domain succeeded
+	ConditionZMSReachable = "ZMSReachable"
+)
+
 // AthenzDomainStatus stores status information about the current resource
 type AthenzDomainStatus struct {
+	// Message is the error of the last failed sync, superseded by LastError and kept for existing consumers
 	Message string `json:"message,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// LastSyncTime is the time of the last successful sync, written at most once per status update interval
+	// while the outcome of the syncs is unchanged
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+	// LastModified is the modified timestamp of the domain in ZMS at the last successful sync
+	LastModified *metav1.Time `json:"lastModified,omitempty"`
+	// LastError is the error of the last failed sync, empty once a sync succeeds
+	LastError string `json:"lastError,omitempty"`
+	// SyncAttempts is the total number of syncs of the domain, including the syncs not written yet by the
+	// status update interval
+	SyncAttempts int64 `json:"syncAttempts,omitempty"`
+	// FailedAttempts is the number of consecutive failed syncs, reset on success
+	FailedAttempts int64 `json:"failedAttempts,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -0,0 +1,376 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	assumeRoleAction = "assume_role"
+
+	// decision reasons
+	ReasonAllowed         = "allowed by assertion"
+	ReasonDenied          = "denied by assertion"
+	ReasonNoMatch         = "no matching assertion"
+	ReasonDomainNotFound  = "domain not found"
+	ReasonInvalidResource = "resource is not of the form <domain>:<entity>"
+)
+
+// Match - assertion that decided the access check, for audit
+type Match struct {
+	Domain   string `json:"domain"`
+	Policy   string `json:"policy"`
+	Role     string `json:"role"`
+	Resource string `json:"resource"`
+	Action   string `json:"action"`
+	Effect   string `json:"effect"`
+}
+
+// Decision - result of an access check
+type Decision struct {
+	Allowed   bool   `json:"allowed"`
+	Reason    string `json:"reason"`
+	Assertion *Match `json:"assertion,omitempty"`
+}
+
+// Authorizer - answers access checks from the AthenzDomain CRs of the informer cache, following the
+// Athenz policy evaluation: an assertion applies when its action and resource match, with * and ?
+// wildcards, and the principal is an unexpired member of its role, directly, through a wildcard
+// member, through an Athenz group or through the assume_role assertions of the trust domain of a
+// delegated role. A matching DENY assertion takes precedence over ALLOW assertions.
+type Authorizer struct {
+	store cache.Store
+	now   func() time.Time
+	// decompressed domain data of the compressed CRs by domain, so that they are not decoded on every check
+	lock         sync.Mutex
+	decompressed map[string]decompressedDomain
+}
+
+// decompressedDomain - domain data of a compressed CR at a resource version
+type decompressedDomain struct {
+	resourceVersion string
+	data            *zms.DomainData
+}
+
+// NewAuthorizer - create an authorizer reading the AthenzDomain CRs from the store
+func NewAuthorizer(store cache.Store) *Authorizer {
+	return &Authorizer{
+		store:        store,
+		now:          time.Now,
+		decompressed: map[string]decompressedDomain{},
+	}
+}
+
+// Access - check if the principal is allowed to perform the action on the resource <domain>:<entity>
+func (a *Authorizer) Access(principal, action, resource string) Decision {
+	i := strings.Index(resource, ":")
+	if i <= 0 {
+		return Decision{Reason: ReasonInvalidResource}
+	}
+	domainData := a.domain(resource[:i])
+	if domainData == nil || domainData.Policies == nil || domainData.Policies.Contents == nil {
+		return Decision{Reason: ReasonDomainNotFound}
+	}
+	now := a.now()
+	var allow *Match
+	for _, policy := range domainData.Policies.Contents.Policies {
+		if policy == nil || (policy.Active != nil && !*policy.Active) {
+			continue
+		}
+		for _, assertion := range policy.Assertions {
+			if assertion == nil || !assertionMatches(assertion, action, resource) {
+				continue
+			}
+			deny := assertion.Effect != nil && *assertion.Effect == zms.DENY
+			// a deny decides the check, an allow only needs to be found once
+			if !deny && allow != nil {
+				continue
+			}
+			if !a.hasRole(domainData, assertion.Role, principal, now) {
+				continue
+			}
+			match := newMatch(domainData, policy, assertion)
+			if deny {
+				return Decision{Reason: ReasonDenied, Assertion: match}
+			}
+			allow = match
+		}
+	}
+	if allow != nil {
+		return Decision{Allowed: true, Reason: ReasonAllowed, Assertion: allow}
+	}
+	return Decision{Reason: ReasonNoMatch}
+}
+
+// domain - domain data of the AthenzDomain CR of the domain, nil when not synced
+func (a *Authorizer) domain(name string) *zms.DomainData {
+	item, exists, err := a.store.GetByKey(name)
+	if err != nil || !exists {
+		a.lock.Lock()
+		delete(a.decompressed, name)
+		a.lock.Unlock()
+		return nil
+	}
+	obj, ok := item.(*athenz_domain.AthenzDomain)
+	if !ok {
+		return nil
+	}
+	if obj.Spec.CompressedDomain == "" {
+		return obj.Spec.Domain
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if cached, ok := a.decompressed[name]; ok && cached.resourceVersion == obj.ResourceVersion {
+		return cached.data
+	}
+	signedDomain, err := cr.SignedDomain(obj)
+	if err != nil {
+		log.Errorf("Access check on domain %s failed. Error: %v", name, err)
+		return nil
+	}
+	a.decompressed[name] = decompressedDomain{resourceVersion: obj.ResourceVersion, data: signedDomain.Domain}
+	return signedDomain.Domain
+}
+
+// hasRole - check if the principal is a member of a role of the domain matching the assertion role
+func (a *Authorizer) hasRole(domainData *zms.DomainData, rolePattern, principal string, now time.Time) bool {
+	for _, role := range domainData.Roles {
+		if role == nil || !match(strings.ToLower(rolePattern), strings.ToLower(string(role.Name))) {
+			continue
+		}
+		if role.Trust != "" {
+			if a.isTrusted(string(role.Trust), string(role.Name), principal, now) {
+				return true
+			}
+			continue
+		}
+		if a.isMember(domainData, role, principal, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMember - check if the principal is an unexpired member of the role, directly or through a group
+func (a *Authorizer) isMember(domainData *zms.DomainData, role *zms.Role, principal string, now time.Time) bool {
+	for _, member := range cr.RoleMembers(role, now) {
+		if strings.Contains(member, cr.GroupSeparator) {
+			if a.isGroupMember(domainData, member, principal, now) {
+				return true
+			}
+			continue
+		}
+		if memberMatches(member, principal) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGroupMember - check if the principal is an unexpired member of the group, looked up in the domain of the group
+func (a *Authorizer) isGroupMember(domainData *zms.DomainData, groupName, principal string, now time.Time) bool {
+	groupDomain := groupName[:strings.Index(groupName, cr.GroupSeparator)]
+	if groupDomain != string(domainData.Name) {
+		domainData = a.domain(groupDomain)
+		if domainData == nil {
+			return false
+		}
+	}
+	for _, group := range domainData.Groups {
+		if group == nil || string(group.Name) != groupName {
+			continue
+		}
+		for _, member := range group.GroupMembers {
+			if member == nil || (member.Expiration != nil && member.Expiration.Time.Before(now)) {
+				continue
+			}
+			if memberMatches(string(member.MemberName), principal) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTrusted - check if the trust domain lets the principal assume the delegated role, through an assume_role
+// assertion on the role whose own role has the principal as member. Trust is only followed one level.
+func (a *Authorizer) isTrusted(trustDomain, roleName, principal string, now time.Time) bool {
+	domainData := a.domain(trustDomain)
+	if domainData == nil || domainData.Policies == nil || domainData.Policies.Contents == nil {
+		return false
+	}
+	trusted := false
+	for _, policy := range domainData.Policies.Contents.Policies {
+		if policy == nil || (policy.Active != nil && !*policy.Active) {
+			continue
+		}
+		for _, assertion := range policy.Assertions {
+			if assertion == nil || !assertionMatches(assertion, assumeRoleAction, roleName) {
+				continue
+			}
+			deny := assertion.Effect != nil && *assertion.Effect == zms.DENY
+			if (deny || !trusted) && a.hasDirectRole(domainData, assertion.Role, principal, now) {
+				if deny {
+					return false
+				}
+				trusted = true
+			}
+		}
+	}
+	return trusted
+}
+
+// hasDirectRole - check if the principal is a member of a role matching the pattern that is not delegated
+func (a *Authorizer) hasDirectRole(domainData *zms.DomainData, rolePattern, principal string, now time.Time) bool {
+	for _, role := range domainData.Roles {
+		if role == nil || role.Trust != "" || !match(strings.ToLower(rolePattern), strings.ToLower(string(role.Name))) {
+			continue
+		}
+		if a.isMember(domainData, role, principal, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// assertionMatches - check the action and the resource against the assertion, ignoring case unless the
+// assertion is case sensitive
+func assertionMatches(assertion *zms.Assertion, action, resource string) bool {
+	assertionAction, assertionResource := assertion.Action, assertion.Resource
+	if assertion.CaseSensitive == nil || !*assertion.CaseSensitive {
+		assertionAction, assertionResource = strings.ToLower(assertionAction), strings.ToLower(assertionResource)
+		action, resource = strings.ToLower(action), strings.ToLower(resource)
+	}
+	return match(assertionAction, action) && match(assertionResource, resource)
+}
+
+// memberMatches - check if the member is the principal or a wildcard member such as user.* matching it
+func memberMatches(member, principal string) bool {
+	if strings.HasSuffix(member, "*") {
+		return strings.HasPrefix(principal, strings.TrimSuffix(member, "*"))
+	}
+	return member == principal
+}
+
+// match - match the value against a pattern where * matches any sequence and ? any single character
+func match(pattern, value string) bool {
+	p, v := 0, 0
+	star, next := -1, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == value[v]):
+			p++
+			v++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, v
+			p++
+		case star >= 0:
+			// let the last star match one more character
+			next++
+			p, v = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// newMatch - audit record of the assertion
+func newMatch(domainData *zms.DomainData, policy *zms.Policy, assertion *zms.Assertion) *Match {
+	effect := zms.ALLOW.String()
+	if assertion.Effect != nil {
+		effect = assertion.Effect.String()
+	}
+	return &Match{
+		Domain:   string(domainData.Name),
+		Policy:   string(policy.Name),
+		Role:     assertion.Role,
+		Resource: assertion.Resource,
+		Action:   assertion.Action,
+		Effect:   effect,
+	}
+}
+
+// request - access check parameters of the HTTP endpoint
+type request struct {
+	Principal string `json:"principal"`
+	Action    string `json:"action"`
+	Resource  string `json:"resource"`
+}
+
+// Handler - /access endpoint answering access checks given as query parameters of a GET request or as
+// the JSON body of a POST request, with the JSON decision
+func (a *Authorizer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/access", func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		switch r.Method {
+		case http.MethodGet:
+			query := r.URL.Query()
+			req = request{Principal: query.Get("principal"), Action: query.Get("action"), Resource: query.Get("resource")}
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if req.Principal == "" || req.Action == "" || req.Resource == "" {
+			http.Error(w, "principal, action and resource are required", http.StatusBadRequest)
+			return
+		}
+		decision := a.Access(req.Principal, req.Action, req.Resource)
+		log.Debugf("Access check principal: %s, action: %s, resource: %s, allowed: %t, reason: %s", req.Principal, req.Action, req.Resource, decision.Allowed, decision.Reason)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(decision)
+	})
+	return mux
+}
+
+// Serve - serve the access check endpoint on addr until the stop channel is closed
+func Serve(addr string, authorizer *Authorizer, stopCh <-chan struct{}) {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: authorizer.Handler(),
+	}
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	log.Infof("Starting authorization server on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Authorization server stopped unexpectedly. Error: %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package authz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/ardielle/ardielle-go/rdl"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	domainName = "home.domain"
+	trustName  = "trust.domain"
+)
+
+func init() {
+	log.InitLogger("/tmp/log/test.log", "info")
+}
+
+// newDomain - AthenzDomain CR of the domain data
+func newDomain(domainData *zms.DomainData) *athenz_domain.AthenzDomain {
+	return &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: string(domainData.Name)},
+		Spec: athenz_domain.AthenzDomainSpec{
+			SignedDomain: zms.SignedDomain{Domain: domainData},
+		},
+	}
+}
+
+// newAuthorizer - authorizer over a domain with readers, writers, a delegated role and a group, and
+// the trust domain of the delegated role
+func newAuthorizer(t *testing.T, now time.Time) *Authorizer {
+	allow := zms.ALLOW
+	deny := zms.DENY
+	inactive := false
+	expired := rdl.Timestamp{Time: now.Add(-time.Hour)}
+	modified := rdl.Timestamp{Time: now.Add(-24 * time.Hour)}
+	home := &zms.DomainData{
+		Name:     domainName,
+		Modified: modified,
+		Roles: []*zms.Role{
+			{
+				Name: domainName + ":role.readers",
+				RoleMembers: []*zms.RoleMember{
+					{MemberName: "user.jane"},
+					{MemberName: "user.expired", Expiration: &expired},
+					{MemberName: "sports.*"},
+					{MemberName: domainName + ":group.ops"},
+				},
+			},
+			{
+				Name:    domainName + ":role.writers",
+				Members: []zms.MemberName{"user.jane", "user.bob"},
+			},
+			{
+				Name:  domainName + ":role.delegated",
+				Trust: trustName,
+			},
+		},
+		Groups: []*zms.Group{
+			{
+				Name: domainName + ":group.ops",
+				GroupMembers: []*zms.GroupMember{
+					{MemberName: "user.ops"},
+					{MemberName: "user.gone", Expiration: &expired},
+				},
+			},
+		},
+		Policies: &zms.SignedPolicies{
+			Contents: &zms.DomainPolicies{
+				Domain: domainName,
+				Policies: []*zms.Policy{
+					{
+						Name: domainName + ":policy.readers",
+						Assertions: []*zms.Assertion{
+							{Role: domainName + ":role.readers", Resource: domainName + ":data.*", Action: "read", Effect: &allow},
+						},
+					},
+					{
+						Name: domainName + ":policy.writers",
+						Assertions: []*zms.Assertion{
+							{Role: domainName + ":role.writers", Resource: domainName + ":data.*", Action: "*", Effect: &allow},
+							{Role: domainName + ":role.writers", Resource: domainName + ":data.secret", Action: "write", Effect: &deny},
+							{Role: domainName + ":role.writers", Resource: domainName + ":Data.Exact", Action: "write", Effect: &allow, CaseSensitive: &[]bool{true}[0]},
+						},
+					},
+					{
+						Name: domainName + ":policy.delegated",
+						Assertions: []*zms.Assertion{
+							{Role: domainName + ":role.delegated", Resource: domainName + ":data.shared", Action: "read", Effect: &allow},
+						},
+					},
+					{
+						Name:   domainName + ":policy.inactive",
+						Active: &inactive,
+						Assertions: []*zms.Assertion{
+							{Role: domainName + ":role.readers", Resource: domainName + ":admin", Action: "*", Effect: &allow},
+						},
+					},
+				},
+			},
+			KeyId:     "zms.0",
+			Signature: "signature-policy",
+		},
+	}
+	trust := &zms.DomainData{
+		Name:     trustName,
+		Modified: modified,
+		Roles: []*zms.Role{
+			{
+				Name:    trustName + ":role.partners",
+				Members: []zms.MemberName{"partner.service"},
+			},
+		},
+		Policies: &zms.SignedPolicies{
+			Contents: &zms.DomainPolicies{
+				Domain: trustName,
+				Policies: []*zms.Policy{
+					{
+						Name: trustName + ":policy.trust",
+						Assertions: []*zms.Assertion{
+							{Role: trustName + ":role.partners", Resource: domainName + ":role.delegated", Action: "assume_role", Effect: &allow},
+						},
+					},
+				},
+			},
+			KeyId:     "zms.0",
+			Signature: "signature-policy",
+		},
+	}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for _, domainData := range []*zms.DomainData{home, trust} {
+		if err := store.Add(newDomain(domainData)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := NewAuthorizer(store)
+	a.now = func() time.Time { return now }
+	return a
+}
+
+func TestAccess(t *testing.T) {
+	a := newAuthorizer(t, time.Now())
+	tests := []struct {
+		name      string
+		principal string
+		action    string
+		resource  string
+		allowed   bool
+		reason    string
+		policy    string
+	}{
+		{name: "direct member", principal: "user.jane", action: "read", resource: domainName + ":data.reports", allowed: true, reason: ReasonAllowed, policy: domainName + ":policy.readers"},
+		{name: "case insensitive", principal: "user.jane", action: "READ", resource: domainName + ":Data.Reports", allowed: true, reason: ReasonAllowed, policy: domainName + ":policy.readers"},
+		{name: "case sensitive assertion", principal: "user.bob", action: "write", resource: domainName + ":data.exact", allowed: true, reason: ReasonAllowed, policy: domainName + ":policy.writers"},
+		{name: "expired member", principal: "user.expired", action: "read", resource: domainName + ":data.reports", reason: ReasonNoMatch},
+		{name: "wildcard member", principal: "sports.api", action: "read", resource: domainName + ":data.reports", allowed: true, reason: ReasonAllowed, policy: domainName + ":policy.readers"},
+		{name: "group member", principal: "user.ops", action: "read", resource: domainName + ":data.reports", allowed: true, reason: ReasonAllowed, policy: domainName + ":policy.readers"},
+		{name: "expired group member", principal: "user.gone", action: "read", resource: domainName + ":data.reports", reason: ReasonNoMatch},
+		{name: "action not granted", principal: "user.ops", action: "write", resource: domainName + ":data.reports", reason: ReasonNoMatch},
+		{name: "deny precedence", principal: "user.bob", action: "write", resource: domainName + ":data.secret", reason: ReasonDenied, policy: domainName + ":policy.writers"},
+		{name: "delegated role", principal: "partner.service", action: "read", resource: domainName + ":data.shared", allowed: true, reason: ReasonAllowed, policy: domainName + ":policy.delegated"},
+		{name: "delegated role other resource", principal: "partner.service", action: "read", resource: domainName + ":data.other", reason: ReasonNoMatch},
+		{name: "inactive policy", principal: "user.jane", action: "read", resource: domainName + ":admin", reason: ReasonNoMatch},
+		{name: "unknown domain", principal: "user.jane", action: "read", resource: "other.domain:data", reason: ReasonDomainNotFound},
+		{name: "invalid resource", principal: "user.jane", action: "read", resource: "data", reason: ReasonInvalidResource},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := a.Access(test.principal, test.action, test.resource)
+			if decision.Allowed != test.allowed || decision.Reason != test.reason {
+				t.Errorf("Expected allowed %t with reason %s, got %t with reason %s", test.allowed, test.reason, decision.Allowed, decision.Reason)
+			}
+			if test.policy == "" {
+				if decision.Assertion != nil {
+					t.Errorf("Expected no matching assertion, got %v", decision.Assertion)
+				}
+				return
+			}
+			if decision.Assertion == nil || decision.Assertion.Policy != test.policy {
+				t.Errorf("Expected assertion of policy %s, got %v", test.policy, decision.Assertion)
+			}
+		})
+	}
+}
+
+// TestAccessCompressed - test access checks on a domain stored compressed
+func TestAccessCompressed(t *testing.T) {
+	a := newAuthorizer(t, time.Now())
+	item, _, _ := a.store.GetByKey(domainName)
+	obj := item.(*athenz_domain.AthenzDomain).DeepCopy()
+	data, err := json.Marshal(obj.Spec.SignedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the domain data as the zms client decodes it
+	var expected zms.SignedDomain
+	if err := json.Unmarshal(data, &expected); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	obj.Spec = athenz_domain.AthenzDomainSpec{CompressedDomain: base64.StdEncoding.EncodeToString(buf.Bytes())}
+	obj.ResourceVersion = "2"
+	if err := a.store.Update(obj); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		decision := a.Access("user.jane", "read", domainName+":data.reports")
+		if !decision.Allowed {
+			t.Errorf("Expected access to be allowed, got %s", decision.Reason)
+		}
+	}
+	if cached := a.decompressed[domainName]; cached.resourceVersion != "2" || !reflect.DeepEqual(cached.data, expected.Domain) {
+		t.Errorf("Expected the decompressed domain to be cached, got version %q", cached.resourceVersion)
+	}
+
+	a.store.Delete(obj)
+	if decision := a.Access("user.jane", "read", domainName+":data.reports"); decision.Reason != ReasonDomainNotFound {
+		t.Errorf("Expected the domain to be not found, got %s", decision.Reason)
+	}
+	if _, ok := a.decompressed[domainName]; ok {
+		t.Error("Expected the decompressed domain of the deleted CR to be dropped")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		match   bool
+	}{
+		{pattern: "*", value: "anything", match: true},
+		{pattern: "data.*", value: "data.reports", match: true},
+		{pattern: "data.*", value: "database", match: false},
+		{pattern: "*.reports", value: "data.reports", match: true},
+		{pattern: "d?ta.*s", value: "data.reports", match: true},
+		{pattern: "d?ta", value: "dta", match: false},
+		{pattern: "a*b*c", value: "abxbc", match: true},
+		{pattern: "a*b*c", value: "abxbd", match: false},
+		{pattern: "exact", value: "exact", match: true},
+	}
+	for _, test := range tests {
+		if match(test.pattern, test.value) != test.match {
+			t.Errorf("Expected match(%s, %s) to be %t", test.pattern, test.value, test.match)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(newAuthorizer(t, time.Now()).Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/access?principal=user.jane&action=read&resource=" + domainName + ":data.reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	decision := Decision{}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !decision.Allowed || decision.Assertion == nil || decision.Assertion.Effect != "ALLOW" {
+		t.Errorf("Expected an ALLOW decision, got %d %v", resp.StatusCode, decision)
+	}
+
+	body := `{"principal":"user.bob","action":"write","resource":"` + domainName + `:data.secret"}`
+	resp, err = http.Post(server.URL+"/access", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	decision = Decision{}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allowed || decision.Assertion == nil || decision.Assertion.Effect != "DENY" {
+		t.Errorf("Expected a DENY decision, got %v", decision)
+	}
+
+	resp, err = http.Get(server.URL + "/access?principal=user.jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d for missing parameters, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -40,6 +40,7 @@ type AthenzDomainsGetter interface {
 type AthenzDomainInterface interface {
 	Create(ctx context.Context, athenzDomain *v1.AthenzDomain, opts metav1.CreateOptions) (*v1.AthenzDomain, error)
 	Update(ctx context.Context, athenzDomain *v1.AthenzDomain, opts metav1.UpdateOptions) (*v1.AthenzDomain, error)
+	UpdateStatus(ctx context.Context, athenzDomain *v1.AthenzDomain, opts metav1.UpdateOptions) (*v1.AthenzDomain, error)
 	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
 	DeleteCollection(ctx context.Context, opts metav1.DeleteOptions, listOpts metav1.ListOptions) error
 	Get(ctx context.Context, name string, opts metav1.GetOptions) (*v1.AthenzDomain, error)
@@ -128,6 +129,21 @@ func (c *athenzDomains) Update(ctx context.Context, athenzDomain *v1.AthenzDomai
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *athenzDomains) UpdateStatus(ctx context.Context, athenzDomain *v1.AthenzDomain, opts metav1.UpdateOptions) (result *v1.AthenzDomain, err error) {
+	result = &v1.AthenzDomain{}
+	err = c.client.Put().
+		Resource("athenzdomains").
+		Name(athenzDomain.Name).
+		SubResource("status").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Body(athenzDomain).
+		Do(ctx).
+		Into(result)
+	return
+}
+
 // Delete takes name of the athenzDomain and deletes it. Returns an error if one occurs.
 func (c *athenzDomains) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
 	return c.client.Delete().
@@ -96,6 +96,17 @@ func (c *FakeAthenzDomains) Update(ctx context.Context, athenzDomain *athenzv1.A
 	return obj.(*athenzv1.AthenzDomain), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakeAthenzDomains) UpdateStatus(ctx context.Context, athenzDomain *athenzv1.AthenzDomain, opts v1.UpdateOptions) (*athenzv1.AthenzDomain, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewRootUpdateSubresourceAction(athenzdomainsResource, "status", athenzDomain), &athenzv1.AthenzDomain{})
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*athenzv1.AthenzDomain), err
+}
+
 // Delete takes name of the athenzDomain and deletes it. Returns an error if one occurs.
 func (c *FakeAthenzDomains) Delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
 	_, err := c.Fake.
@@ -0,0 +1,425 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/istio"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/rbac"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/util"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Config - settings of the syncer. Every setting is a command line flag of the same name and can also
+// be set in the yaml file given with --config, settings in the file take precedence over the flags.
+type Config struct {
+	Key                  string          `json:"key"`
+	Cert                 string          `json:"cert"`
+	CACert               string          `json:"cacert"`
+	ZMSURL               string          `json:"zms-url"`
+	ZMSQPS               float64         `json:"zms-qps"`
+	ZMSBurst             int             `json:"zms-burst"`
+	UpdateCron           metav1.Duration `json:"update-cron"`
+	ResyncCron           metav1.Duration `json:"resync-cron"`
+	ContactTimeCmNs      string          `json:"athenz-contact-time-cm-ns"`
+	ContactTimeCmName    string          `json:"athenz-contact-time-cm-name"`
+	ContactTimeCmKey     string          `json:"athenz-contact-time-cm-key"`
+	ContactTimeHorizon   metav1.Duration `json:"athenz-contact-time-horizon"`
+	QueueDelayInterval   metav1.Duration `json:"queue-delay-interval"`
+	RetryBaseDelay       metav1.Duration `json:"retry-base-delay"`
+	RetryMaxDelay        metav1.Duration `json:"retry-max-delay"`
+	Workers              int             `json:"workers"`
+	AdminDomain          string          `json:"admin-domain"`
+	SystemNamespaces     StringList      `json:"system-namespaces"`
+	ExcludeNamespaces    StringList      `json:"exclude-namespaces"`
+	IncludeNsSelector    string          `json:"include-namespace-selector"`
+	ExcludeNsSelector    string          `json:"exclude-namespace-selector"`
+	IncludeNsRegex       string          `json:"include-namespace-regex"`
+	ExcludeNsRegex       string          `json:"exclude-namespace-regex"`
+	ExcludeMSDRules      bool            `json:"exclude-msd-rules"`
+	DryRun               bool            `json:"dry-run"`
+	CompressThreshold    int             `json:"compress-threshold"`
+	StatusInterval       metav1.Duration `json:"status-update-interval"`
+	DeletionPolicy       string          `json:"deletion-policy"`
+	OrphanTTL            metav1.Duration `json:"orphan-ttl"`
+	GraceChecks          int             `json:"deletion-grace-checks"`
+	GraceInterval        metav1.Duration `json:"deletion-grace-interval"`
+	MaxDeletions         int             `json:"max-deletions"`
+	DeletionInterval     metav1.Duration `json:"deletion-interval"`
+	BreakerThreshold     float64         `json:"breaker-threshold"`
+	BreakerMinRequests   int             `json:"breaker-min-requests"`
+	BreakerWindow        metav1.Duration `json:"breaker-window"`
+	DisableKeepAlives    bool            `json:"disable-keep-alives"`
+	LogLocation          string          `json:"log-location"`
+	LogMode              string          `json:"log-mode"`
+	IdentityKey          string          `json:"identity-key"`
+	UseNToken            bool            `json:"use-ntoken"`
+	ServiceName          string          `json:"service-name"`
+	ServiceDomain        string          `json:"service-domain"`
+	SecretName           string          `json:"secret-name"`
+	AuthHeader           string          `json:"auth-header"`
+	NTokenExpiry         metav1.Duration `json:"ntoken-expiry"`
+	VerifySignatures     bool            `json:"verify-signatures"`
+	ZMSPublicKeys        string          `json:"zms-public-keys"`
+	MetricsAddr          string          `json:"metrics-addr"`
+	HealthAddr           string          `json:"health-addr"`
+	AuthzAddr            string          `json:"authz-addr"`
+	ZMSReadyWindow       metav1.Duration `json:"zms-ready-window"`
+	StallTimeout         metav1.Duration `json:"stall-timeout"`
+	LeaderElect          bool            `json:"leader-elect"`
+	LeaderElectNamespace string          `json:"leader-elect-namespace"`
+	LeaderElectName      string          `json:"leader-elect-name"`
+	LeaderElectID        string          `json:"leader-elect-id"`
+	LeaseDuration        metav1.Duration `json:"leader-elect-lease-duration"`
+	RenewDeadline        metav1.Duration `json:"leader-elect-renew-deadline"`
+	RetryPeriod          metav1.Duration `json:"leader-elect-retry-period"`
+	GenerateRBAC         bool            `json:"generate-rbac"`
+	RBACResourceGrammar  string          `json:"rbac-resource-grammar"`
+	GenerateIstioAuthz   bool            `json:"generate-istio-authz"`
+	IstioTrustDomain     string          `json:"istio-trust-domain"`
+	IstioDryRun          bool            `json:"istio-dry-run"`
+	Kubeconfig           string          `json:"kubeconfig"`
+	InClusterConfig      bool            `json:"inClusterConfig"`
+}
+
+// settings applied to a running syncer when the config file changes, all others require a restart
+var liveSettings = map[string]bool{
+	"ExcludeNamespaces": true,
+	"IncludeNsSelector": true,
+	"ExcludeNsSelector": true,
+	"IncludeNsRegex":    true,
+	"ExcludeNsRegex":    true,
+	"SystemNamespaces":  true,
+	"ExcludeMSDRules":   true,
+	"UpdateCron":        true,
+	"ResyncCron":        true,
+}
+
+// StringList - list of strings, set as a comma separated flag or as a yaml list
+type StringList []string
+
+// String - comma separated list
+func (s *StringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set - parse a comma separated list, empty items are dropped
+func (s *StringList) Set(value string) error {
+	list := StringList{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	*s = list
+	return nil
+}
+
+// NewConfig - create a config with the default settings
+func NewConfig() *Config {
+	kubeconfig := ""
+	if home := util.HomeDir(); home != "" {
+		kubeconfig = filepath.Join(home, ".kube", "config")
+	}
+	return &Config{
+		Key:                  "/var/run/athenz/service.key.pem",
+		Cert:                 "/var/run/athenz/service.cert.pem",
+		UpdateCron:           metav1.Duration{Duration: time.Minute},
+		ResyncCron:           metav1.Duration{Duration: time.Hour},
+		ContactTimeCmNs:      "kube-yahoo",
+		ContactTimeCmName:    "athenzcall-config",
+		ContactTimeCmKey:     "latest_contact",
+		ContactTimeHorizon:   metav1.Duration{Duration: 24 * time.Hour},
+		QueueDelayInterval:   metav1.Duration{Duration: 250 * time.Millisecond},
+		RetryBaseDelay:       metav1.Duration{Duration: time.Second},
+		RetryMaxDelay:        metav1.Duration{Duration: 5 * time.Minute},
+		Workers:              1,
+		DeletionPolicy:       cr.DeletionImmediate,
+		OrphanTTL:            metav1.Duration{Duration: 24 * time.Hour},
+		StatusInterval:       metav1.Duration{Duration: cr.DefaultStatusUpdateInterval},
+		GraceChecks:          3,
+		GraceInterval:        metav1.Duration{Duration: time.Minute},
+		MaxDeletions:         20,
+		DeletionInterval:     metav1.Duration{Duration: 10 * time.Minute},
+		BreakerThreshold:     0.5,
+		BreakerMinRequests:   10,
+		BreakerWindow:        metav1.Duration{Duration: 5 * time.Minute},
+		ZMSQPS:               10,
+		ZMSBurst:             20,
+		SystemNamespaces:     StringList{},
+		ExcludeNamespaces:    StringList{},
+		DisableKeepAlives:    true,
+		LogLocation:          "/var/log/k8s-athenz-syncer/k8s-athenz-syncer.log",
+		LogMode:              "info",
+		IdentityKey:          "/var/run/keys/identity",
+		ServiceName:          "k8s-athenz-syncer",
+		SecretName:           "k8s-athenz-syncer",
+		NTokenExpiry:         metav1.Duration{Duration: time.Hour},
+		MetricsAddr:          ":8080",
+		HealthAddr:           ":8081",
+		ZMSReadyWindow:       metav1.Duration{Duration: 5 * time.Minute},
+		StallTimeout:         metav1.Duration{Duration: 10 * time.Minute},
+		LeaderElectNamespace: "kube-yahoo",
+		LeaderElectName:      "k8s-athenz-syncer",
+		LeaseDuration:        metav1.Duration{Duration: 15 * time.Second},
+		RenewDeadline:        metav1.Duration{Duration: 10 * time.Second},
+		RetryPeriod:          metav1.Duration{Duration: 2 * time.Second},
+		RBACResourceGrammar:  rbac.DefaultGrammar,
+		IstioTrustDomain:     istio.DefaultTrustDomain,
+		Kubeconfig:           kubeconfig,
+		InClusterConfig:      true,
+	}
+}
+
+// AddFlags - register a flag for every setting, the current settings are the flag defaults
+func (c *Config) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Key, "key", c.Key, "Athenz private key file")
+	fs.StringVar(&c.Cert, "cert", c.Cert, "Athenz certificate file")
+	fs.StringVar(&c.CACert, "cacert", c.CACert, "Athenz CA certificate file")
+	fs.StringVar(&c.ZMSURL, "zms-url", c.ZMSURL, "Athenz ZMS API URL")
+	fs.Float64Var(&c.ZMSQPS, "zms-qps", c.ZMSQPS, "Maximum number of ZMS requests per second shared by the workers and the crons, 0 for no limit")
+	fs.IntVar(&c.ZMSBurst, "zms-burst", c.ZMSBurst, "Maximum burst of ZMS requests above zms-qps")
+	fs.DurationVar(&c.UpdateCron.Duration, "update-cron", c.UpdateCron.Duration, "Update cron sleep time")
+	fs.DurationVar(&c.ResyncCron.Duration, "resync-cron", c.ResyncCron.Duration, "Cron full resync sleep time")
+	fs.StringVar(&c.ContactTimeCmNs, "athenz-contact-time-cm-ns", c.ContactTimeCmNs, "Namespace of ConfigMap to record the latest time that the Update Cron contacted Athenz")
+	fs.StringVar(&c.ContactTimeCmName, "athenz-contact-time-cm-name", c.ContactTimeCmName, "Name of ConfigMap to record the latest time that the Update Cron contacted Athenz")
+	fs.StringVar(&c.ContactTimeCmKey, "athenz-contact-time-cm-key", c.ContactTimeCmKey, "Key of ConfigMap to record the latest time that the Update Cron contacted Athenz")
+	fs.DurationVar(&c.ContactTimeHorizon.Duration, "athenz-contact-time-horizon", c.ContactTimeHorizon.Duration, "Maximum age of the time recorded in the ConfigMap to resume the Update Cron from, all domains are synced when it is older")
+	fs.DurationVar(&c.QueueDelayInterval.Duration, "queue-delay-interval", c.QueueDelayInterval.Duration, "Minimum time between two domains taken from the workqueue")
+	fs.DurationVar(&c.RetryBaseDelay.Duration, "retry-base-delay", c.RetryBaseDelay.Duration, "Delay before retrying a failed domain, doubled with every further failure of the domain, 0 to only space the retries by queue-delay-interval")
+	fs.DurationVar(&c.RetryMaxDelay.Duration, "retry-max-delay", c.RetryMaxDelay.Duration, "Maximum delay between two retries of a failing domain")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "Number of workers processing the workqueue concurrently")
+	fs.StringVar(&c.AdminDomain, "admin-domain", c.AdminDomain, "admin domain")
+	fs.Var(&c.SystemNamespaces, "system-namespaces", "list of cluster system namespaces")
+	fs.Var(&c.ExcludeNamespaces, "exclude-namespaces", "Namespaces to exclude from processing ex: 'kube-system,kube-public,acceptance-test'")
+	fs.StringVar(&c.IncludeNsSelector, "include-namespace-selector", c.IncludeNsSelector, "Label selector of the namespaces to sync ex: 'athenz.io/sync=true', all namespaces when empty")
+	fs.StringVar(&c.ExcludeNsSelector, "exclude-namespace-selector", c.ExcludeNsSelector, "Label selector of the namespaces to exclude from processing")
+	fs.StringVar(&c.IncludeNsRegex, "include-namespace-regex", c.IncludeNsRegex, "Regex matching the full name of the namespaces to sync, all namespaces when empty")
+	fs.StringVar(&c.ExcludeNsRegex, "exclude-namespace-regex", c.ExcludeNsRegex, "Regex matching the full name of the namespaces to exclude from processing")
+	fs.BoolVar(&c.ExcludeMSDRules, "exclude-msd-rules", c.ExcludeMSDRules, "Exclude MSD based role and policies when syncing Athenz domains")
+	fs.BoolVar(&c.DryRun, "dry-run", c.DryRun, "Log the changes to the AthenzDomain CRs as diffs without writing them")
+	fs.IntVar(&c.CompressThreshold, "compress-threshold", c.CompressThreshold, "Size in bytes of the domain data above which it is stored gzipped and base64 encoded in the compressedDomain field of the AthenzDomain CR, 0 to disable")
+	fs.DurationVar(&c.StatusInterval.Duration, "status-update-interval", c.StatusInterval.Duration, "Minimum time between two status writes of an AthenzDomain CR whose sync outcome is unchanged, 0 to write the status on every sync")
+	fs.StringVar(&c.DeletionPolicy, "deletion-policy", c.DeletionPolicy, "Policy for the AthenzDomain CRs of domains no longer mapped to a namespace: immediate deletes them, delayed marks them orphaned and deletes them after orphan-ttl, retain marks them orphaned and keeps them")
+	fs.DurationVar(&c.OrphanTTL.Duration, "orphan-ttl", c.OrphanTTL.Duration, "Time orphaned AthenzDomain CRs are kept with the delayed deletion policy")
+	fs.IntVar(&c.GraceChecks, "deletion-grace-checks", c.GraceChecks, "Number of consecutive checks a domain must be missing from ZMS before its AthenzDomain CR is deleted")
+	fs.DurationVar(&c.GraceInterval.Duration, "deletion-grace-interval", c.GraceInterval.Duration, "Minimum time between two checks counted towards deletion-grace-checks")
+	fs.IntVar(&c.MaxDeletions, "max-deletions", c.MaxDeletions, "Maximum number of AthenzDomain CRs deleted per deletion-interval, 0 for no limit")
+	fs.DurationVar(&c.DeletionInterval.Duration, "deletion-interval", c.DeletionInterval.Duration, "Interval of the max-deletions budget")
+	fs.Float64Var(&c.BreakerThreshold, "breaker-threshold", c.BreakerThreshold, "Ratio of ZMS responses reporting a domain missing above which all AthenzDomain CR deletions stop, 0 to disable")
+	fs.IntVar(&c.BreakerMinRequests, "breaker-min-requests", c.BreakerMinRequests, "Minimum number of ZMS responses within breaker-window before the breaker may stop deletions")
+	fs.DurationVar(&c.BreakerWindow.Duration, "breaker-window", c.BreakerWindow.Duration, "Window of ZMS responses the breaker-threshold ratio is computed over, and the minimum time deletions stay stopped")
+	fs.BoolVar(&c.DisableKeepAlives, "disable-keep-alives", c.DisableKeepAlives, "Disable keep alive for zms client")
+	fs.StringVar(&c.LogLocation, "log-location", c.LogLocation, "log location")
+	fs.StringVar(&c.LogMode, "log-mode", c.LogMode, "logger mode")
+	fs.StringVar(&c.IdentityKey, "identity-key", c.IdentityKey, "directory containing private keys for service identity")
+	fs.BoolVar(&c.UseNToken, "use-ntoken", c.UseNToken, "use nToken for zms authentication")
+	fs.StringVar(&c.ServiceName, "service-name", c.ServiceName, "service name")
+	fs.StringVar(&c.ServiceDomain, "service-domain", c.ServiceDomain, "athenz domain that contains k8s-athenz-syncer")
+	fs.StringVar(&c.SecretName, "secret-name", c.SecretName, "secret name that contains private key")
+	fs.StringVar(&c.AuthHeader, "auth-header", c.AuthHeader, "Authentication header field")
+	fs.DurationVar(&c.NTokenExpiry.Duration, "ntoken-expiry", c.NTokenExpiry.Duration, "Custom nToken expiration duration")
+	fs.BoolVar(&c.VerifySignatures, "verify-signatures", c.VerifySignatures, "Verify ZMS signatures of domain data before writing AthenzDomain CRs")
+	fs.StringVar(&c.ZMSPublicKeys, "zms-public-keys", c.ZMSPublicKeys, "PEM bundle of ZMS public keys with Key-Id headers, fetched from the sys.auth domain when empty")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "Address for the Prometheus metrics endpoint, empty to disable")
+	fs.StringVar(&c.HealthAddr, "health-addr", c.HealthAddr, "Address for the /healthz and /readyz endpoints, empty to disable")
+	fs.StringVar(&c.AuthzAddr, "authz-addr", c.AuthzAddr, "Address for the /access authorization check endpoint, empty to disable")
+	fs.DurationVar(&c.ZMSReadyWindow.Duration, "zms-ready-window", c.ZMSReadyWindow.Duration, "Readiness fails when there was no successful ZMS call within this window")
+	fs.DurationVar(&c.StallTimeout.Duration, "stall-timeout", c.StallTimeout.Duration, "Liveness fails when a worker or the update cron is stuck for longer than this timeout")
+	fs.BoolVar(&c.LeaderElect, "leader-elect", c.LeaderElect, "Enable Lease based leader election so that multiple replicas can be run")
+	fs.StringVar(&c.LeaderElectNamespace, "leader-elect-namespace", c.LeaderElectNamespace, "Namespace of the Lease used for leader election")
+	fs.StringVar(&c.LeaderElectName, "leader-elect-name", c.LeaderElectName, "Name of the Lease used for leader election")
+	fs.StringVar(&c.LeaderElectID, "leader-elect-id", c.LeaderElectID, "Identity of this replica for leader election, defaults to the hostname")
+	fs.DurationVar(&c.LeaseDuration.Duration, "leader-elect-lease-duration", c.LeaseDuration.Duration, "Duration that standby replicas wait before trying to acquire a non-renewed lease")
+	fs.DurationVar(&c.RenewDeadline.Duration, "leader-elect-renew-deadline", c.RenewDeadline.Duration, "Duration that the leader retries refreshing the lease before giving up")
+	fs.DurationVar(&c.RetryPeriod.Duration, "leader-elect-retry-period", c.RetryPeriod.Duration, "Duration replicas wait between leader election actions")
+	fs.BoolVar(&c.GenerateRBAC, "generate-rbac", c.GenerateRBAC, "Generate Roles and RoleBindings in the domain namespaces from the policy assertions matching rbac-resource-grammar")
+	fs.StringVar(&c.RBACResourceGrammar, "rbac-resource-grammar", c.RBACResourceGrammar, "Assertion resource grammar with {domain}, {resource} and optional {verb} placeholders, the assertion action is the verb without {verb}")
+	fs.BoolVar(&c.GenerateIstioAuthz, "generate-istio-authz", c.GenerateIstioAuthz, "Generate Istio AuthorizationPolicies in the domain namespaces from the assertions on domain::service resources")
+	fs.StringVar(&c.IstioTrustDomain, "istio-trust-domain", c.IstioTrustDomain, "SPIFFE trust domain of the principals in the generated AuthorizationPolicies")
+	fs.BoolVar(&c.IstioDryRun, "istio-dry-run", c.IstioDryRun, "Only log the AuthorizationPolicy changes instead of applying them")
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", c.Kubeconfig, "(optional) absolute path to the kubeconfig file")
+	fs.BoolVar(&c.InClusterConfig, "inClusterConfig", c.InClusterConfig, "Set to true to use in cluster config.")
+}
+
+// Load - read the yaml config file on top of a copy of the base config and validate the result
+func Load(file string, base *Config) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file %s. Error: %v", file, err)
+	}
+	config := base.DeepCopy()
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("Unable to parse config file %s. Error: %v", file, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s. Error: %v", file, err)
+	}
+	return config, nil
+}
+
+// Validate - check that the settings are usable
+func (c *Config) Validate() error {
+	if c.ZMSURL == "" {
+		return fmt.Errorf("zms-url is required")
+	}
+	durations := []struct {
+		name  string
+		value metav1.Duration
+	}{
+		{"update-cron", c.UpdateCron},
+		{"resync-cron", c.ResyncCron},
+		{"ntoken-expiry", c.NTokenExpiry},
+		{"zms-ready-window", c.ZMSReadyWindow},
+		{"stall-timeout", c.StallTimeout},
+	}
+	if c.LeaderElect {
+		durations = append(durations, []struct {
+			name  string
+			value metav1.Duration
+		}{
+			{"leader-elect-lease-duration", c.LeaseDuration},
+			{"leader-elect-renew-deadline", c.RenewDeadline},
+			{"leader-elect-retry-period", c.RetryPeriod},
+		}...)
+	}
+	for _, d := range durations {
+		if d.value.Duration <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", d.name, d.value.Duration)
+		}
+	}
+	if c.QueueDelayInterval.Duration < 0 {
+		return fmt.Errorf("queue-delay-interval must not be negative, got %s", c.QueueDelayInterval.Duration)
+	}
+	if c.RetryBaseDelay.Duration < 0 {
+		return fmt.Errorf("retry-base-delay must not be negative, got %s", c.RetryBaseDelay.Duration)
+	}
+	if c.RetryMaxDelay.Duration < c.RetryBaseDelay.Duration {
+		return fmt.Errorf("retry-max-delay must not be shorter than retry-base-delay, got %s", c.RetryMaxDelay.Duration)
+	}
+	if c.ContactTimeHorizon.Duration < 0 {
+		return fmt.Errorf("athenz-contact-time-horizon must not be negative, got %s", c.ContactTimeHorizon.Duration)
+	}
+	if c.CompressThreshold < 0 {
+		return fmt.Errorf("compress-threshold must not be negative, got %d", c.CompressThreshold)
+	}
+	if c.StatusInterval.Duration < 0 {
+		return fmt.Errorf("status-update-interval must not be negative, got %s", c.StatusInterval.Duration)
+	}
+	switch c.DeletionPolicy {
+	case cr.DeletionImmediate, cr.DeletionDelayed, cr.DeletionRetain:
+	default:
+		return fmt.Errorf("deletion-policy must be %s, %s or %s, got %q", cr.DeletionImmediate, cr.DeletionDelayed, cr.DeletionRetain, c.DeletionPolicy)
+	}
+	if c.OrphanTTL.Duration < 0 {
+		return fmt.Errorf("orphan-ttl must not be negative, got %s", c.OrphanTTL.Duration)
+	}
+	if c.GraceChecks < 1 {
+		return fmt.Errorf("deletion-grace-checks must be at least 1, got %d", c.GraceChecks)
+	}
+	if c.GraceInterval.Duration < 0 {
+		return fmt.Errorf("deletion-grace-interval must not be negative, got %s", c.GraceInterval.Duration)
+	}
+	if c.MaxDeletions < 0 {
+		return fmt.Errorf("max-deletions must not be negative, got %d", c.MaxDeletions)
+	}
+	if c.MaxDeletions > 0 && c.DeletionInterval.Duration <= 0 {
+		return fmt.Errorf("deletion-interval must be positive, got %s", c.DeletionInterval.Duration)
+	}
+	if c.BreakerThreshold < 0 || c.BreakerThreshold > 1 {
+		return fmt.Errorf("breaker-threshold must be between 0 and 1, got %g", c.BreakerThreshold)
+	}
+	if c.BreakerThreshold > 0 && c.BreakerMinRequests < 1 {
+		return fmt.Errorf("breaker-min-requests must be at least 1, got %d", c.BreakerMinRequests)
+	}
+	if c.BreakerThreshold > 0 && c.BreakerWindow.Duration <= 0 {
+		return fmt.Errorf("breaker-window must be positive, got %s", c.BreakerWindow.Duration)
+	}
+	if c.ZMSQPS < 0 {
+		return fmt.Errorf("zms-qps must not be negative, got %g", c.ZMSQPS)
+	}
+	if c.ZMSQPS > 0 && c.ZMSBurst < 1 {
+		return fmt.Errorf("zms-burst must be at least 1, got %d", c.ZMSBurst)
+	}
+	if c.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1, got %d", c.Workers)
+	}
+	if len(c.SystemNamespaces) > 0 && c.AdminDomain == "" {
+		return fmt.Errorf("admin-domain is required when system-namespaces are set")
+	}
+	if _, err := c.NamespaceFilter(); err != nil {
+		return err
+	}
+	if _, err := logrus.ParseLevel(c.LogMode); err != nil {
+		return fmt.Errorf("log-mode is invalid. Error: %v", err)
+	}
+	if c.LeaderElect && c.LeaseDuration.Duration <= c.RenewDeadline.Duration {
+		return fmt.Errorf("leader-elect-lease-duration must be greater than leader-elect-renew-deadline")
+	}
+	if c.UseNToken && c.ServiceDomain == "" {
+		return fmt.Errorf("service-domain is required when use-ntoken is set")
+	}
+	if c.GenerateIstioAuthz && c.IstioTrustDomain == "" {
+		return fmt.Errorf("istio-trust-domain is required when generate-istio-authz is set")
+	}
+	if c.GenerateRBAC {
+		if _, err := rbac.ParseGrammar(c.RBACResourceGrammar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NamespaceFilter - parse the namespace selectors and regexes into the filter of the namespaces to sync
+func (c *Config) NamespaceFilter() (*util.NamespaceFilter, error) {
+	return util.NewNamespaceFilter(c.IncludeNsSelector, c.ExcludeNsSelector, c.IncludeNsRegex, c.ExcludeNsRegex)
+}
+
+// DeepCopy - copy the config including its lists
+func (c *Config) DeepCopy() *Config {
+	config := *c
+	config.SystemNamespaces = append(StringList{}, c.SystemNamespaces...)
+	config.ExcludeNamespaces = append(StringList{}, c.ExcludeNamespaces...)
+	return &config
+}
+
+// RestartRequired - settings changed between the configs that are only applied on restart
+func RestartRequired(old, new *Config) []string {
+	changed := []string{}
+	oldValue := reflect.ValueOf(*old)
+	newValue := reflect.ValueOf(*new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if liveSettings[field.Name] {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, field.Tag.Get("json"))
+		}
+	}
+	return changed
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+)
+
+func init() {
+	log.InitLogger("/tmp/log/test.log", "info")
+}
+
+// writeConfig - write the yaml config into a temporary directory and return its path
+func writeConfig(t *testing.T, dir, content string) string {
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestAddFlags(t *testing.T) {
+	c := NewConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.AddFlags(fs)
+	err := fs.Parse([]string{"--zms-url=https://zms.athenz.com", "--update-cron=30s", "--exclude-namespaces= kube-public, ,acceptance-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ZMSURL != "https://zms.athenz.com" || c.UpdateCron.Duration != 30*time.Second {
+		t.Errorf("Flags should be set on the config, got %s and %s", c.ZMSURL, c.UpdateCron.Duration)
+	}
+	if !reflect.DeepEqual(c.ExcludeNamespaces, StringList{"kube-public", "acceptance-test"}) {
+		t.Errorf("Expected trimmed list without empty items, got %v", c.ExcludeNamespaces)
+	}
+	if c.ResyncCron.Duration != time.Hour {
+		t.Errorf("Flags not set should keep the default, got %s", c.ResyncCron.Duration)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := tempDir(t)
+	base := NewConfig()
+	base.ZMSURL = "https://zms.athenz.com"
+	base.AdminDomain = "admin.domain"
+
+	file := writeConfig(t, dir, `
+update-cron: 2m
+exclude-namespaces:
+- kube-public
+exclude-msd-rules: true
+`)
+	c, err := Load(file, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UpdateCron.Duration != 2*time.Minute || !c.ExcludeMSDRules || !reflect.DeepEqual(c.ExcludeNamespaces, StringList{"kube-public"}) {
+		t.Errorf("Settings of the config file should be loaded, got %+v", c)
+	}
+	if c.AdminDomain != "admin.domain" || c.ZMSURL != "https://zms.athenz.com" {
+		t.Error("Settings missing from the config file should be taken from the base config")
+	}
+	if base.UpdateCron.Duration != time.Minute {
+		t.Error("Base config should not be modified")
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "unknown setting", content: "update-crons: 2m"},
+		{name: "invalid duration", content: "update-cron: soon"},
+		{name: "invalid setting", content: "workers: 0"},
+		{name: "invalid yaml", content: "exclude-namespaces: [kube-public"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := writeConfig(t, dir, test.content)
+			if _, err := Load(file, base); err == nil {
+				t.Error("Expected an error loading the config file")
+			}
+		})
+	}
+	if _, err := Load(filepath.Join(dir, "missing.yaml"), base); err == nil {
+		t.Error("Expected an error loading a missing config file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		valid  bool
+	}{
+		{name: "valid", modify: func(c *Config) {}, valid: true},
+		{name: "missing zms url", modify: func(c *Config) { c.ZMSURL = "" }},
+		{name: "zero update cron", modify: func(c *Config) { c.UpdateCron.Duration = 0 }},
+		{name: "negative resync cron", modify: func(c *Config) { c.ResyncCron.Duration = -time.Minute }},
+		{name: "negative queue delay", modify: func(c *Config) { c.QueueDelayInterval.Duration = -time.Second }},
+		{name: "unknown deletion policy", modify: func(c *Config) { c.DeletionPolicy = "later" }},
+		{name: "negative orphan ttl", modify: func(c *Config) { c.OrphanTTL.Duration = -time.Hour }},
+		{name: "negative status update interval", modify: func(c *Config) { c.StatusInterval.Duration = -time.Minute }},
+		{name: "no deletion grace checks", modify: func(c *Config) { c.GraceChecks = 0 }},
+		{name: "negative max deletions", modify: func(c *Config) { c.MaxDeletions = -1 }},
+		{name: "breaker threshold above 1", modify: func(c *Config) { c.BreakerThreshold = 1.5 }},
+		{name: "no breaker window", modify: func(c *Config) { c.BreakerWindow.Duration = 0 }},
+		{name: "negative retry base delay", modify: func(c *Config) { c.RetryBaseDelay.Duration = -time.Second }},
+		{name: "retry max delay below base delay", modify: func(c *Config) { c.RetryMaxDelay.Duration = 500 * time.Millisecond }},
+		{name: "no workers", modify: func(c *Config) { c.Workers = 0 }},
+		{name: "system namespaces without admin domain", modify: func(c *Config) { c.SystemNamespaces = StringList{"kube-system"} }},
+		{name: "invalid log mode", modify: func(c *Config) { c.LogMode = "verbose" }},
+		{name: "lease shorter than renew deadline", modify: func(c *Config) {
+			c.LeaderElect = true
+			c.LeaseDuration.Duration = 5 * time.Second
+		}},
+		{name: "ntoken without service domain", modify: func(c *Config) { c.UseNToken = true }},
+		{name: "namespace filter", modify: func(c *Config) {
+			c.IncludeNsSelector = "athenz.io/sync=true"
+			c.ExcludeNsRegex = ".*-sandbox"
+		}, valid: true},
+		{name: "invalid namespace selector", modify: func(c *Config) { c.IncludeNsSelector = "athenz.io/sync in true" }},
+		{name: "invalid namespace regex", modify: func(c *Config) { c.ExcludeNsRegex = "team-(" }},
+		{name: "istio without trust domain", modify: func(c *Config) {
+			c.GenerateIstioAuthz = true
+			c.IstioTrustDomain = ""
+		}},
+		{name: "rbac", modify: func(c *Config) { c.GenerateRBAC = true }, valid: true},
+		{name: "invalid rbac grammar", modify: func(c *Config) {
+			c.GenerateRBAC = true
+			c.RBACResourceGrammar = "{domain}:{verb}"
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewConfig()
+			c.ZMSURL = "https://zms.athenz.com"
+			test.modify(c)
+			err := c.Validate()
+			if test.valid && err != nil {
+				t.Errorf("Expected a valid config. Error: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("Expected a validation error")
+			}
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := NewConfig()
+	new := old.DeepCopy()
+	new.ExcludeNamespaces = StringList{"kube-public"}
+	new.UpdateCron.Duration = time.Hour
+	new.IncludeNsSelector = "athenz.io/sync=true"
+	if changed := RestartRequired(old, new); len(changed) != 0 {
+		t.Errorf("Reloadable settings should not require a restart, got %v", changed)
+	}
+	new.Workers = 4
+	new.ZMSURL = "https://zms.athenz.com"
+	if changed := RestartRequired(old, new); !reflect.DeepEqual(changed, []string{"zms-url", "workers"}) {
+		t.Errorf("Expected zms-url and workers to require a restart, got %v", changed)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := tempDir(t)
+	base := NewConfig()
+	base.ZMSURL = "https://zms.athenz.com"
+	file := writeConfig(t, dir, "update-cron: 2m\n")
+	r, err := NewReloader(file, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.delay = 10 * time.Millisecond
+
+	changes := make(chan *Config, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	err = r.Run(func(old, new *Config) {
+		changes <- new
+	}, stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(t, dir, "update-cron: 3m\nexclude-namespaces: [kube-public]\n")
+	select {
+	case c := <-changes:
+		if c.UpdateCron.Duration != 3*time.Minute || !reflect.DeepEqual(c.ExcludeNamespaces, StringList{"kube-public"}) {
+			t.Errorf("Expected the updated settings, got %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Updated config file was not reloaded")
+	}
+
+	writeConfig(t, dir, "update-cron: 0s\n")
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case c := <-changes:
+		t.Errorf("Invalid config should not be applied, got %+v", c)
+	default:
+	}
+	if r.Config().UpdateCron.Duration != 3*time.Minute {
+		t.Errorf("Previous config should be kept when the config file is invalid, got %s", r.Config().UpdateCron.Duration)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/filewatcher"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/tevino/abool"
+)
+
+// Reloader reloads the config file when it is updated on the filesystem. A config that fails
+// validation is logged and the current config is kept.
+type Reloader struct {
+	l        sync.RWMutex
+	file     string
+	base     *Config
+	config   *Config
+	onChange func(old, new *Config)
+	cond     *abool.AtomicBool
+	// delay groups the file watch events of a single update together
+	delay time.Duration
+}
+
+// NewReloader returns a Reloader holding the config loaded from the file on top of the base config
+func NewReloader(file string, base *Config) (*Reloader, error) {
+	config, err := Load(file, base)
+	if err != nil {
+		return nil, err
+	}
+	return &Reloader{
+		file:   file,
+		base:   base,
+		config: config,
+		cond:   abool.New(),
+		delay:  5 * time.Second,
+	}, nil
+}
+
+// Config returns the latest valid config
+func (r *Reloader) Config() *Config {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	return r.config
+}
+
+// Run starts watching the config file, onChange is called with the previous and the new config
+// whenever a valid change is loaded
+func (r *Reloader) Run(onChange func(old, new *Config), stopCh <-chan struct{}) error {
+	r.l.Lock()
+	r.onChange = onChange
+	r.l.Unlock()
+	// ConfigMap volumes are updated by swapping the ..data symlink, the file itself is never written
+	files := []string{r.file, filepath.Join(filepath.Dir(r.file), "..data")}
+	watcher := filewatcher.NewWatcher(r, files)
+	if err := watcher.Run(stopCh); err != nil {
+		return err
+	}
+	// pick up changes made since the config was loaded
+	r.reload()
+	return nil
+}
+
+// fileUpdate reloads the config, only the first of the concurrent calls reloads after the delay
+func (r *Reloader) fileUpdate() {
+	if r.cond.SetToIf(false, true) {
+		time.Sleep(r.delay)
+		r.reload()
+		r.cond.SetToIf(true, false)
+	}
+}
+
+// FileUpdate spawns a internal fileUpdate go routine.
+func (r *Reloader) FileUpdate() {
+	go r.fileUpdate()
+}
+
+// WatchError will process any errors received from the file watch.
+func (r *Reloader) WatchError(err error) {
+	log.Errorln("Error watching config file:", err)
+}
+
+// reload loads the config file and applies it when it is valid and changed
+func (r *Reloader) reload() {
+	config, err := Load(r.file, r.base)
+	if err != nil {
+		log.Errorf("Keeping the current config. Error: %v", err)
+		return
+	}
+	r.l.Lock()
+	old := r.config
+	if reflect.DeepEqual(old, config) {
+		r.l.Unlock()
+		return
+	}
+	r.config = config
+	onChange := r.onChange
+	r.l.Unlock()
+
+	log.Infof("Loaded updated config file %s", r.file)
+	if changed := RestartRequired(old, config); len(changed) > 0 {
+		log.Warnf("Settings %v changed in config file %s, a restart is required to apply them", changed, r.file)
+	}
+	if onChange != nil {
+		onChange(old, config)
+	}
+}
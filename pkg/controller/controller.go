@@ -19,31 +19,48 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
 	"github.com/ardielle/ardielle-go/rdl"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/workqueue"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
 	athenzClientset "github.com/AthenZ/k8s-athenz-syncer/pkg/client/clientset/versioned"
 	athenzInformer "github.com/AthenZ/k8s-athenz-syncer/pkg/client/informers/externalversions/athenz/v1"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/cron"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/health"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/metrics"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/priorityqueue"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/ratelimiter"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/safety"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/util"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/verifier"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/zmsclient"
+	"github.com/tevino/abool"
 )
 
 const (
-	workerQueueRetry    = 3
-	trustDomainIndexKey = "trustDomain"
+	// failures in a row after which a warning event reports the domain as failing
+	failureEventThreshold = 3
+	trustDomainIndexKey   = "trustDomain"
+	groupDomainIndexKey   = "groupDomain"
+	queueName             = "athenzdomains"
 )
 
 // Controller struct defines how a controller should encapsulate
@@ -51,26 +68,65 @@ const (
 // queueing, and handling of resource changes
 type Controller struct {
 	clientset       kubernetes.Interface
-	queue           workqueue.RateLimitingInterface
+	queue           priorityqueue.Interface
+	rateLimiter     *ratelimiter.RateLimiter
 	nsIndexInformer cache.SharedIndexInformer
-	zmsClient       *zms.ZMSClient
+	zmsClient       zmsclient.Client
+	zmsLimiter      *zmsclient.Limiter
+	guard           *safety.Guard
 	cron            *cron.Cron
 	util            *util.Util
 	cr              *cr.CRUtil
+	leading         *abool.AtomicBool
+	verifier        *verifier.Verifier
+	recorder        record.EventRecorder
+	reconcilers     []DomainReconciler
+}
+
+// DomainReconciler - derives cluster resources from the domain data of an AthenzDomain CR once it is synced
+type DomainReconciler interface {
+	// Reconcile - apply the resources derived from the CR in the namespaces mapped to its domain
+	Reconcile(ctx context.Context, obj *athenz_domain.AthenzDomain, namespaces []string) error
+}
+
+// LeaderElectionConfig - configuration of the Lease lock used to elect the active syncer replica
+type LeaderElectionConfig struct {
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
 }
 
 // NewController returns a Controller with logger, clientset, queue and informer generated
-func NewController(k8sClient kubernetes.Interface, versiondClient athenzClientset.Interface, zmsClient *zms.ZMSClient, updateCron time.Duration, resyncCron time.Duration, delayInterval time.Duration, util *util.Util, cm *cron.AthenzContactTimeConfigMap) *Controller {
-	nsListWatcher := cache.NewListWatchFromClient(k8sClient.CoreV1().RESTClient(), "namespaces", corev1.NamespaceAll, fields.Everything())
-	nsIndexInformer := cache.NewSharedIndexInformer(nsListWatcher, &corev1.Namespace{}, time.Hour, cache.Indexers{})
+func NewController(k8sClient kubernetes.Interface, versiondClient athenzClientset.Interface, zmsClient zmsclient.Client, updateCron time.Duration, resyncCron time.Duration, delayInterval time.Duration, util *util.Util, cm *cron.AthenzContactTimeConfigMap, verifier *verifier.Verifier) *Controller {
+	nsListWatcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return k8sClient.CoreV1().Namespaces().List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return k8sClient.CoreV1().Namespaces().Watch(context.TODO(), options)
+		},
+	}
+	nsIndexInformer := cache.NewSharedIndexInformer(nsListWatcher, &corev1.Namespace{}, time.Hour, namespaceIndexers())
+	// the queue paces the items by the delay interval, the rate limiter delays the retries
 	rateLimiter := ratelimiter.NewRateLimiter(delayInterval)
-	queue := workqueue.NewRateLimitingQueue(rateLimiter)
+	queue := priorityqueue.New(rateLimiter, priorityqueue.Config{
+		Name:            queueName,
+		DelayInterval:   delayInterval,
+		MetricsProvider: metrics.WorkqueueProvider(),
+	})
 	c := &Controller{
 		clientset:       k8sClient,
 		queue:           queue,
+		rateLimiter:     rateLimiter,
 		nsIndexInformer: nsIndexInformer,
 		zmsClient:       zmsClient,
 		util:            util,
+		leading:         abool.New(),
+		verifier:        verifier,
+		recorder:        newEventRecorder(k8sClient),
 	}
 	c.addNSInformerHandlers(nsIndexInformer)
 	// initialize cr informer
@@ -81,6 +137,11 @@ func NewController(k8sClient kubernetes.Interface, versiondClient athenzClientse
 			log.Infof("AthenzDomain CR Add Event Created. Domain: %s", domain)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
+			// status updates written by the syncer do not change the generation and need no sync, a CR
+			// deleted while kept by the orphan finalizer is synced to release it
+			if !specChanged(oldObj, newObj) && !orphanDeleted(oldObj, newObj) {
+				return
+			}
 			domain := c.crinformerhandler(cache.MetaNamespaceKeyFunc, newObj)
 			log.Infof("AthenzDomain CR Update Event Created. Domain: %s", domain)
 		},
@@ -91,12 +152,20 @@ func NewController(k8sClient kubernetes.Interface, versiondClient athenzClientse
 	})
 	crIndexInformer.AddIndexers(cache.Indexers{
 		trustDomainIndexKey: cr.TrustDomainIndexFunc,
+		groupDomainIndexKey: cr.GroupDomainIndexFunc,
 	})
 	c.cr = cr.NewCRUtil(versiondClient, crIndexInformer)
 	c.cron = cron.NewCron(k8sClient, updateCron, resyncCron, "", zmsClient, nsIndexInformer, queue, util, c.cr, cm)
 	return c
 }
 
+// namespaceIndexers - indexers of nsIndexInformer
+func namespaceIndexers() cache.Indexers {
+	return cache.Indexers{
+		util.DomainIndexKey: util.DomainIndexFunc,
+	}
+}
+
 // addNSInformerHandlers - add handlers for nsIndexInformer
 func (c *Controller) addNSInformerHandlers(nsIndexInformer cache.SharedIndexInformer) {
 	nsIndexInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -107,6 +176,7 @@ func (c *Controller) addNSInformerHandlers(nsIndexInformer cache.SharedIndexInfo
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			key := c.nsinformerhandler(cache.MetaNamespaceKeyFunc, newObj)
 			log.Infof("Update cluster namespace: %s", key)
+			c.nsdomainchanged(key, oldObj, newObj)
 		},
 		DeleteFunc: func(obj interface{}) {
 			key := c.nsinformerhandler(cache.DeletionHandlingMetaNamespaceKeyFunc, obj)
@@ -122,15 +192,44 @@ func (c *Controller) nsinformerhandler(fn cache.KeyFunc, obj interface{}) string
 		log.Errorf("Error returned from Key Func in nsInformerHandler. Error: %v", err)
 		return ""
 	}
-	if c.util.IsNamespaceExcluded(key) {
-		log.Infof("Skip processing excluded namespace: %s", key)
-		return key
-	}
 	domain := c.util.NamespaceToDomain(key)
-	c.queue.AddRateLimited(domain)
+	synced := !c.util.IsNamespaceExcluded(key)
+	switch namespace := obj.(type) {
+	case *corev1.Namespace:
+		domain = c.util.GetNamespaceDomain(namespace)
+		synced = c.util.IsNamespaceSynced(namespace)
+	case cache.DeletedFinalStateUnknown:
+		if ns, ok := namespace.Obj.(*corev1.Namespace); ok {
+			domain = c.util.GetNamespaceDomain(ns)
+			synced = c.util.IsNamespaceSynced(ns)
+		}
+	}
+	if !synced {
+		// a namespace that stopped matching the namespace filter leaves its CR behind, which the sync removes
+		if _, exists, _ := c.cr.GetCRByName(domain); !exists {
+			log.Infof("Skip processing excluded namespace: %s", key)
+			return key
+		}
+		log.Infof("Namespace %s is no longer synced, removing AthenzDomain CR %s", key, domain)
+	}
+	c.queue.AddWithPriority(domain, priorityqueue.PriorityHigh)
 	return key
 }
 
+// nsdomainchanged - add the previous domain of an updated namespace to the queue when its domain annotation
+// changed, so that the previous domain is removed when no longer mapped
+func (c *Controller) nsdomainchanged(key string, oldObj, newObj interface{}) {
+	oldNs, oldOk := oldObj.(*corev1.Namespace)
+	newNs, newOk := newObj.(*corev1.Namespace)
+	if !oldOk || !newOk || !c.util.IsNamespaceSynced(oldNs) {
+		return
+	}
+	if oldDomain := c.util.GetNamespaceDomain(oldNs); oldDomain != c.util.GetNamespaceDomain(newNs) {
+		log.Infof("Domain of namespace %s changed from %s", key, oldDomain)
+		c.queue.AddWithPriority(oldDomain, priorityqueue.PriorityHigh)
+	}
+}
+
 // crinformerhandler - helper function for crIndexInformer handler
 func (c *Controller) crinformerhandler(fn cache.KeyFunc, obj interface{}) string {
 	key, err := fn(obj)
@@ -138,12 +237,41 @@ func (c *Controller) crinformerhandler(fn cache.KeyFunc, obj interface{}) string
 		log.Errorf("Error returned from Key Func in crInformerHandler. Error: %v", err)
 		return ""
 	}
-	c.queue.AddRateLimited(key)
+	// CR events are mostly the initial list and the echo of the syncer's own writes, they are not urgent
+	c.queue.AddWithPriority(key, priorityqueue.PriorityLow)
 	return key
 }
 
-// Run is the main path of execution for the controller loop
-func (c *Controller) Run(stopCh <-chan struct{}) {
+// specChanged - check if an AthenzDomain CR update event changed anything but the status
+func specChanged(oldObj, newObj interface{}) bool {
+	oldCR, ok := oldObj.(*athenz_domain.AthenzDomain)
+	if !ok {
+		return true
+	}
+	newCR, ok := newObj.(*athenz_domain.AthenzDomain)
+	if !ok {
+		return true
+	}
+	// the generation is not compared as it also changes on status updates when the CRD has no status subresource
+	return !reflect.DeepEqual(oldCR.Spec, newCR.Spec)
+}
+
+// orphanDeleted - check if an AthenzDomain CR update event set the deletion timestamp of a CR kept by the
+// orphan finalizer, which is only removed by a sync of the domain
+func orphanDeleted(oldObj, newObj interface{}) bool {
+	oldCR, ok := oldObj.(*athenz_domain.AthenzDomain)
+	if !ok {
+		return false
+	}
+	newCR, ok := newObj.(*athenz_domain.AthenzDomain)
+	if !ok {
+		return false
+	}
+	return oldCR.DeletionTimestamp == nil && newCR.DeletionTimestamp != nil && cr.HasOrphanFinalizer(newCR)
+}
+
+// Run is the main path of execution for the controller loop, processing the queue with the given number of workers
+func (c *Controller) Run(workers int, stopCh <-chan struct{}) {
 	// handle a panic with logging and exiting
 	defer utilruntime.HandleCrash()
 	// ignore new items in the queue but when all goroutines
@@ -151,7 +279,137 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 	defer c.queue.ShutDown()
 
 	log.Info("Controller.Run: initiating")
+	if !c.startInformers(stopCh) {
+		return
+	}
+	c.runLeader(workers, stopCh)
+}
+
+// RunWithLeaderElection runs the controller loop only while this replica holds the Lease lock.
+// Informers are started and synced on every replica so that standbys can take over without delay.
+func (c *Controller) RunWithLeaderElection(workers int, stopCh <-chan struct{}, config LeaderElectionConfig) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	log.Infof("Controller.RunWithLeaderElection: initiating with identity %s", config.Identity)
+	if !c.startInformers(stopCh) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: config.Namespace,
+			Name:      config.Name,
+		},
+		Client: c.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: config.Identity,
+		},
+	}
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            config.Name,
+		LeaseDuration:   config.LeaseDuration,
+		RenewDeadline:   config.RenewDeadline,
+		RetryPeriod:     config.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Infof("Acquired leader lease %s/%s", config.Namespace, config.Name)
+				c.runLeader(workers, ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				c.leading.UnSet()
+				// a graceful shutdown releases the lease, anything else means the lease was lost
+				// and the process exits so that the crons and workers are not left running
+				if ctx.Err() != nil {
+					log.Infof("Released leader lease %s/%s", config.Namespace, config.Name)
+					return
+				}
+				log.Fatalf("Lost leader lease %s/%s, exiting", config.Namespace, config.Name)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != config.Identity {
+					log.Infof("Current leader is %s, running as standby", identity)
+				}
+			},
+		},
+	})
+}
+
+// IsLeader returns true while the controller is running the crons and workers
+func (c *Controller) IsLeader() bool {
+	return c.leading.IsSet()
+}
+
+// CRStore returns the informer cache of the AthenzDomain CRs, which is kept in sync on every replica
+func (c *Controller) CRStore() cache.Store {
+	return c.cr.CrIndexInformer.GetStore()
+}
+
+// SetDryRun enables the dry run mode in which syncs log the changes they would make to the AthenzDomain
+// CRs instead of writing them. It must be called before the controller is run.
+func (c *Controller) SetDryRun(dryRun bool) {
+	c.cr.SetDryRun(dryRun)
+}
+
+// SetCompressThreshold stores the domain data of the AthenzDomain CRs compressed when its json exceeds the
+// threshold in bytes, 0 disables compression. It must be called before the controller is run.
+func (c *Controller) SetCompressThreshold(threshold int) {
+	c.cr.SetCompressThreshold(threshold)
+}
+
+// SetStatusUpdateInterval writes the status of an AthenzDomain CR whose sync outcome is unchanged at most once
+// per interval, 0 writes it on every sync. It must be called before the controller is run.
+func (c *Controller) SetStatusUpdateInterval(interval time.Duration) {
+	c.cr.SetStatusUpdateInterval(interval)
+}
+
+// SetRetryBackoff sets the exponential backoff of the retries of a failing domain, starting at baseDelay
+// and doubling up to maxDelay. Without it the retries are only spaced by the delay interval.
+func (c *Controller) SetRetryBackoff(baseDelay, maxDelay time.Duration) {
+	c.rateLimiter.SetBackoff(baseDelay, maxDelay)
+}
+
+// SetDeletionPolicy sets the policy applied to the AthenzDomain CRs of domains that are no longer mapped,
+// cr.DeletionImmediate, cr.DeletionDelayed with the orphan TTL or cr.DeletionRetain
+func (c *Controller) SetDeletionPolicy(policy string, ttl time.Duration) {
+	c.cr.SetDeletionPolicy(policy, ttl)
+}
+
+// SetDeletionGuard sets the guard that holds back deletions of AthenzDomain CRs during ZMS incidents,
+// all deletions are allowed without it
+func (c *Controller) SetDeletionGuard(guard *safety.Guard) {
+	c.guard = guard
+}
 
+// SetZMSLimiter sets the limiter of the ZMS requests, whose pause delays the retries of throttled syncs
+func (c *Controller) SetZMSLimiter(limiter *zmsclient.Limiter) {
+	c.zmsLimiter = limiter
+}
+
+// SetCronIntervals changes the update cron and full resync cron intervals while running
+func (c *Controller) SetCronIntervals(updateCron, resyncCron time.Duration) {
+	c.cron.SetIntervals(updateCron, resyncCron)
+}
+
+// Resync adds all domains to the queue, used when settings changing which domains are synced or
+// how they are written are reloaded. Only the leader processes the queue.
+func (c *Controller) Resync() {
+	if c.IsLeader() {
+		c.cron.ResyncAll()
+	}
+}
+
+// startInformers runs the namespace and AthenzDomain informers and waits for their caches to sync
+func (c *Controller) startInformers(stopCh <-chan struct{}) bool {
 	// run the nsinformer and crinformer to start listing and watching resources
 	go c.nsIndexInformer.Run(stopCh)
 	go c.cr.CrIndexInformer.Run(stopCh)
@@ -159,20 +417,84 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 	// do the initial synchronization (one time) to populate resources
 	if !cache.WaitForCacheSync(stopCh, c.nsIndexInformer.HasSynced, c.cr.CrIndexInformer.HasSynced) {
 		utilruntime.HandleError(fmt.Errorf("Error syncing cache"))
-		return
+		return false
 	}
 	log.Info("Controller.Run: cache sync complete")
+	health.SetInformersSynced(true)
+	return true
+}
+
+// WaitForCaches starts the informers and waits for their caches to be synced, the informers stop with stopCh.
+// It is used to sync or diff single domains with SyncDomain and DiffDomain without running the controller.
+func (c *Controller) WaitForCaches(stopCh <-chan struct{}) error {
+	if !c.startInformers(stopCh) {
+		return errors.New("Unable to sync the namespace and AthenzDomain informer caches")
+	}
+	return nil
+}
+
+// SyncDomain syncs the AthenzDomain CR of the domain once, outside of the workqueue, and returns the action taken.
+// Domains that are not mapped are refused, their CRs are only orphaned or deleted by the controller itself so that
+// a mistyped domain name can not remove live state.
+func (c *Controller) SyncDomain(domain string) (string, error) {
+	if !c.cron.ValidateDomain(domain) {
+		return metrics.ResultError, fmt.Errorf("Domain %s is not mapped to a namespace, admin, system, trust or group domain", domain)
+	}
+	return c.sync(domain)
+}
 
-	timestamp := c.cr.GetLatestTimestamp()
-	c.cron.SetEtag(timestamp)
+// DiffDomain computes the changes a sync of the domain would make to its AthenzDomain CR without writing it
+func (c *Controller) DiffDomain(domain string) (*cr.DomainDiff, error) {
+	if !c.cron.ValidateDomain(domain) {
+		return c.cr.Diff(domain, nil)
+	}
+	result, exist, err := c.zmsGetSignedDomains(domain)
+	if err != nil {
+		if rdlErr, ok := err.(rdl.ResourceError); ok && rdlErr.Code == 404 {
+			return c.cr.Diff(domain, nil)
+		}
+		return nil, fmt.Errorf("Unable to fetch domain %s from ZMS. Error: %v", domain, err)
+	}
+	if exist {
+		for _, domainData := range result.Domains {
+			if domainData.Domain.Name == zms.DomainName(domain) {
+				return c.cr.Diff(domain, domainData)
+			}
+		}
+	}
+	return c.cr.Diff(domain, nil)
+}
+
+// runLeader starts the update and resync crons and processes the queue until stopCh is closed
+func (c *Controller) runLeader(workers int, stopCh <-chan struct{}) {
+	c.leading.Set()
+	defer c.leading.UnSet()
+	health.SetLeading(true)
+	defer health.SetLeading(false)
+
+	etag, resumed := c.cron.ResumeEtag()
+	c.cron.SetEtag(etag)
 	go c.cron.UpdateCron(stopCh)
 	go c.cron.FullResync(stopCh)
 
-	// add all admin domain and system namespaces to the queue initially
-	c.cron.AddAdminSystemDomains()
+	if resumed {
+		// add all admin domain and system namespaces to the queue initially
+		c.cron.AddAdminSystemDomains()
+	} else {
+		// changes since the last run are unknown, domains deleted in ZMS are only found by syncing all of them
+		c.cron.ResyncAll()
+	}
 
-	// run the runWorker method every second with a stop channel
-	wait.Until(c.runWorker, time.Second, stopCh)
+	// run the runWorker method every second with a stop channel. The workqueue never hands
+	// out a key that is still being processed, so a domain is only synced by one worker at a time
+	if workers < 1 {
+		workers = 1
+	}
+	log.Infof("Controller.Run: starting %d workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
 }
 
 // runWorker executes the loop to process new items added to the queue
@@ -209,66 +531,144 @@ func (c *Controller) processNextItem() bool {
 		log.Errorf("string cast failed. Key object: %v", key)
 		return true
 	}
+	health.StartItem(domainName)
+	defer health.FinishItem(domainName)
 	log.Info("Processing key: ", domainName)
 
 	// process item that is popped off
-	err := c.sync(domainName)
+	result, err := c.sync(domainName)
 	// retry when there is a 429 or there is something wrong with create/update CR
-	if err != nil {
-		if c.queue.NumRequeues(domainName) < workerQueueRetry {
-			c.queue.AddRateLimited(domainName)
-			log.Infof("Error processing AthenzDomain CR (name: %s) in Athenz database: %v. Retrying...", domainName, err)
+	if deferred, ok := err.(*safety.DeferredError); ok {
+		// deferred deletions are checked again later, they are not failures of the domain
+		metrics.RecordSync(metrics.ResultDeferred)
+		log.Infof("%v. Checking again in %s", deferred, deferred.RetryAfter)
+		c.queue.AddAfter(domainName, deferred.RetryAfter)
+	} else if err != nil {
+		metrics.RecordSync(metrics.ResultError)
+		if zmsclient.IsThrottled(err) {
+			// retried once ZMS takes requests again, throttling does not use up the retries of the domain
+			metrics.RecordRetry()
+			delay := c.zmsLimiter.RetryDelay()
+			log.Infof("ZMS throttled the sync of AthenzDomain CR (name: %s). Retrying in %s", domainName, delay)
+			c.queue.AddAfter(domainName, delay)
 		} else {
-			c.queue.Forget(key)
-			log.Infof("Error processing AthenzDomain CR (name: %s) in Athenz database. End of Retry.", domainName)
+			// failing domains stay in the queue until they sync, backing off further with every failure
+			c.queue.AddRateLimited(domainName)
+			failures := c.queue.NumRequeues(domainName)
+			metrics.RecordRetry()
+			metrics.SetDomainFailures(domainName, failures)
+			log.Infof("Error processing AthenzDomain CR (name: %s) in Athenz database: %v. Retrying after %d consecutive failures...", domainName, err, failures)
+			if failures == failureEventThreshold {
+				c.recordEvent(domainName, nil, corev1.EventTypeWarning, ReasonSyncFailing, "Syncing domain %s failed %d times in a row, retrying with backoff: %v", domainName, failures, err)
+			}
 		}
+	} else {
+		// reset the backoff so that later failures start over from the base delay
+		c.queue.Forget(key)
+		c.cron.MarkSynced(domainName)
+		metrics.ClearDomainFailures(domainName)
+		metrics.RecordSync(result)
 	}
 
 	// keep the worker loop running by returning true
 	return true
 }
 
-// sync - process queue item
-func (c *Controller) sync(domain string) error {
+// sync - process queue item and return the action taken on the AthenzDomain CR
+func (c *Controller) sync(domain string) (string, error) {
 	// if this domain is not a valid domain(a domain that we want to sync) then we attempt to remove it
 	valid := c.cron.ValidateDomain(domain)
 	if !valid {
-		log.Errorf("Domain %s is an invalid domain (not part of namespace, admin domain, system domain or trust domain)", domain)
-		return c.cr.RemoveAthenzDomain(context.TODO(), domain)
+		log.Errorf("Domain %s is an invalid domain (not part of namespace, admin domain, system domain, trust domain or group domain)", domain)
+		return c.orphanAthenzDomain(domain, "domain is not mapped to a namespace, admin, system, trust or group domain")
+	}
+	if err := c.adoptAthenzDomain(domain); err != nil {
+		return metrics.ResultError, err
+	}
+	if namespaces := c.cron.DomainNamespaces(domain); len(namespaces) > 1 {
+		log.Warnf("Namespaces %v are all mapped to domain %s", namespaces, domain)
+		c.recordEvent(domain, nil, corev1.EventTypeWarning, ReasonDomainConflict, "Namespaces %s are all mapped to Athenz domain %s, only one namespace should be named after or annotated with %s=%s", strings.Join(namespaces, ", "), domain, util.DomainAnnotation, domain)
 	}
 	result, exist, err := c.zmsGetSignedDomains(domain)
 	if err != nil {
 		log.Errorf("Error while making ZMS get signed domainName (%s): %v", domain, err)
+		// never write unverified data, keep the existing CR and flag it instead
+		if _, ok := err.(*verifier.VerificationError); ok {
+			c.recordEvent(domain, nil, corev1.EventTypeWarning, ReasonSignatureInvalid, "Refusing to write unverified domain data: %v", err)
+			c.updateStatus(domain, nil, cr.SyncStatus{
+				Err:               err,
+				ZMSReachable:      true,
+				SignatureVerified: metav1.ConditionFalse,
+			})
+			return metrics.ResultError, err
+		}
 		rdl, ok := err.(rdl.ResourceError)
 		if !ok {
-			return errors.New("Error occurred when converting error types")
+			c.recordEvent(domain, nil, corev1.EventTypeWarning, ReasonZMSError, "Unable to fetch domain %s from ZMS: %v", domain, err)
+			c.updateStatus(domain, nil, cr.SyncStatus{Err: err})
+			return metrics.ResultError, errors.New("Error occurred when converting error types")
 		}
 		// if return 404 error, remove AthenzDomains CR
 		if rdl.Code == 404 {
-			return c.cr.RemoveAthenzDomain(context.TODO(), domain)
-		}
-		obj, exists, err := c.cr.GetCRByName(domain)
-		if err != nil {
-			return err
+			return c.removeAthenzDomain(domain, "domain was not found in ZMS", true)
 		}
-		if exists {
-			obj.Status.Message = err.Error()
-			c.cr.UpdateErrorStatus(context.TODO(), obj)
-		}
-		return err
+		c.recordEvent(domain, nil, corev1.EventTypeWarning, ReasonZMSError, "Unable to fetch domain %s from ZMS: %v", domain, err)
+		c.updateStatus(domain, nil, cr.SyncStatus{Err: err})
+		return metrics.ResultError, err
 	}
 	if !exist {
 		log.Errorf("Did not find DomainName: %s in ZMS.", domain)
-		return c.cr.RemoveAthenzDomain(context.TODO(), domain)
+		return c.removeAthenzDomain(domain, "ZMS returned no data for the domain", true)
 	}
+	action := metrics.ResultUnchanged
 	zmsDomainName := zms.DomainName(domain)
 	for _, domainData := range result.Domains {
 		if domainData.Domain.Name == zmsDomainName {
-			_, err := c.cr.CreateUpdateAthenzDomain(context.TODO(), domain, domainData)
-			if err != nil {
-				return fmt.Errorf("Error occurred when creating AthenzDomain custom resources. Error: %v", err)
+			c.guard.Found(domain)
+			var obj *athenz_domain.AthenzDomain
+			if c.cr.DryRun() {
+				diff, err := c.cr.Diff(domain, domainData)
+				if err != nil {
+					return metrics.ResultError, err
+				}
+				action = reportDiff(diff)
+			} else {
+				_, crExists, err := c.cr.GetCRByName(domain)
+				if err != nil {
+					return metrics.ResultError, err
+				}
+				verified := metav1.ConditionUnknown
+				if c.verifier != nil {
+					verified = metav1.ConditionTrue
+				}
+				obj, err = c.cr.CreateUpdateAthenzDomain(context.TODO(), domain, domainData)
+				if err != nil {
+					err = fmt.Errorf("Error occurred when creating AthenzDomain custom resources. Error: %v", err)
+					c.recordEvent(domain, nil, corev1.EventTypeWarning, ReasonSyncFailed, "Unable to write AthenzDomain: %v", err)
+					c.updateStatus(domain, nil, cr.SyncStatus{
+						Err:               err,
+						ZMSReachable:      true,
+						SignatureVerified: verified,
+					})
+					return metrics.ResultError, err
+				}
+				if obj != nil {
+					action = metrics.ResultCreated
+					if crExists {
+						action = metrics.ResultUpdated
+						c.recordEvent(domain, obj, corev1.EventTypeNormal, ReasonUpdated, "Updated AthenzDomain %s with domain data modified in ZMS at %s", domain, domainData.Domain.Modified)
+					} else {
+						c.recordEvent(domain, obj, corev1.EventTypeNormal, ReasonCreated, "Created AthenzDomain %s from ZMS", domain)
+					}
+				}
+				log.Infof("Successfully created/updated new AthenzDomains CR: %v", zmsDomainName)
+				modified := metav1.NewTime(domainData.Domain.Modified.Time)
+				c.updateStatus(domain, obj, cr.SyncStatus{
+					ZMSReachable:      true,
+					SignatureVerified: verified,
+					Modified:          &modified,
+				})
 			}
-			log.Infof("Successfully created/updated new AthenzDomains CR: %v", zmsDomainName)
 			// parse domain data and add trust domains to the queue
 			for _, role := range domainData.Domain.Roles {
 				if role != nil && string(role.Trust) != "" && role.Trust != zmsDomainName {
@@ -280,37 +680,236 @@ func (c *Controller) sync(domain string) error {
 					if !exists {
 						// Here the logic is to check if current domain is a namespace existing in the cluster, if so, add the trust domain to the queue
 						// otherwise, we should skip processing trust domain as athenz zms only checks one level above for delegated domains.
-						_, nsExists, err := c.nsIndexInformer.GetStore().GetByKey(c.util.DomainToNamespace(domain))
-						if err != nil {
-							log.Errorf("Error checking domain's corresponding namespace in namespace cache store. Error: %v", err)
-							continue
-						}
+						nsExists := len(c.cron.DomainNamespaces(domain)) > 0
 						if nsExists || c.util.IsAdminDomain(domain) {
-							c.queue.AddRateLimited(string(role.Trust))
+							c.queue.AddWithPriority(string(role.Trust), priorityqueue.PriorityMedium)
+							c.recordEvent(domain, obj, corev1.EventTypeNormal, ReasonTrustDomainDiscovered, "Role %s delegates to trust domain %s, syncing it", role.Name, role.Trust)
 						}
 					}
 				}
 			}
+			c.syncGroupDomains(domain, obj, domainData.Domain)
+			// derived resources are left untouched in dry run mode
+			if c.cr.DryRun() {
+				continue
+			}
+			// the domains with group members of this domain are synced again so that their derived
+			// resources see the new group membership
+			if action == metrics.ResultCreated || action == metrics.ResultUpdated {
+				for _, dependent := range c.cr.GroupDomainDependents(domain) {
+					log.Infof("Group domain %s changed, syncing dependent domain %s", domain, dependent)
+					c.queue.AddWithPriority(dependent, priorityqueue.PriorityMedium)
+				}
+			}
+			if err := c.reconcile(domain, obj); err != nil {
+				return metrics.ResultError, err
+			}
+		}
+	}
+	return action, nil
+}
+
+// syncGroupDomains - add the domains owning groups that are members of the roles of the domain to the queue when
+// they have no AthenzDomain CR yet, so that consumers can expand the group members. Like trust domains, group
+// domains are only followed one level from the domains of the namespaces and the admin domain.
+func (c *Controller) syncGroupDomains(domain string, obj *athenz_domain.AthenzDomain, domainData *zms.DomainData) {
+	if len(c.cron.DomainNamespaces(domain)) == 0 && !c.util.IsAdminDomain(domain) {
+		return
+	}
+	for _, groupDomain := range cr.GroupDomains(domainData) {
+		_, exists, err := c.cr.CrIndexInformer.GetStore().GetByKey(groupDomain)
+		if err != nil {
+			log.Errorf("Error checking group domain in cache. Error: %v", err)
+			continue
+		}
+		if !exists {
+			c.queue.AddWithPriority(groupDomain, priorityqueue.PriorityMedium)
+			c.recordEvent(domain, obj, corev1.EventTypeNormal, ReasonGroupDomainDiscovered, "Roles have members that are groups of domain %s, syncing it", groupDomain)
 		}
 	}
+}
+
+// DomainNamespaces - get the synced namespaces mapped to the domain by their name or their domain annotation
+func (c *Controller) DomainNamespaces(domain string) []string {
+	return c.cron.DomainNamespaces(domain)
+}
+
+// AddReconciler - run the reconciler after every successful sync of a domain
+func (c *Controller) AddReconciler(reconciler DomainReconciler) {
+	c.reconcilers = append(c.reconcilers, reconciler)
+}
+
+// reconcile - run the reconcilers on the synced CR, obj is the CR written by the sync or nil when it was
+// unchanged in which case the informer store is used
+func (c *Controller) reconcile(domain string, obj *athenz_domain.AthenzDomain) error {
+	if len(c.reconcilers) == 0 {
+		return nil
+	}
+	if obj == nil {
+		cr, exists, err := c.cr.GetCRByName(domain)
+		if err != nil || !exists {
+			return err
+		}
+		obj = cr
+	}
+	namespaces := c.cron.DomainNamespaces(domain)
+	for _, reconciler := range c.reconcilers {
+		if err := reconciler.Reconcile(context.TODO(), obj, namespaces); err != nil {
+			err = fmt.Errorf("Error occurred when reconciling resources derived from AthenzDomain %s. Error: %v", domain, err)
+			c.recordEvent(domain, obj, corev1.EventTypeWarning, ReasonReconcileFailed, "Unable to apply resources derived from AthenzDomain: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// updateStatus - record the outcome of the sync on the AthenzDomain CR status, failures are only logged
+// as the next sync records the status again
+func (c *Controller) updateStatus(domain string, obj *athenz_domain.AthenzDomain, result cr.SyncStatus) {
+	if err := c.cr.UpdateSyncStatus(context.TODO(), domain, obj, result); err != nil {
+		log.Errorf("Unable to record sync status of AthenzDomain CR %s. Error: %v", domain, err)
+	}
+}
+
+// orphanAthenzDomain - apply the deletion policy to the AthenzDomain CR of a domain that is no longer mapped:
+// it is removed right away with the immediate policy, otherwise it is marked orphaned and removed once
+// the policy allows it
+func (c *Controller) orphanAthenzDomain(domain, reason string) (string, error) {
+	policy := c.cr.DeletionPolicy()
+	if policy == cr.DeletionImmediate {
+		return c.removeAthenzDomain(domain, reason, false)
+	}
+	obj, exists, err := c.cr.GetCRByName(domain)
+	if err != nil {
+		return metrics.ResultError, err
+	}
+	if !exists {
+		return metrics.ResultUnchanged, nil
+	}
+	if _, orphaned := cr.OrphanedAt(obj); orphaned {
+		if c.cr.OrphanExpired(obj, time.Now()) {
+			return c.removeAthenzDomain(domain, fmt.Sprintf("%s, orphaned CR reaped under the %s deletion policy", reason, policy), false)
+		}
+		return metrics.ResultUnchanged, nil
+	}
+	if err := c.cr.MarkOrphaned(context.TODO(), obj, time.Now()); err != nil {
+		return metrics.ResultError, err
+	}
+	c.recordEvent(domain, obj, corev1.EventTypeWarning, ReasonOrphaned, "Marked AthenzDomain %s orphaned under the %s deletion policy: %s", domain, policy, reason)
+	return metrics.ResultUpdated, nil
+}
+
+// adoptAthenzDomain - remove the orphaned mark of the AthenzDomain CR of a domain that is mapped again
+func (c *Controller) adoptAthenzDomain(domain string) error {
+	obj, exists, err := c.cr.GetCRByName(domain)
+	if err != nil || !exists {
+		return err
+	}
+	if _, orphaned := cr.OrphanedAt(obj); !orphaned {
+		return nil
+	}
+	if err := c.cr.UnmarkOrphaned(context.TODO(), obj); err != nil {
+		return err
+	}
+	c.recordEvent(domain, obj, corev1.EventTypeNormal, ReasonAdopted, "AthenzDomain %s is no longer orphaned, the domain is mapped again", domain)
 	return nil
 }
 
+// removeAthenzDomain - remove the AthenzDomain CR of the domain if it exists and return the action taken,
+// the reason is reported in the events emitted for the deletion. Deletions of domains missing from ZMS
+// are subject to the circuit breaker and grace period of the deletion guard, all deletions to its budget.
+func (c *Controller) removeAthenzDomain(domain, reason string, missingFromZMS bool) (string, error) {
+	obj, exists, err := c.cr.GetCRByName(domain)
+	if err != nil {
+		return metrics.ResultError, err
+	}
+	if !exists {
+		return metrics.ResultUnchanged, nil
+	}
+	if missingFromZMS {
+		if err := c.guard.Missing(domain); err != nil {
+			return c.deferDeletion(domain, obj, reason, err)
+		}
+	}
+	if c.cr.DryRun() {
+		diff, err := c.cr.Diff(domain, nil)
+		if err != nil {
+			return metrics.ResultError, err
+		}
+		log.Infof("Dry run: AthenzDomain %s would be deleted: %s", domain, reason)
+		return reportDiff(diff), nil
+	}
+	if err := c.guard.Delete(domain); err != nil {
+		return c.deferDeletion(domain, obj, reason, err)
+	}
+	if err := c.cr.RemoveAthenzDomain(context.TODO(), domain); err != nil {
+		c.recordEvent(domain, obj, corev1.EventTypeWarning, ReasonSyncFailed, "Unable to delete AthenzDomain %s (%s): %v", domain, reason, err)
+		return metrics.ResultError, err
+	}
+	c.recordEvent(domain, obj, corev1.EventTypeWarning, ReasonDeleted, "Deleted AthenzDomain %s: %s", domain, reason)
+	return metrics.ResultDeleted, nil
+}
+
+// deferDeletion - report an AthenzDomain CR deletion held back by the deletion guard
+func (c *Controller) deferDeletion(domain string, obj *athenz_domain.AthenzDomain, reason string, err error) (string, error) {
+	if deferred, ok := err.(*safety.DeferredError); ok {
+		metrics.RecordDeletionDeferred(deferred.Reason)
+	}
+	log.Warnf("Keeping AthenzDomain %s although %s: %v", domain, reason, err)
+	c.recordEvent(domain, obj, corev1.EventTypeWarning, ReasonDeletionDeferred, "Keeping AthenzDomain %s although %s: %v", domain, reason, err)
+	return metrics.ResultDeferred, err
+}
+
+// reportDiff - log and record the changes a dry run sync would make to the AthenzDomain CR and return
+// the result the sync would have
+func reportDiff(diff *cr.DomainDiff) string {
+	if diff.Action == cr.ActionNone {
+		return metrics.ResultUnchanged
+	}
+	log.Infof("Dry run: %s", diff)
+	metrics.RecordDryRunAction(diff.Action)
+	metrics.RecordDryRunChanges("role", len(diff.RolesAdded), len(diff.RolesRemoved))
+	metrics.RecordDryRunChanges("member", len(diff.MembersAdded), len(diff.MembersRemoved))
+	metrics.RecordDryRunChanges("policy", len(diff.PoliciesAdded), len(diff.PoliciesRemoved))
+	metrics.RecordDryRunChanges("assertion", len(diff.AssertionsAdded), len(diff.AssertionsRemoved))
+	switch diff.Action {
+	case cr.ActionCreate:
+		return metrics.ResultCreated
+	case cr.ActionDelete:
+		return metrics.ResultDeleted
+	default:
+		return metrics.ResultUpdated
+	}
+}
+
 // zmsGetSignedDomains - make http request to zms API to fetch domain data
 func (c *Controller) zmsGetSignedDomains(domain string) (*zms.SignedDomains, bool, error) {
 	d := zms.DomainName(domain)
 	master := false
 	conditions := false
+	start := time.Now()
 	signedDomain, _, err := c.zmsClient.GetSignedDomains(d, "", "", &master, &conditions, "")
+	metrics.ObserveZMSRequest(metrics.CallGetSignedDomain, start, err)
 	if err != nil {
 		return nil, false, err
 	}
+	health.RecordZMSSuccess()
 	// Currently for GetSignedDomains API call, it returns {"domains":[]} when domain (d) passed in does not exist in Athenz
 	if len(signedDomain.Domains) == 0 {
 		log.Error("SignedDomain call returned an empty list")
 		return nil, false, nil
 	}
 
+	// signatures cover the domain data as returned by ZMS, so verify before any filtering
+	if c.verifier != nil {
+		for _, domainData := range signedDomain.Domains {
+			if err := c.verifier.VerifySignedDomain(domainData); err != nil {
+				metrics.RecordSignatureFailure()
+				return nil, false, err
+			}
+		}
+	}
+
 	for i := range signedDomain.Domains {
 		signedDomain.Domains[i].Domain = c.util.FilterMSDRules(signedDomain.Domains[i].Domain)
 	}
@@ -17,25 +17,49 @@ package controller
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/AthenZ/athenz/clients/go/zms"
 	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/client/clientset/versioned/fake"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/cron"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/metrics"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/priorityqueue"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/safety"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/util"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/verifier"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/zmsclient"
+	fakezms "github.com/AthenZ/k8s-athenz-syncer/pkg/zmsclient/fake"
 	"github.com/ardielle/ardielle-go/rdl"
 	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 )
 
@@ -54,10 +78,26 @@ func newController() *Controller {
 		Name:      "athenzcall-config",
 		Key:       "latest_contact",
 	}
-	newCtl := NewController(clientset, athenzclientset, &zmsclient, time.Minute, time.Hour, 250*time.Millisecond, util, cm)
+	newCtl := NewController(clientset, athenzclientset, &zmsclient, time.Minute, time.Hour, 250*time.Millisecond, util, cm, nil)
 	return newCtl
 }
 
+// newSignedZMS - start a fake ZMS server signing the domains it serves and a verifier trusting its key
+func newSignedZMS(t *testing.T) (*fakezms.Server, *verifier.Verifier) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fakezms.NewServer()
+	server.SetSigningKey("zms.0", key)
+	v, err := verifier.NewVerifier(server.Client(), "")
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, v
+}
+
 func getFakeDomain() zms.SignedDomain {
 	t := true
 	f := false
@@ -178,7 +218,8 @@ func TestZmsGetSignedDomains(t *testing.T) {
 	httpClient, teardown := testingHTTPClient(h)
 	defer teardown()
 	c := newController()
-	c.zmsClient.Transport = httpClient.Transport
+	zmsClient := zms.NewClient("https://zms.athenz.com", httpClient.Transport)
+	c.zmsClient = &zmsClient
 	res, _, err := c.zmsGetSignedDomains(domainName)
 	if err != nil {
 		t.Error("Failed to get signed domain", err)
@@ -254,7 +295,7 @@ func TestNsinformerhandler(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			c := newController()
 			c.util = util.NewUtil("admin.domain", []string{"kube-system"}, tt.excludedNS, false)
-			mockQueue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+			mockQueue := priorityqueue.New(workqueue.DefaultControllerRateLimiter(), priorityqueue.Config{})
 			c.queue = mockQueue
 
 			result := c.nsinformerhandler(tt.keyFunc, &athenz_domain.AthenzDomain{})
@@ -280,3 +321,1087 @@ func TestNsinformerhandler(t *testing.T) {
 		})
 	}
 }
+
+// TestRemoveAthenzDomain - test the action reported when removing AthenzDomain CRs
+func TestRemoveAthenzDomain(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	c := newController()
+	result, err := c.removeAthenzDomain(domainName, "domain was not found in ZMS", true)
+	if err != nil {
+		t.Error(err)
+	}
+	if result != metrics.ResultUnchanged {
+		t.Errorf("Expected %s result when no CR exists, got %s", metrics.ResultUnchanged, result)
+	}
+
+	d := getFakeDomain()
+	cr, err := c.cr.CreateUpdateAthenzDomain(context.TODO(), domainName, &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cr.CrIndexInformer.GetStore().Add(cr)
+	result, err = c.removeAthenzDomain(domainName, "domain was not found in ZMS", true)
+	if err != nil {
+		t.Error(err)
+	}
+	if result != metrics.ResultDeleted {
+		t.Errorf("Expected %s result when CR exists, got %s", metrics.ResultDeleted, result)
+	}
+}
+
+// newEmptyCRInformer - AthenzDomain informer backed by an empty list for tests that run the informers
+func newEmptyCRInformer() cache.SharedIndexInformer {
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return &athenz_domain.AthenzDomainList{}, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}
+	return cache.NewSharedIndexInformer(lw, &athenz_domain.AthenzDomain{}, 0, cache.Indexers{
+		trustDomainIndexKey: cr.TrustDomainIndexFunc,
+		groupDomainIndexKey: cr.GroupDomainIndexFunc,
+	})
+}
+
+// TestRunWithLeaderElection - test that only one of two replicas runs as leader and that the standby takes over
+func TestRunWithLeaderElection(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	athenzclientset := fake.NewSimpleClientset()
+	clientset := k8sfake.NewSimpleClientset()
+	zmsclient := zms.NewClient("https://127.0.0.1:1", &http.Transport{})
+	util := util.NewUtil("admin.domain", []string{}, []string{}, false)
+	cm := &cron.AthenzContactTimeConfigMap{
+		Namespace: "kube-yahoo",
+		Name:      "athenzcall-config",
+		Key:       "latest_contact",
+	}
+	replicas := []*Controller{
+		NewController(clientset, athenzclientset, &zmsclient, time.Minute, time.Hour, 250*time.Millisecond, util, cm, nil),
+		NewController(clientset, athenzclientset, &zmsclient, time.Minute, time.Hour, 250*time.Millisecond, util, cm, nil),
+	}
+	for _, c := range replicas {
+		c.cr.CrIndexInformer = newEmptyCRInformer()
+	}
+	stopChs := []chan struct{}{make(chan struct{}), make(chan struct{})}
+	for i, c := range replicas {
+		go c.RunWithLeaderElection(1, stopChs[i], LeaderElectionConfig{
+			Namespace:     "kube-yahoo",
+			Name:          "k8s-athenz-syncer",
+			Identity:      fmt.Sprintf("replica-%d", i),
+			LeaseDuration: 2 * time.Second,
+			RenewDeadline: time.Second,
+			RetryPeriod:   200 * time.Millisecond,
+		})
+	}
+	defer func() {
+		for _, ch := range stopChs {
+			select {
+			case <-ch:
+			default:
+				close(ch)
+			}
+		}
+	}()
+
+	leader := -1
+	for i := 0; i < 50 && leader == -1; i++ {
+		time.Sleep(100 * time.Millisecond)
+		for j, c := range replicas {
+			if c.IsLeader() {
+				leader = j
+			}
+		}
+	}
+	if leader == -1 {
+		t.Fatal("Expected one of the replicas to become leader")
+	}
+	standby := 1 - leader
+	if replicas[standby].IsLeader() {
+		t.Fatal("Expected only one replica to be leader")
+	}
+
+	// stopping the leader releases the lease and the standby takes over
+	close(stopChs[leader])
+	for i := 0; i < 50 && !replicas[standby].IsLeader(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !replicas[standby].IsLeader() {
+		t.Error("Expected standby replica to become leader after the leader stopped")
+	}
+	if replicas[leader].IsLeader() {
+		t.Error("Expected stopped replica to no longer be leader")
+	}
+}
+
+// TestConcurrentWorkers - test that multiple workers process the queue in parallel without ever
+// syncing the same domain in two workers at once
+func TestConcurrentWorkers(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	var lock sync.Mutex
+	inFlight := map[string]int{}
+	maxPerDomain := 0
+	total := 0
+	maxTotal := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain := r.URL.Query().Get("domain")
+		lock.Lock()
+		inFlight[domain]++
+		total++
+		if inFlight[domain] > maxPerDomain {
+			maxPerDomain = inFlight[domain]
+		}
+		if total > maxTotal {
+			maxTotal = total
+		}
+		lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		lock.Lock()
+		inFlight[domain]--
+		total--
+		lock.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":404,"message":"Not Found"}`))
+	})
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	c := newController()
+	zmsClient := zms.NewClient("https://zms.athenz.com", httpClient.Transport)
+	c.zmsClient = &zmsClient
+	// no delay interval, so that the items are handed out as fast as the workers take them
+	c.queue = priorityqueue.New(workqueue.NewItemExponentialFailureRateLimiter(0, 0), priorityqueue.Config{})
+	domains := []string{}
+	for i := 0; i < 8; i++ {
+		ns := fmt.Sprintf("concurrent-%d", i)
+		c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})
+		domains = append(domains, c.util.NamespaceToDomain(ns))
+	}
+
+	workers := 4
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.runWorker()
+		}()
+	}
+	// keep adding the same domains while they are being processed
+	for round := 0; round < 10; round++ {
+		for _, domain := range domains {
+			c.queue.Add(domain)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < 100 && c.queue.Len() > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.queue.ShutDownWithDrain()
+	wg.Wait()
+
+	if maxPerDomain != 1 {
+		t.Errorf("Expected a domain to be processed by a single worker at a time, got %d concurrent syncs", maxPerDomain)
+	}
+	if maxTotal < 2 {
+		t.Errorf("Expected domains to be processed in parallel by %d workers, max concurrency was %d", workers, maxTotal)
+	}
+}
+
+// TestSyncSignatureVerificationFailure - test that unverified domain data never overwrites the AthenzDomain CR
+func TestSyncSignatureVerificationFailure(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "zms_public_keys.pem")
+	bundle := pem.EncodeToMemory(&pem.Block{
+		Type:    "PUBLIC KEY",
+		Headers: map[string]string{"Key-Id": "colo-env-1.1"},
+		Bytes:   der,
+	})
+	if err := ioutil.WriteFile(keyFile, bundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := verifier.NewVerifier(nil, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// zms returns modified domain data carrying a signature that does not match
+	tampered := getFakeDomain()
+	tampered.Domain.Roles[0].RoleMembers[0].MemberName = "user.attacker"
+	js, _ := json.Marshal(&zms.SignedDomains{Domains: []*zms.SignedDomain{&tampered}})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(js)
+	})
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	athenzclientset := fake.NewSimpleClientset()
+	zmsclient := zms.NewClient("https://zms.athenz.com", httpClient.Transport)
+	util := util.NewUtil("admin.domain", []string{}, []string{}, false)
+	cm := &cron.AthenzContactTimeConfigMap{
+		Namespace: "kube-yahoo",
+		Name:      "athenzcall-config",
+		Key:       "latest_contact",
+	}
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, &zmsclient, time.Minute, time.Hour, 250*time.Millisecond, util, cm, v)
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	d := getFakeDomain()
+	existing, err := c.cr.CreateUpdateAthenzDomain(context.TODO(), domainName, &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cr.CrIndexInformer.GetStore().Add(existing)
+
+	result, err := c.sync(domainName)
+	if _, ok := err.(*verifier.VerificationError); !ok {
+		t.Fatalf("Expected a verification error, got %v", err)
+	}
+	if result != metrics.ResultError {
+		t.Errorf("Expected %s result, got %s", metrics.ResultError, result)
+	}
+	obj, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Spec.Domain.Roles[0].RoleMembers[0].MemberName != username {
+		t.Error("AthenzDomain CR spec should not be overwritten with unverified data")
+	}
+	if !strings.Contains(obj.Status.LastError, "Domain signature verification failed") {
+		t.Errorf("Verification failure should be recorded on the CR status, got %q", obj.Status.LastError)
+	}
+	if !meta.IsStatusConditionFalse(obj.Status.Conditions, athenz_domain.ConditionSignatureVerified) {
+		t.Error("SignatureVerified condition should be false after a verification failure")
+	}
+	if !meta.IsStatusConditionTrue(obj.Status.Conditions, athenz_domain.ConditionZMSReachable) {
+		t.Error("ZMSReachable condition should be true when ZMS returned the domain data")
+	}
+}
+
+// TestSpecChanged - test that status only updates of AthenzDomain CRs are not synced again
+func TestSpecChanged(t *testing.T) {
+	d := getFakeDomain()
+	oldCR := &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: domainName, Generation: 1},
+		Spec:       athenz_domain.AthenzDomainSpec{SignedDomain: d},
+	}
+	newCR := oldCR.DeepCopy()
+	newCR.Status.SyncAttempts = 1
+	newCR.Status.LastError = "zms unavailable"
+	if specChanged(oldCR, newCR) {
+		t.Error("Status only update should not be considered a spec change")
+	}
+	newCR.Spec.KeyId = "300"
+	if !specChanged(oldCR, newCR) {
+		t.Error("Spec update should be considered a spec change")
+	}
+}
+
+// TestOrphanDeleted - test that deleting a CR kept by the orphan finalizer is synced to release it
+func TestOrphanDeleted(t *testing.T) {
+	oldCR := &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: domainName, Finalizers: []string{cr.OrphanFinalizer}},
+	}
+	newCR := oldCR.DeepCopy()
+	now := metav1.Now()
+	newCR.DeletionTimestamp = &now
+	if !orphanDeleted(oldCR, newCR) {
+		t.Error("Deletion of a CR with the orphan finalizer should be synced")
+	}
+	if orphanDeleted(newCR, newCR.DeepCopy()) {
+		t.Error("Updates of a CR already being deleted should not be synced again")
+	}
+	newCR.Finalizers = nil
+	if orphanDeleted(oldCR, newCR) {
+		t.Error("Deletion of a CR without the orphan finalizer should not be synced")
+	}
+}
+
+// TestRemoveAthenzDomainEvents - test that deleting a CR emits events on the CR and the mapped namespace
+func TestRemoveAthenzDomainEvents(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	c := newController()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	d := getFakeDomain()
+	obj, err := c.cr.CreateUpdateAthenzDomain(context.TODO(), domainName, &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cr.CrIndexInformer.GetStore().Add(obj)
+
+	if _, err := c.removeAthenzDomain(domainName, "domain was not found in ZMS", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Events) != 2 {
+		t.Fatalf("Expected an event on the AthenzDomain and on the namespace, got %d events", len(recorder.Events))
+	}
+	for i := 0; i < 2; i++ {
+		event := <-recorder.Events
+		expected := "Warning Deleted Deleted AthenzDomain home.domain: domain was not found in ZMS"
+		if event != expected {
+			t.Errorf("Expected event %q, got %q", expected, event)
+		}
+	}
+}
+
+// TestEventRecorder - test that events on AthenzDomain CRs are written through the k8s client
+func TestEventRecorder(t *testing.T) {
+	clientset := k8sfake.NewSimpleClientset()
+	recorder := newEventRecorder(clientset)
+	obj := &athenz_domain.AthenzDomain{ObjectMeta: metav1.ObjectMeta{Name: domainName, UID: "uid"}}
+	recorder.Event(obj, corev1.EventTypeNormal, ReasonCreated, "Created AthenzDomain home.domain from ZMS")
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		events, err := clientset.CoreV1().Events("").List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, event := range events.Items {
+			if event.InvolvedObject.Kind == "AthenzDomain" && event.InvolvedObject.Name == domainName && event.Reason == ReasonCreated {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Errorf("Expected an event for the AthenzDomain to be created. Error: %v", err)
+	}
+}
+
+// TestSyncFakeZMS - test the sync of a domain through its lifecycle in ZMS against the fake ZMS server
+func TestSyncFakeZMS(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fakezms.NewServer()
+	defer server.Close()
+	server.SetSigningKey("zms.0", key)
+	v, err := verifier.NewVerifier(server.Client(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	athenzclientset := fake.NewSimpleClientset()
+	util := util.NewUtil("admin.domain", []string{}, []string{}, false)
+	cm := &cron.AthenzContactTimeConfigMap{
+		Namespace: "kube-yahoo",
+		Name:      "athenzcall-config",
+		Key:       "latest_contact",
+	}
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, server.Client(), time.Minute, time.Hour, 250*time.Millisecond, util, cm, v)
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	// the informers are not running, keep the store in sync with the clientset
+	syncStore := func() *athenz_domain.AthenzDomain {
+		obj, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.cr.CrIndexInformer.GetStore().Update(obj)
+		return obj
+	}
+
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+	roles := len(d.Domain.Roles)
+	result, err := c.sync(domainName)
+	if err != nil || result != metrics.ResultCreated {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultCreated, result, err)
+	}
+	obj := syncStore()
+	if !meta.IsStatusConditionTrue(obj.Status.Conditions, athenz_domain.ConditionSignatureVerified) {
+		t.Error("SignatureVerified condition should be true for domain data signed by ZMS")
+	}
+
+	err = server.PutRole(domainName, &zms.Role{
+		Name:        zms.ResourceName(domainName + ":role.reader"),
+		RoleMembers: []*zms.RoleMember{{MemberName: "user.bar"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = c.sync(domainName)
+	if err != nil || result != metrics.ResultUpdated {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultUpdated, result, err)
+	}
+	obj = syncStore()
+	if len(obj.Spec.Domain.Roles) != roles+1 {
+		t.Errorf("Expected the new role to be synced, got %d roles", len(obj.Spec.Domain.Roles))
+	}
+
+	server.InjectFault(fakezms.Fault{Call: fakezms.CallSignedDomain, Domain: domainName, Code: http.StatusServiceUnavailable, Count: 1})
+	result, err = c.sync(domainName)
+	if err == nil || result != metrics.ResultError {
+		t.Fatalf("Expected %s result when ZMS is unavailable, got %s", metrics.ResultError, result)
+	}
+	obj = syncStore()
+	if !meta.IsStatusConditionFalse(obj.Status.Conditions, athenz_domain.ConditionZMSReachable) {
+		t.Error("ZMSReachable condition should be false when ZMS is unavailable")
+	}
+	if len(obj.Spec.Domain.Roles) != roles+1 {
+		t.Error("AthenzDomain CR spec should be kept when ZMS is unavailable")
+	}
+
+	server.DeleteDomain(domainName)
+	result, err = c.sync(domainName)
+	if err != nil || result != metrics.ResultDeleted {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultDeleted, result, err)
+	}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{}); err == nil {
+		t.Error("AthenzDomain CR should be removed once the domain is deleted in ZMS")
+	}
+}
+
+// TestNamespaceDomainAnnotation - test that namespaces annotated with their domain are synced under that domain
+func TestNamespaceDomainAnnotation(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	c := newController()
+	queue := priorityqueue.New(workqueue.NewItemExponentialFailureRateLimiter(0, 0), priorityqueue.Config{})
+	c.queue = queue
+	c.cron = cron.NewCron(c.clientset, time.Minute, time.Hour, "", c.zmsClient, c.nsIndexInformer, queue, c.util, c.cr, nil)
+
+	oldNs := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments"}}
+	newNs := oldNs.DeepCopy()
+	newNs.Annotations = map[string]string{util.DomainAnnotation: "corp.payments"}
+	key := c.nsinformerhandler(cache.MetaNamespaceKeyFunc, newNs)
+	c.nsdomainchanged(key, oldNs, newNs)
+	time.Sleep(100 * time.Millisecond)
+	queued := map[string]bool{}
+	for queue.Len() > 0 {
+		item, _ := queue.Get()
+		queued[item.(string)] = true
+		queue.Done(item)
+	}
+	if !queued["corp.payments"] || !queued["payments"] || len(queued) != 2 {
+		t.Errorf("Expected the annotated domain and the previous domain to be queued, got %v", queued)
+	}
+
+	c.nsIndexInformer.GetStore().Add(newNs)
+	if !c.cron.ValidateDomain("corp.payments") {
+		t.Error("Domain declared by a namespace annotation should be valid")
+	}
+	if c.cron.ValidateDomain("payments") {
+		t.Error("Domain of an annotated namespace name should no longer be valid")
+	}
+}
+
+// TestNamespaceDomainConflict - test that namespaces mapped to the same domain are reported
+func TestNamespaceDomainConflict(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server, v := newSignedZMS(t)
+	defer server.Close()
+	server.AddDomain(&zms.DomainData{Name: "team.prod"})
+	c := newController()
+	c.zmsClient = server.Client()
+	c.verifier = v
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-prod"}})
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team-dev",
+		Annotations: map[string]string{util.DomainAnnotation: "team.prod"},
+	}})
+
+	if result, err := c.sync("team.prod"); err != nil || result != metrics.ResultCreated {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultCreated, result, err)
+	}
+	conflicts := 0
+	for len(recorder.Events) > 0 {
+		event := <-recorder.Events
+		if strings.HasPrefix(event, "Warning "+ReasonDomainConflict+" Namespaces team-dev, team-prod") {
+			conflicts++
+		}
+	}
+	if conflicts != 2 {
+		t.Errorf("Expected a conflict event on both namespaces, got %d", conflicts)
+	}
+}
+
+// TestNamespaceFilterCleanup - test that the AthenzDomain CR of a namespace that stops matching the namespace filter is removed
+func TestNamespaceFilterCleanup(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server := fakezms.NewServer()
+	defer server.Close()
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+
+	athenzclientset := fake.NewSimpleClientset()
+	u := util.NewUtil("admin.domain", []string{}, []string{}, false)
+	filter, err := util.NewNamespaceFilter("athenz.io/sync=true", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SetNamespaceFilter(filter)
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, server.Client(), time.Minute, time.Hour, 250*time.Millisecond, u, nil, nil)
+	queue := priorityqueue.New(workqueue.NewItemExponentialFailureRateLimiter(0, 0), priorityqueue.Config{})
+	c.queue = queue
+	queued := func() []string {
+		time.Sleep(100 * time.Millisecond)
+		items := []string{}
+		for queue.Len() > 0 {
+			item, _ := queue.Get()
+			items = append(items, item.(string))
+			queue.Done(item)
+		}
+		return items
+	}
+
+	optedIn := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "home-domain",
+		Labels: map[string]string{"athenz.io/sync": "true"},
+	}}
+	optedOut := optedIn.DeepCopy()
+	optedOut.Labels = nil
+
+	c.nsinformerhandler(cache.MetaNamespaceKeyFunc, optedOut)
+	if items := queued(); len(items) != 0 {
+		t.Errorf("Namespace without the opt-in label should not be queued, got %v", items)
+	}
+
+	c.nsIndexInformer.GetStore().Add(optedIn)
+	c.nsinformerhandler(cache.MetaNamespaceKeyFunc, optedIn)
+	if items := queued(); !reflect.DeepEqual(items, []string{domainName}) {
+		t.Errorf("Expected the domain of the opted in namespace to be queued, got %v", items)
+	}
+	if result, err := c.sync(domainName); err != nil || result != metrics.ResultCreated {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultCreated, result, err)
+	}
+	obj, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cr.CrIndexInformer.GetStore().Add(obj)
+	// drop the trust domain queued by the sync
+	queued()
+
+	// removing the label queues the domain for cleanup
+	c.nsIndexInformer.GetStore().Update(optedOut)
+	c.nsinformerhandler(cache.MetaNamespaceKeyFunc, optedOut)
+	if items := queued(); !reflect.DeepEqual(items, []string{domainName}) {
+		t.Errorf("Expected the domain of the opted out namespace to be queued, got %v", items)
+	}
+	if result, err := c.sync(domainName); err != nil || result != metrics.ResultDeleted {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultDeleted, result, err)
+	}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{}); err == nil {
+		t.Error("AthenzDomain CR should be removed once the namespace is no longer synced")
+	}
+}
+
+// fakeReconciler - records the reconciled CRs and fails when err is set
+type fakeReconciler struct {
+	objs       []*athenz_domain.AthenzDomain
+	domains    []string
+	namespaces [][]string
+	err        error
+}
+
+func (r *fakeReconciler) Reconcile(ctx context.Context, obj *athenz_domain.AthenzDomain, namespaces []string) error {
+	r.objs = append(r.objs, obj)
+	r.domains = append(r.domains, obj.Name)
+	r.namespaces = append(r.namespaces, namespaces)
+	return r.err
+}
+
+// TestReconcilers - test that the reconcilers run on the synced CR of the domain
+func TestReconcilers(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server := fakezms.NewServer()
+	defer server.Close()
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+	c := newController()
+	c.zmsClient = server.Client()
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	reconciler := &fakeReconciler{}
+	c.AddReconciler(reconciler)
+
+	if result, err := c.sync(domainName); err != nil || result != metrics.ResultCreated {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultCreated, result, err)
+	}
+	if !reflect.DeepEqual(reconciler.domains, []string{domainName}) || !reflect.DeepEqual(reconciler.namespaces, [][]string{{"home-domain"}}) {
+		t.Errorf("Expected the CR to be reconciled in the namespace of the domain, got %v and %v", reconciler.domains, reconciler.namespaces)
+	}
+
+	// the CR is unchanged, the reconciler runs on the CR of the informer store
+	c.cr.CrIndexInformer.GetStore().Add(reconciler.objs[0])
+	reconciler.err = fmt.Errorf("mock reconcile error")
+	if result, err := c.sync(domainName); err == nil || result != metrics.ResultError {
+		t.Errorf("Expected %s result when the reconciler fails, got %s", metrics.ResultError, result)
+	}
+	if len(reconciler.domains) != 2 {
+		t.Errorf("Expected the unchanged CR to be reconciled, got %v", reconciler.domains)
+	}
+	failed := false
+	for len(recorder.Events) > 0 {
+		if strings.HasPrefix(<-recorder.Events, "Warning "+ReasonReconcileFailed) {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Error("Expected a ReconcileFailed event")
+	}
+}
+
+// TestSyncDryRun - test that a dry run sync reports the changes without writing the AthenzDomain CR
+func TestSyncDryRun(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server := fakezms.NewServer()
+	defer server.Close()
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+	athenzclientset := fake.NewSimpleClientset()
+	util := util.NewUtil("admin.domain", []string{}, []string{}, false)
+	cm := &cron.AthenzContactTimeConfigMap{
+		Namespace: "kube-yahoo",
+		Name:      "athenzcall-config",
+		Key:       "latest_contact",
+	}
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, server.Client(), time.Minute, time.Hour, 250*time.Millisecond, util, cm, nil)
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	reconciler := &fakeReconciler{}
+	c.AddReconciler(reconciler)
+	c.SetDryRun(true)
+
+	if result, err := c.sync(domainName); err != nil || result != metrics.ResultCreated {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultCreated, result, err)
+	}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{}); err == nil {
+		t.Error("AthenzDomain CR should not be created in dry run mode")
+	}
+	if len(reconciler.domains) != 0 {
+		t.Errorf("Reconcilers should not run in dry run mode, got %v", reconciler.domains)
+	}
+
+	// the CR exists, removing the domain from ZMS computes its deletion
+	obj := &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: domainName},
+		Spec:       athenz_domain.AthenzDomainSpec{SignedDomain: d},
+	}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Create(context.TODO(), obj, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c.cr.CrIndexInformer.GetStore().Add(obj)
+	server.DeleteDomain(domainName)
+	if result, err := c.sync(domainName); err != nil || result != metrics.ResultDeleted {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultDeleted, result, err)
+	}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{}); err != nil {
+		t.Error("AthenzDomain CR should be kept in dry run mode")
+	}
+}
+
+// TestSyncDomain - test that the one-shot sync refuses unmapped domains instead of removing their CRs
+func TestSyncDomain(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server := fakezms.NewServer()
+	defer server.Close()
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+	athenzclientset := fake.NewSimpleClientset()
+	util := util.NewUtil("admin.domain", []string{}, []string{}, false)
+	cm := &cron.AthenzContactTimeConfigMap{
+		Namespace: "kube-yahoo",
+		Name:      "athenzcall-config",
+		Key:       "latest_contact",
+	}
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, server.Client(), time.Minute, time.Hour, 250*time.Millisecond, util, cm, nil)
+	obj := &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: domainName},
+		Spec:       athenz_domain.AthenzDomainSpec{SignedDomain: d},
+	}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Create(context.TODO(), obj, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c.cr.CrIndexInformer.GetStore().Add(obj)
+
+	if _, err := c.SyncDomain(domainName); err == nil {
+		t.Error("Sync of a domain without a namespace should be refused")
+	}
+	kept, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("AthenzDomain CR of the refused domain should be kept. Error: %v", err)
+	}
+	if _, orphaned := kept.Annotations[cr.OrphanedAtAnnotation]; orphaned {
+		t.Error("AthenzDomain CR of the refused domain should not be orphaned")
+	}
+
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	if _, err := c.SyncDomain(domainName); err != nil {
+		t.Errorf("Sync of a mapped domain should succeed. Error: %v", err)
+	}
+}
+
+// TestDiffDomain - test the changes computed between ZMS and the AthenzDomain CR of a domain
+func TestDiffDomain(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server := fakezms.NewServer()
+	defer server.Close()
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+	c := newController()
+	c.zmsClient = server.Client()
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+
+	diff, err := c.DiffDomain(domainName)
+	if err != nil || diff.Action != cr.ActionCreate {
+		t.Fatalf("Expected the CR to be created, got %v. Error: %v", diff, err)
+	}
+
+	// the CR holds the domain as returned by ZMS, apart from the signatures
+	signed, _, err := c.zmsGetSignedDomains(domainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: domainName},
+		Spec:       athenz_domain.AthenzDomainSpec{SignedDomain: *signed.Domains[0]},
+	}
+	obj.Spec.Signature = "old-signature"
+	c.cr.CrIndexInformer.GetStore().Add(obj)
+	diff, err = c.DiffDomain(domainName)
+	if err != nil || diff.Action != cr.ActionNone {
+		t.Errorf("Expected no change when only the signature differs, got %v. Error: %v", diff, err)
+	}
+
+	err = server.PutRole(domainName, &zms.Role{
+		Name:        zms.ResourceName(domainName + ":role.reader"),
+		RoleMembers: []*zms.RoleMember{{MemberName: "user.bar"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err = c.DiffDomain(domainName)
+	if err != nil || diff.Action != cr.ActionUpdate || !reflect.DeepEqual(diff.RolesAdded, []string{domainName + ":role.reader"}) {
+		t.Errorf("Expected the new role to be added, got %v. Error: %v", diff, err)
+	}
+
+	server.DeleteDomain(domainName)
+	diff, err = c.DiffDomain(domainName)
+	if err != nil || diff.Action != cr.ActionDelete {
+		t.Errorf("Expected the CR to be deleted, got %v. Error: %v", diff, err)
+	}
+}
+
+// TestFreshNamespaceDuringFullResync - test that a new namespace is synced ahead of the domains queued by a full resync
+func TestFreshNamespaceDuringFullResync(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server, v := newSignedZMS(t)
+	defer server.Close()
+	athenzclientset := fake.NewSimpleClientset()
+	u := util.NewUtil("", []string{}, []string{}, false)
+	delayInterval := 20 * time.Millisecond
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, server.Client(), time.Minute, time.Hour, delayInterval, u, nil, v)
+	resyncDomains := 100
+	for i := 0; i < resyncDomains; i++ {
+		ns := fmt.Sprintf("resync-%d", i)
+		c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})
+		server.AddDomain(&zms.DomainData{Name: zms.DomainName(u.NamespaceToDomain(ns))})
+	}
+	fresh := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fresh-ns"}}
+	server.AddDomain(&zms.DomainData{Name: "fresh.ns"})
+
+	c.cron.ResyncAll()
+	go c.runWorker()
+	defer c.queue.ShutDown()
+	time.Sleep(5 * delayInterval)
+
+	c.nsIndexInformer.GetStore().Add(fresh)
+	start := time.Now()
+	c.nsinformerhandler(cache.MetaNamespaceKeyFunc, fresh)
+	for time.Since(start) < time.Second {
+		if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), "fresh.ns", metav1.GetOptions{}); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	if elapsed > 10*delayInterval {
+		t.Fatalf("Expected the new namespace to be synced within a few delay intervals, took %s", elapsed)
+	}
+	synced := 0
+	for i := 0; i < resyncDomains; i++ {
+		domain := u.NamespaceToDomain(fmt.Sprintf("resync-%d", i))
+		if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domain, metav1.GetOptions{}); err == nil {
+			synced++
+		}
+	}
+	if synced == 0 {
+		t.Error("Expected the resync domains handed out before the new namespace to be synced")
+	}
+	remaining := c.queue.(*priorityqueue.PriorityQueue).LenByPriority(priorityqueue.PriorityLow)
+	if remaining < resyncDomains/2 {
+		t.Errorf("Expected the new namespace to be synced while the full resync is queued, %d domains left", remaining)
+	}
+}
+
+// TestThrottledSync - test that a sync throttled by ZMS is retried after the Retry-After without using up its retries,
+// and that the Retry-After pauses the other ZMS requests
+func TestThrottledSync(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server := fakezms.NewServer()
+	defer server.Close()
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+	limiter := zmsclient.NewLimiter(0, 0)
+	zmsClient := server.Client()
+	zmsClient.Transport = limiter.Transport(zmsClient.Transport)
+
+	athenzclientset := fake.NewSimpleClientset()
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, zmsClient, time.Minute, time.Hour, 0, util.NewUtil("", []string{}, []string{}, false), nil, nil)
+	c.SetZMSLimiter(limiter)
+	c.queue = priorityqueue.New(workqueue.NewItemExponentialFailureRateLimiter(0, 0), priorityqueue.Config{})
+	defer c.queue.ShutDown()
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	server.InjectFault(fakezms.Fault{Call: fakezms.CallSignedDomain, Domain: domainName, Code: http.StatusTooManyRequests, RetryAfter: "1", Count: 1})
+
+	c.queue.Add(domainName)
+	c.processNextItem()
+	if c.queue.NumRequeues(domainName) != 0 {
+		t.Errorf("Expected throttling not to use up the retries, got %d requeues", c.queue.NumRequeues(domainName))
+	}
+	if c.queue.Len() != 0 {
+		t.Error("Expected the throttled domain to be retried after the Retry-After")
+	}
+
+	// the update cron shares the ZMS client and waits for the pause as well
+	start := time.Now()
+	master := false
+	if _, _, err := c.zmsClient.GetSignedDomains("", "true", "", &master, &master, ""); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Expected the ZMS requests to be paused for the Retry-After, took %s", elapsed)
+	}
+
+	for i := 0; i < 100 && c.queue.Len() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.processNextItem()
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the domain to be synced once ZMS takes requests again. Error: %v", err)
+	}
+}
+
+// TestRetryUntilSynced - test that a failing domain is retried with backoff past the event threshold until it syncs
+func TestRetryUntilSynced(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server := fakezms.NewServer()
+	defer server.Close()
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+
+	athenzclientset := fake.NewSimpleClientset()
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, server.Client(), time.Minute, time.Hour, 0, util.NewUtil("", []string{}, []string{}, false), nil, nil)
+	c.SetRetryBackoff(10*time.Millisecond, 40*time.Millisecond)
+	defer c.queue.ShutDown()
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	failures := failureEventThreshold + 2
+	server.InjectFault(fakezms.Fault{Call: fakezms.CallSignedDomain, Domain: domainName, Code: http.StatusInternalServerError, Count: failures})
+
+	c.queue.Add(domainName)
+	for i := 1; i <= failures; i++ {
+		c.processNextItem()
+		if c.queue.NumRequeues(domainName) != i {
+			t.Fatalf("Expected %d consecutive failures, got %d", i, c.queue.NumRequeues(domainName))
+		}
+	}
+	c.processNextItem()
+	if c.queue.NumRequeues(domainName) != 0 {
+		t.Errorf("Expected the failures to be reset once the domain synced, got %d", c.queue.NumRequeues(domainName))
+	}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the domain to be synced after the failures. Error: %v", err)
+	}
+}
+
+// TestDeletionGuard - test that a domain missing from ZMS keeps its CR until the grace period passed and the budget allows it
+func TestDeletionGuard(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server := fakezms.NewServer()
+	defer server.Close()
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+
+	athenzclientset := fake.NewSimpleClientset()
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, server.Client(), time.Minute, time.Hour, 0, util.NewUtil("", []string{}, []string{}, false), nil, nil)
+	c.SetDeletionGuard(safety.NewGuard(safety.Config{GraceChecks: 2, MaxDeletions: 1, DeletionInterval: time.Hour}))
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	if _, err := c.sync(domainName); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cr.CrIndexInformer.GetStore().Add(obj)
+
+	server.DeleteDomain(domainName)
+	result, err := c.sync(domainName)
+	if _, ok := err.(*safety.DeferredError); !ok || result != metrics.ResultDeferred {
+		t.Fatalf("Expected the deletion to be deferred on the first missing check, got %s. Error: %v", result, err)
+	}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{}); err != nil {
+		t.Fatalf("Expected the AthenzDomain CR to be kept during the grace period. Error: %v", err)
+	}
+	result, err = c.sync(domainName)
+	if err != nil || result != metrics.ResultDeleted {
+		t.Fatalf("Expected %s result after the grace period, got %s. Error: %v", metrics.ResultDeleted, result, err)
+	}
+
+	// the budget of one deletion per hour is used up
+	c.cr.CrIndexInformer.GetStore().Add(obj)
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Create(context.TODO(), obj, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c.nsIndexInformer.GetStore().Delete(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	result, err = c.sync(domainName)
+	if deferred, ok := err.(*safety.DeferredError); !ok || deferred.Reason != metrics.DeferBudget || result != metrics.ResultDeferred {
+		t.Errorf("Expected the deletion to be deferred by the budget, got %s. Error: %v", result, err)
+	}
+}
+
+// TestDeletionPolicy - test that the CR of a domain no longer mapped is marked orphaned, adopted again and reaped after the TTL
+func TestDeletionPolicy(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server := fakezms.NewServer()
+	defer server.Close()
+	d := getFakeDomain()
+	server.AddDomain(d.Domain)
+
+	athenzclientset := fake.NewSimpleClientset()
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, server.Client(), time.Minute, time.Hour, 0, util.NewUtil("", []string{}, []string{}, false), nil, nil)
+	c.SetDeletionPolicy(cr.DeletionDelayed, time.Hour)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}}
+	c.nsIndexInformer.GetStore().Add(ns)
+	// the informers are not running, keep the store in sync with the clientset
+	syncStore := func() *athenz_domain.AthenzDomain {
+		obj, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.cr.CrIndexInformer.GetStore().Update(obj)
+		return obj
+	}
+	if _, err := c.sync(domainName); err != nil {
+		t.Fatal(err)
+	}
+	syncStore()
+
+	c.nsIndexInformer.GetStore().Delete(ns)
+	result, err := c.sync(domainName)
+	if err != nil || result != metrics.ResultUpdated {
+		t.Fatalf("Expected the CR to be marked orphaned, got %s. Error: %v", result, err)
+	}
+	if _, orphaned := cr.OrphanedAt(syncStore()); !orphaned {
+		t.Fatal("Expected the CR to be annotated orphaned")
+	}
+	result, err = c.sync(domainName)
+	if err != nil || result != metrics.ResultUnchanged {
+		t.Errorf("Expected the orphaned CR to be kept during the TTL, got %s. Error: %v", result, err)
+	}
+
+	c.nsIndexInformer.GetStore().Add(ns)
+	if _, err := c.sync(domainName); err != nil {
+		t.Fatal(err)
+	}
+	if _, orphaned := cr.OrphanedAt(syncStore()); orphaned {
+		t.Error("Expected the orphaned mark to be removed once the namespace is back")
+	}
+
+	c.SetDeletionPolicy(cr.DeletionDelayed, 0)
+	c.nsIndexInformer.GetStore().Delete(ns)
+	if _, err := c.sync(domainName); err != nil {
+		t.Fatal(err)
+	}
+	syncStore()
+	result, err = c.sync(domainName)
+	if err != nil || result != metrics.ResultDeleted {
+		t.Fatalf("Expected the orphaned CR to be deleted after the TTL, got %s. Error: %v", result, err)
+	}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, metav1.GetOptions{}); err == nil {
+		t.Error("Expected the orphaned CR to be deleted after the TTL")
+	}
+}
+
+// TestGroupDomains - test that the domains of group members are synced and that their updates sync the dependent domains again
+func TestGroupDomains(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	server, v := newSignedZMS(t)
+	defer server.Close()
+	d := getFakeDomain()
+	d.Domain.Roles = append(d.Domain.Roles, &zms.Role{
+		Name:        zms.ResourceName(domainName + ":role.devs"),
+		RoleMembers: []*zms.RoleMember{{MemberName: "other.domain:group.devs"}},
+	})
+	server.AddDomain(d.Domain)
+	server.AddDomain(&zms.DomainData{Name: "other.domain"})
+
+	athenzclientset := fake.NewSimpleClientset()
+	c := NewController(k8sfake.NewSimpleClientset(), athenzclientset, server.Client(), time.Minute, time.Hour, 0, util.NewUtil("", []string{}, []string{}, false), nil, v)
+	defer c.queue.ShutDown()
+	c.nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-domain"}})
+	// the informers are not running, keep the store in sync with the clientset
+	syncStore := func(domain string) {
+		obj, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domain, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.cr.CrIndexInformer.GetStore().Update(obj)
+	}
+	queued := func() map[string]bool {
+		items := map[string]bool{}
+		for c.queue.Len() > 0 {
+			item, _ := c.queue.Get()
+			items[item.(string)] = true
+			c.queue.Done(item)
+		}
+		return items
+	}
+
+	if result, err := c.sync(domainName); err != nil || result != metrics.ResultCreated {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultCreated, result, err)
+	}
+	syncStore(domainName)
+	if !queued()["other.domain"] {
+		t.Fatal("Expected the domain of the group member to be queued")
+	}
+	if !c.cron.ValidateDomain("other.domain") {
+		t.Fatal("Expected the domain of the group member to be a valid domain")
+	}
+	result, err := c.sync("other.domain")
+	if err != nil || result != metrics.ResultCreated {
+		t.Fatalf("Expected %s result, got %s. Error: %v", metrics.ResultCreated, result, err)
+	}
+	syncStore("other.domain")
+	if !queued()[domainName] {
+		t.Error("Expected the domain referencing the group to be queued once the group domain changed")
+	}
+
+	// an unchanged group domain does not sync the dependent domains again
+	if _, err := c.sync("other.domain"); err != nil {
+		t.Fatal(err)
+	}
+	if queued()[domainName] {
+		t.Error("Expected the dependent domain not to be queued when the group domain is unchanged")
+	}
+}
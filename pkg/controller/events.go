@@ -0,0 +1,79 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package controller
+
+import (
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+	athenzScheme "github.com/AthenZ/k8s-athenz-syncer/pkg/client/clientset/versioned/scheme"
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const eventComponent = "k8s-athenz-syncer"
+
+// event reasons emitted on the AthenzDomain CR and the namespaces mapped to the domain
+const (
+	ReasonCreated               = "Created"
+	ReasonUpdated               = "Updated"
+	ReasonDeleted               = "Deleted"
+	ReasonDeletionDeferred      = "DeletionDeferred"
+	ReasonOrphaned              = "Orphaned"
+	ReasonAdopted               = "Adopted"
+	ReasonZMSError              = "ZMSError"
+	ReasonSignatureInvalid      = "SignatureVerificationFailed"
+	ReasonSyncFailed            = "SyncFailed"
+	ReasonSyncFailing           = "SyncFailing"
+	ReasonTrustDomainDiscovered = "TrustDomainDiscovered"
+	ReasonGroupDomainDiscovered = "GroupDomainDiscovered"
+	ReasonDomainConflict        = "DomainConflict"
+	ReasonReconcileFailed       = "ReconcileFailed"
+)
+
+// newEventRecorder - create an event recorder writing events through the k8s client
+func newEventRecorder(k8sClient kubernetes.Interface) record.EventRecorder {
+	// AthenzDomain must be known to the scheme to build event object references
+	utilruntime.Must(athenzScheme.AddToScheme(scheme.Scheme))
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8sClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// recordEvent - emit an event on the AthenzDomain CR and on the namespaces mapped to the domain.
+// obj is the latest copy of the CR, the informer store is used when it is nil.
+func (c *Controller) recordEvent(domain string, obj *athenz_domain.AthenzDomain, eventType, reason, messageFmt string, args ...interface{}) {
+	if obj == nil {
+		cr, exists, err := c.cr.GetCRByName(domain)
+		if err == nil && exists {
+			obj = cr
+		}
+	}
+	if obj != nil {
+		c.recorder.Eventf(obj, eventType, reason, messageFmt, args...)
+	}
+	for _, name := range c.cron.DomainNamespaces(domain) {
+		item, exists, err := c.nsIndexInformer.GetStore().GetByKey(name)
+		if err != nil || !exists {
+			continue
+		}
+		if namespace, ok := item.(*corev1.Namespace); ok {
+			c.recorder.Eventf(namespace, eventType, reason, messageFmt, args...)
+		}
+	}
+}
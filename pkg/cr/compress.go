@@ -0,0 +1,92 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+)
+
+// SignedDomain - full signed domain of the AthenzDomain CR, decompressed when the CR stores it in the
+// compressedDomain field. Consumers of the CRs should read the domain data through it.
+func SignedDomain(obj *athenz_domain.AthenzDomain) (*zms.SignedDomain, error) {
+	if obj == nil {
+		return nil, errors.New("AthenzDomain CR is nil")
+	}
+	spec, err := decodeSpec(&obj.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress AthenzDomain CR %s. Error: %v", obj.Name, err)
+	}
+	return &spec.SignedDomain, nil
+}
+
+// encodeSpec - spec of the signed domain, compressed when its json exceeds the threshold in bytes.
+// A threshold of 0 never compresses.
+func encodeSpec(domainData *zms.SignedDomain, threshold int) (*athenz_domain.AthenzDomainSpec, error) {
+	spec := &athenz_domain.AthenzDomainSpec{SignedDomain: *domainData}
+	if threshold <= 0 {
+		return spec, nil
+	}
+	data, err := json.Marshal(domainData)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) <= threshold {
+		return spec, nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &athenz_domain.AthenzDomainSpec{CompressedDomain: base64.StdEncoding.EncodeToString(buf.Bytes())}, nil
+}
+
+// decodeSpec - spec with the inline signed domain, the spec itself when it is not compressed
+func decodeSpec(spec *athenz_domain.AthenzDomainSpec) (*athenz_domain.AthenzDomainSpec, error) {
+	if spec == nil || spec.CompressedDomain == "" {
+		return spec, nil
+	}
+	compressed, err := base64.StdEncoding.DecodeString(spec.CompressedDomain)
+	if err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	decoded := &athenz_domain.AthenzDomainSpec{}
+	if err := json.Unmarshal(data, &decoded.SignedDomain); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
@@ -2,9 +2,12 @@ package cr
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/AthenZ/athenz/clients/go/zms"
@@ -12,17 +15,47 @@ import (
 	athenzClientset "github.com/AthenZ/k8s-athenz-syncer/pkg/client/clientset/versioned"
 	athenzclient "github.com/AthenZ/k8s-athenz-syncer/pkg/client/clientset/versioned/typed/athenz/v1"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apiError "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
 )
 
-const trustDomainIndexKey = "trustDomain"
+const (
+	trustDomainIndexKey = "trustDomain"
+	groupDomainIndexKey = "groupDomain"
+	// GroupSeparator - separator of the domain and the name of an Athenz group in a role member name
+	GroupSeparator = ":group."
+	// ManagedByLabel - label selecting the objects derived from AthenzDomain CRs by the syncer
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue - value of the managed by label
+	ManagedByValue = "k8s-athenz-syncer"
+	// FieldManager - field manager recorded for the AthenzDomain CR fields written by the syncer
+	FieldManager = "k8s-athenz-syncer"
+	// DefaultStatusUpdateInterval - minimum time between two status writes of a CR whose sync outcome is unchanged
+	DefaultStatusUpdateInterval = 5 * time.Minute
+)
 
 // CRUtil - cr resource struct
 type CRUtil struct {
 	athenzClientset athenzclient.AthenzV1Interface
 	CrIndexInformer cache.SharedIndexInformer
+	// dryRun skips all writes through the AthenzDomains client
+	dryRun bool
+	// compressThreshold is the size in bytes above which the domain data is stored compressed, 0 disables it
+	compressThreshold int
+	// deletionPolicy and orphanTTL decide when orphaned CRs are deleted, see SetDeletionPolicy
+	deletionPolicy string
+	orphanTTL      time.Duration
+	// statusInterval throttles the status writes of unchanged outcomes, pendingAttempts counts the syncs by
+	// domain that are not written yet
+	statusInterval  time.Duration
+	statusMutex     sync.Mutex
+	pendingAttempts map[string]int64
 }
 
 // NewCRUtil - create new cr resource object
@@ -30,26 +63,58 @@ func NewCRUtil(athenzClientset athenzClientset.Interface, crIndexInformer cache.
 	cr := &CRUtil{
 		athenzClientset: athenzClientset.AthenzV1(),
 		CrIndexInformer: crIndexInformer,
+		statusInterval:  DefaultStatusUpdateInterval,
+		pendingAttempts: map[string]int64{},
 	}
 	return cr
 }
 
+// SetDryRun - in dry run mode the AthenzDomain CRs are never written, the changes are computed with Diff instead
+func (c *CRUtil) SetDryRun(dryRun bool) {
+	c.dryRun = dryRun
+}
+
+// DryRun - true when the AthenzDomain CRs are not written
+func (c *CRUtil) DryRun() bool {
+	return c.dryRun
+}
+
+// SetCompressThreshold - store the domain data gzipped and base64 encoded in the compressedDomain field of the
+// spec when its json exceeds the threshold in bytes, so that large domains stay below the etcd object size limit.
+// A threshold of 0 always stores the domain data inline.
+func (c *CRUtil) SetCompressThreshold(threshold int) {
+	c.compressThreshold = threshold
+}
+
+// SetStatusUpdateInterval - write the status of a CR whose sync outcome is unchanged at most once per interval,
+// the sync attempts and time of the syncs in between are written with the next status update. An interval of 0
+// writes the status on every sync.
+func (c *CRUtil) SetStatusUpdateInterval(interval time.Duration) {
+	c.statusInterval = interval
+}
+
 // CreateUpdateAthenzDomain - create AthenzDomain Custom Resource with data from Athenz
 func (c *CRUtil) CreateUpdateAthenzDomain(ctx context.Context, domain string, domainData *zms.SignedDomain) (cr *athenz_domain.AthenzDomain, err error) {
 	if domainData == nil {
 		return nil, errors.New("Domain data from ZMS API call is nil")
 	}
+	if c.dryRun {
+		log.Infof("Dry run: skipping create/update of AthenzDomain CR %s", domain)
+		return nil, nil
+	}
 	athenzDomainClient := c.athenzClientset.AthenzDomains()
+	spec, err := encodeSpec(domainData, c.compressThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compress AthenzDomain CR: %s. Error: %v", domain, err)
+	}
+	if spec.CompressedDomain != "" {
+		log.Infof("Domain data of %s exceeds %d bytes, storing it compressed", domain, c.compressThreshold)
+	}
 	newCR := &athenz_domain.AthenzDomain{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: domain,
 		},
-		Spec: athenz_domain.AthenzDomainSpec{
-			SignedDomain: *domainData,
-		},
-		Status: athenz_domain.AthenzDomainStatus{
-			Message: "",
-		},
+		Spec: *spec,
 	}
 
 	obj, exist, err := c.GetCRByName(domain)
@@ -57,36 +122,88 @@ func (c *CRUtil) CreateUpdateAthenzDomain(ctx context.Context, domain string, do
 		return nil, fmt.Errorf("Did not find key in store. Error while looking up for key: %v", err)
 	}
 	if !exist {
-		cr, err = athenzDomainClient.Create(ctx, newCR, metav1.CreateOptions{})
+		cr, err = athenzDomainClient.Create(ctx, newCR, metav1.CreateOptions{FieldManager: FieldManager})
 		if err == nil {
 			return cr, nil
 		} else if !apiError.IsAlreadyExists(err) {
 			return nil, fmt.Errorf("Failed to create new AthenzDomain CR: %s. Error: %v", domain, err)
 		}
+		// created since the informer cache was synced
+		obj, err = athenzDomainClient.Get(ctx, domain, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get AthenzDomain CR: %s. Error: %v", domain, err)
+		}
 	}
 	return c.updateCR(ctx, obj, newCR)
 }
 
-// updateCR - perform an update operation on existing AthenzDomain CR
+// updateCR - patch the spec of the existing AthenzDomain CR with a JSON merge patch of the fields that changed.
+// The patch carries the resource version of the CR it was computed from, so that a stale informer cache fails
+// with a conflict instead of missing or reverting concurrent changes, in which case the patch is computed again
+// from the latest CR. The patch never touches the status.
 func (c *CRUtil) updateCR(ctx context.Context, object *athenz_domain.AthenzDomain, newCR *athenz_domain.AthenzDomain) (*athenz_domain.AthenzDomain, error) {
 	if object == nil || newCR == nil {
 		return nil, errors.New("one of the domain objects to compare is empty")
 	}
-	oldObjCopy := object.Spec.DeepCopy()
-	newObjCopy := newCR.Spec.DeepCopy()
-	oldObjCopy.Signature = ""
-	oldObjCopy.Domain.Policies.Signature = ""
-	newObjCopy.Signature = ""
-	newObjCopy.Domain.Policies.Signature = ""
-	eql := reflect.DeepEqual(oldObjCopy, newObjCopy)
-	statusEql := reflect.DeepEqual(object.Status, newCR.Status)
-	if eql && statusEql {
+	var cr *athenz_domain.AthenzDomain
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		cr, err = c.patchSpec(ctx, object, newCR)
+		if apiError.IsConflict(err) {
+			latest, getErr := c.athenzClientset.AthenzDomains().Get(ctx, newCR.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			object = latest
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to patch AthenzDomain CR: %s. Error: %v", newCR.Name, err)
+	}
+	return cr, nil
+}
+
+// patchSpec - patch the spec of the CR with the changes from object to newCR, nil is returned when the spec
+// is up to date
+func (c *CRUtil) patchSpec(ctx context.Context, object *athenz_domain.AthenzDomain, newCR *athenz_domain.AthenzDomain) (*athenz_domain.AthenzDomain, error) {
+	current, err := decodeSpec(&object.Spec)
+	if err != nil {
+		// the whole spec is replaced
+		log.Warnf("Unable to decompress AthenzDomain CR %s. Error: %v", newCR.Name, err)
+		current = &athenz_domain.AthenzDomainSpec{}
+	}
+	desired, err := decodeSpec(&newCR.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress AthenzDomain CR: %s. Error: %v", newCR.Name, err)
+	}
+	// the CR is also rewritten when it switches between the inline and the compressed form
+	sameForm := (object.Spec.CompressedDomain == "") == (newCR.Spec.CompressedDomain == "")
+	if sameForm && specEqual(current, desired) {
 		log.Info("AthenzDomain CR is up to date, skipping CR update.")
 		return nil, nil
 	}
-	resourceVersion := object.ResourceVersion
-	newCR.ObjectMeta.ResourceVersion = resourceVersion
-	return c.athenzClientset.AthenzDomains().Update(ctx, newCR, metav1.UpdateOptions{})
+	patch, err := mergePatch(
+		map[string]interface{}{"spec": object.Spec},
+		map[string]interface{}{"metadata": map[string]interface{}{"resourceVersion": object.ResourceVersion}, "spec": newCR.Spec},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compute patch of AthenzDomain CR: %s. Error: %v", newCR.Name, err)
+	}
+	return c.athenzClientset.AthenzDomains().Patch(ctx, newCR.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: FieldManager})
+}
+
+// mergePatch - JSON merge patch turning the original object into the modified one
+func mergePatch(original, modified interface{}) ([]byte, error) {
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	modifiedJSON, err := json.Marshal(modified)
+	if err != nil {
+		return nil, err
+	}
+	return jsonpatch.CreateMergePatch(originalJSON, modifiedJSON)
 }
 
 // GetCRByName - get AthenzDomain CR by domain
@@ -106,12 +223,24 @@ func (c *CRUtil) GetCRByName(domain string) (*athenz_domain.AthenzDomain, bool,
 
 // RemoveAthenzDomain - delete AthenzDomain CR from Cluster
 func (c *CRUtil) RemoveAthenzDomain(ctx context.Context, domain string) error {
+	if c.dryRun {
+		log.Infof("Dry run: skipping delete of AthenzDomain CR %s", domain)
+		return nil
+	}
 	obj, exist, err := c.GetCRByName(domain)
 	if err != nil {
 		log.Infof("Error occurred in getCRByName function. Error: %v", err)
 		return err
 	}
 	if exist && obj != nil {
+		// the CR is kept by the orphan finalizer until it is released
+		if err := c.releaseFinalizer(ctx, obj); err != nil {
+			return err
+		}
+		if obj.DeletionTimestamp != nil {
+			log.Infof("Released AthenzDomain CR %s being deleted", domain)
+			return nil
+		}
 		err := c.athenzClientset.AthenzDomains().Delete(ctx, domain, metav1.DeleteOptions{})
 		if err != nil {
 			log.Error("Error occurred when deleting AthenzDomain Custom Resource in the Cluster")
@@ -122,7 +251,8 @@ func (c *CRUtil) RemoveAthenzDomain(ctx context.Context, domain string) error {
 	return nil
 }
 
-// GetLatestTimestamp - get the latest etag from all AthenzDomain CRs in the store (used initially)
+// GetLatestTimestamp - get the latest etag from all AthenzDomain CRs in the store (used initially when no etag
+// is recorded in the contact time config map)
 func (c *CRUtil) GetLatestTimestamp() string {
 	crs := c.CrIndexInformer.GetStore().List()
 	// initial date to compare with etags from CRs
@@ -135,7 +265,16 @@ func (c *CRUtil) GetLatestTimestamp() string {
 		if !ok {
 			return ""
 		}
-		timestamp := cr.Spec.Domain.Modified
+		// the domain data of compressed CRs is only in the compressedDomain field
+		signedDomain, err := SignedDomain(cr)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if signedDomain.Domain == nil {
+			continue
+		}
+		timestamp := signedDomain.Domain.Modified
 		if timestamp.After(latest) {
 			latest = timestamp.Time
 		}
@@ -160,27 +299,53 @@ func (c *CRUtil) IsTrustDomain(domainName string) bool {
 	return true
 }
 
-// TrustDomainIndexFunc returns the list of trust domains as defined by the delegated roles in an Athenz domain
-func TrustDomainIndexFunc(obj interface{}) ([]string, error) {
+// IsGroupDomain looks up the group domain index to determine if the given domain owns a group that is a member
+// of a role of another synced domain
+func (c *CRUtil) IsGroupDomain(domainName string) bool {
+	return len(c.GroupDomainDependents(domainName)) > 0
+}
+
+// GroupDomainDependents returns the names of the AthenzDomain CRs with role members that are groups of the given domain
+func (c *CRUtil) GroupDomainDependents(domainName string) []string {
+	dependents, err := c.CrIndexInformer.GetIndexer().IndexKeys(groupDomainIndexKey, domainName)
+	if err != nil {
+		log.Errorf("Error while looking up the group domain indexer: %s", err)
+		return nil
+	}
+	return dependents
+}
+
+// indexedDomainData - domain data of an AthenzDomain CR given to an index func, nil when it has none
+func indexedDomainData(obj interface{}) *zms.DomainData {
 	domain, ok := obj.(*athenz_domain.AthenzDomain)
 	if !ok {
 		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
 		if !ok {
 			log.Errorf("Couldn't get object from tombstone %#v", obj)
-			return []string{}, nil
+			return nil
 		}
 		domain, ok = tombstone.Obj.(*athenz_domain.AthenzDomain)
 		if !ok {
 			log.Errorf("Tombstone contained object that is not an Athenz Domain %#v", obj)
-			return []string{}, nil
+			return nil
 		}
 	}
-	data := domain.Spec.Domain
+	signedDomain, err := SignedDomain(domain)
+	if err != nil {
+		log.Errorf("Unable to index AthenzDomain CR %s. Error: %v", domain.Name, err)
+		return nil
+	}
+	return signedDomain.Domain
+}
+
+// TrustDomainIndexFunc returns the list of trust domains as defined by the delegated roles in an Athenz domain
+func TrustDomainIndexFunc(obj interface{}) ([]string, error) {
+	data := indexedDomainData(obj)
 	if data == nil {
 		return []string{}, nil
 	}
 	trustDomains := make([]string, 0)
-	for _, role := range domain.Spec.Domain.Roles {
+	for _, role := range data.Roles {
 		if role.Trust != "" {
 			trustDomains = append(trustDomains, string(role.Trust))
 		}
@@ -188,10 +353,187 @@ func TrustDomainIndexFunc(obj interface{}) ([]string, error) {
 	return trustDomains, nil
 }
 
-// UpdateErrorStatus - add error status field in CR when zms call returns error
-func (c *CRUtil) UpdateErrorStatus(ctx context.Context, obj *athenz_domain.AthenzDomain) {
-	_, err := c.athenzClientset.AthenzDomains().Update(ctx, obj, metav1.UpdateOptions{})
+// GroupDomainIndexFunc returns the list of the other domains owning groups that are members of the roles of an Athenz domain
+func GroupDomainIndexFunc(obj interface{}) ([]string, error) {
+	data := indexedDomainData(obj)
+	if data == nil {
+		return []string{}, nil
+	}
+	return GroupDomains(data), nil
+}
+
+// GroupDomains - sorted names of the other domains owning groups that are members of the roles of the domain,
+// expired members included as they may be extended in ZMS without the role changing
+func GroupDomains(data *zms.DomainData) []string {
+	domains := map[string]bool{}
+	for _, role := range data.Roles {
+		for _, member := range RoleMembers(role, time.Time{}) {
+			i := strings.Index(member, GroupSeparator)
+			if i > 0 && member[:i] != string(data.Name) {
+				domains[member[:i]] = true
+			}
+		}
+	}
+	groupDomains := make([]string, 0, len(domains))
+	for domain := range domains {
+		groupDomains = append(groupDomains, domain)
+	}
+	sort.Strings(groupDomains)
+	return groupDomains
+}
+
+// OwnerReference - reference making the AthenzDomain CR the owner of an object derived from it, so that
+// the object is garbage collected with the CR
+func OwnerReference(obj *athenz_domain.AthenzDomain) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{
+		APIVersion: athenz_domain.SchemeGroupVersion.String(),
+		Kind:       "AthenzDomain",
+		Name:       obj.Name,
+		UID:        obj.UID,
+		Controller: &controller,
+	}
+}
+
+// RoleMembers - sorted names of the role members that are not expired
+func RoleMembers(role *zms.Role, now time.Time) []string {
+	members := []string{}
+	if role == nil {
+		return members
+	}
+	if len(role.RoleMembers) > 0 {
+		for _, member := range role.RoleMembers {
+			if member == nil || (member.Expiration != nil && member.Expiration.Time.Before(now)) {
+				continue
+			}
+			members = append(members, string(member.MemberName))
+		}
+	} else {
+		for _, member := range role.Members {
+			members = append(members, string(member))
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// SyncStatus - outcome of a single sync of an Athenz domain
+type SyncStatus struct {
+	// Err is the error that failed the sync, nil when the sync succeeded
+	Err error
+	// ZMSReachable is false when the ZMS call for the domain failed
+	ZMSReachable bool
+	// SignatureVerified is True or False when the signatures were checked, Unknown when verification
+	// is disabled and empty when the sync failed before the domain data could be checked
+	SignatureVerified metav1.ConditionStatus
+	// Modified is the modified timestamp of the domain in ZMS
+	Modified *metav1.Time
+}
+
+// UpdateSyncStatus - record the outcome of a sync on the status subresource of the AthenzDomain CR with a
+// JSON merge patch of the status fields that changed, so that the spec is never overwritten. Every sync is
+// counted and a successful sync sets the last sync time, but an outcome that leaves the rest of the status as it
+// was is only written once per status update interval, so that a full resync of unchanged domains does not write
+// every CR. obj is the latest copy of the CR returned by the API server, the informer store is used when nil.
+func (c *CRUtil) UpdateSyncStatus(ctx context.Context, domain string, obj *athenz_domain.AthenzDomain, result SyncStatus) error {
+	if c.dryRun {
+		return nil
+	}
+	if obj == nil {
+		cr, exists, err := c.GetCRByName(domain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			c.statusMutex.Lock()
+			delete(c.pendingAttempts, domain)
+			c.statusMutex.Unlock()
+			return nil
+		}
+		obj = cr
+	}
+	original := obj.Status.DeepCopy()
+	obj = obj.DeepCopy()
+	status := &obj.Status
+	status.ObservedGeneration = obj.Generation
+
+	if result.ZMSReachable {
+		setCondition(obj, athenz_domain.ConditionZMSReachable, metav1.ConditionTrue, "RequestSucceeded", "")
+	} else {
+		setCondition(obj, athenz_domain.ConditionZMSReachable, metav1.ConditionFalse, "RequestFailed", errorMessage(result.Err))
+	}
+	switch result.SignatureVerified {
+	case metav1.ConditionTrue:
+		setCondition(obj, athenz_domain.ConditionSignatureVerified, metav1.ConditionTrue, "SignatureValid", "")
+	case metav1.ConditionFalse:
+		setCondition(obj, athenz_domain.ConditionSignatureVerified, metav1.ConditionFalse, "SignatureInvalid", errorMessage(result.Err))
+	case metav1.ConditionUnknown:
+		setCondition(obj, athenz_domain.ConditionSignatureVerified, metav1.ConditionUnknown, "VerificationDisabled", "")
+	}
+
+	if result.Err != nil {
+		status.LastError = result.Err.Error()
+		status.Message = status.LastError
+		status.FailedAttempts++
+		setCondition(obj, athenz_domain.ConditionSynced, metav1.ConditionFalse, "SyncFailed", status.LastError)
+	} else {
+		if result.Modified != nil {
+			// to the second as stored by the API server, so that it compares equal to the stored time
+			modified := result.Modified.Rfc3339Copy()
+			status.LastModified = &modified
+		}
+		status.LastError = ""
+		status.Message = ""
+		status.FailedAttempts = 0
+		setCondition(obj, athenz_domain.ConditionSynced, metav1.ConditionTrue, "SyncSucceeded", "")
+	}
+	now := metav1.Now()
+	unchanged := equality.Semantic.DeepEqual(original, status)
+	c.statusMutex.Lock()
+	attempts := c.pendingAttempts[domain] + 1
+	if unchanged && original.LastSyncTime != nil && now.Sub(original.LastSyncTime.Time) < c.statusInterval {
+		// counted and written with the next status update of the CR
+		c.pendingAttempts[domain] = attempts
+		c.statusMutex.Unlock()
+		return nil
+	}
+	delete(c.pendingAttempts, domain)
+	c.statusMutex.Unlock()
+	status.SyncAttempts += attempts
+	if result.Err == nil {
+		status.LastSyncTime = &now
+	}
+
+	patch, err := mergePatch(map[string]interface{}{"status": original}, map[string]interface{}{"status": status})
 	if err != nil {
-		log.Error(err)
+		return fmt.Errorf("Failed to compute status patch of AthenzDomain CR: %s. Error: %v", domain, err)
+	}
+	_, err = c.athenzClientset.AthenzDomains().Patch(ctx, domain, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: FieldManager}, "status")
+	if err != nil {
+		// counted again with the next status update
+		c.statusMutex.Lock()
+		c.pendingAttempts[domain] += attempts
+		c.statusMutex.Unlock()
+		return fmt.Errorf("Failed to update status of AthenzDomain CR: %s. Error: %v", domain, err)
+	}
+	return nil
+}
+
+// setCondition - set a status condition, the transition time only changes when the status does
+func setCondition(obj *athenz_domain.AthenzDomain, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&obj.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: obj.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// errorMessage - message of a possibly nil error
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
 	}
+	return err.Error()
 }
@@ -17,8 +17,13 @@ package cr
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,9 +34,13 @@ import (
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
 	"github.com/ardielle/ardielle-go/rdl"
 	apiError "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -97,10 +106,24 @@ func getFakeDomain() zms.SignedDomain {
 	}
 }
 
+// decodedDomain - signed domain in the form the zms client decodes it, with the defaults of its Init
+func decodedDomain(t *testing.T, signedDomain zms.SignedDomain) zms.SignedDomain {
+	data, err := json.Marshal(signedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded zms.SignedDomain
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
 func newCRResource() *CRUtil {
 	athenzclientset := fake.NewSimpleClientset()
 	informer := athenzInformer.NewAthenzDomainInformer(athenzclientset, 0, cache.Indexers{
 		"trustDomain": TrustDomainIndexFunc,
+		"groupDomain": GroupDomainIndexFunc,
 	})
 	return NewCRUtil(athenzclientset, informer)
 }
@@ -169,8 +192,12 @@ func TestRemoveAthenzDomain(t *testing.T) {
 }
 
 func TestGetLatestTimestamp(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
 	times := [3]string{"2019-05-27T21:53:45Z", "2019-05-29T21:53:45Z", "2019-05-29T21:50:45Z"}
 	c := newCRResource()
+	if str := c.GetLatestTimestamp(); str != "" {
+		t.Errorf("Expected no timestamp without CRs, got %s", str)
+	}
 	for i, v := range times {
 		domainName := fmt.Sprintf("home.czhuang.test.%d", i)
 		time, err := time.Parse(time.RFC3339, v)
@@ -186,6 +213,12 @@ func TestGetLatestTimestamp(t *testing.T) {
 		signedDomain := zms.SignedDomain{
 			Domain: &domain,
 		}
+		// the domain data of the latest CR is stored compressed
+		if i == 1 {
+			c.SetCompressThreshold(1)
+		} else {
+			c.SetCompressThreshold(0)
+		}
 		cr, err := c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain)
 		if err != nil {
 			t.Errorf("Error occurred during create/update of CR. Error: %v", err)
@@ -247,3 +280,498 @@ func TestTrustDomainIndexFunc(t *testing.T) {
 		t.Error("failed to parse trust domains")
 	}
 }
+
+// TestGroupDomains - test the domains owning the groups that are role members
+func TestGroupDomains(t *testing.T) {
+	expired := rdl.Timestamp{Time: time.Now().Add(-time.Minute)}
+	data := &zms.DomainData{
+		Name: zms.DomainName(domainName),
+		Roles: []*zms.Role{
+			{
+				RoleMembers: []*zms.RoleMember{
+					{MemberName: "user.joe"},
+					{MemberName: "other.domain:group.devs"},
+					{MemberName: domainName + ":group.admins"},
+				},
+			},
+			{
+				RoleMembers: []*zms.RoleMember{
+					{MemberName: "group.domain:group.ops", Expiration: &expired},
+					{MemberName: "other.domain:group.ops"},
+				},
+			},
+		},
+	}
+	if domains := GroupDomains(data); !reflect.DeepEqual(domains, []string{"group.domain", "other.domain"}) {
+		t.Errorf("Expected the other domains owning groups, got %v", domains)
+	}
+
+	c := newCRResource()
+	if c.IsGroupDomain("other.domain") {
+		t.Error("other.domain is not a group domain")
+	}
+	domain := &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: domainName,
+		},
+		Spec: athenz_domain.AthenzDomainSpec{
+			SignedDomain: zms.SignedDomain{Domain: data},
+		},
+	}
+	c.CrIndexInformer.GetIndexer().Add(domain)
+	if !c.IsGroupDomain("other.domain") {
+		t.Error("other.domain is a group domain")
+	}
+	if dependents := c.GroupDomainDependents("group.domain"); !reflect.DeepEqual(dependents, []string{domainName}) {
+		t.Errorf("Expected %s to depend on group.domain, got %v", domainName, dependents)
+	}
+}
+
+// TestUpdateSyncStatus - test the sync outcome recorded on the AthenzDomain CR status
+func TestUpdateSyncStatus(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	signedDomain := getFakeDomain()
+	c := newCRResource()
+	cr, err := c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CrIndexInformer.GetStore().Add(cr)
+
+	zmsErr := fmt.Errorf("zms unavailable")
+	err = c.UpdateSyncStatus(context.TODO(), domainName, nil, SyncStatus{Err: zmsErr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.athenzClientset.AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status.LastError != zmsErr.Error() || res.Status.FailedAttempts != 1 || res.Status.SyncAttempts != 1 {
+		t.Errorf("Failed sync should be recorded on the status, got %+v", res.Status)
+	}
+	if !meta.IsStatusConditionFalse(res.Status.Conditions, athenz_domain.ConditionZMSReachable) {
+		t.Error("ZMSReachable condition should be false after a failed ZMS call")
+	}
+	if !meta.IsStatusConditionFalse(res.Status.Conditions, athenz_domain.ConditionSynced) {
+		t.Error("Synced condition should be false after a failed sync")
+	}
+	if meta.FindStatusCondition(res.Status.Conditions, athenz_domain.ConditionSignatureVerified) != nil {
+		t.Error("SignatureVerified condition should not be set when the domain data was never checked")
+	}
+
+	modified := metav1.NewTime(signedDomain.Domain.Modified.Time)
+	err = c.UpdateSyncStatus(context.TODO(), domainName, res, SyncStatus{
+		ZMSReachable:      true,
+		SignatureVerified: metav1.ConditionTrue,
+		Modified:          &modified,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.athenzClientset.AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := res.Status
+	if status.LastError != "" || status.Message != "" || status.FailedAttempts != 0 || status.SyncAttempts != 2 {
+		t.Errorf("Successful sync should reset the error and failed attempts, got %+v", status)
+	}
+	// the patch is serialized, which keeps the times to the second as the API server does
+	if status.LastSyncTime == nil || status.LastModified == nil || status.LastModified.Unix() != modified.Unix() {
+		t.Errorf("Successful sync should record the sync and modified times, got %+v", status)
+	}
+	for _, conditionType := range []string{athenz_domain.ConditionSynced, athenz_domain.ConditionZMSReachable, athenz_domain.ConditionSignatureVerified} {
+		if !meta.IsStatusConditionTrue(status.Conditions, conditionType) {
+			t.Errorf("%s condition should be true after a successful sync", conditionType)
+		}
+	}
+
+	// an unchanged outcome is not written again within the status update interval
+	unchanged := SyncStatus{
+		ZMSReachable:      true,
+		SignatureVerified: metav1.ConditionTrue,
+		Modified:          &modified,
+	}
+	if err := c.UpdateSyncStatus(context.TODO(), domainName, res, unchanged); err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.athenzClientset.AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status.SyncAttempts != 2 || !res.Status.LastSyncTime.Equal(status.LastSyncTime) {
+		t.Errorf("Expected no status patch for an unchanged outcome, got %+v", res.Status)
+	}
+
+	// once the interval elapsed, the sync and the ones held back are written
+	c.SetStatusUpdateInterval(0)
+	if err := c.UpdateSyncStatus(context.TODO(), domainName, res, unchanged); err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.athenzClientset.AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status.SyncAttempts != 4 || res.Status.LastSyncTime == nil || res.Status.LastSyncTime.Before(status.LastSyncTime) {
+		t.Errorf("Expected the held back syncs to be recorded, got %+v", res.Status)
+	}
+
+	// status of a domain without a CR is not recorded
+	err = c.UpdateSyncStatus(context.TODO(), "missing.domain", nil, SyncStatus{Err: zmsErr})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRoleMembers - test that expired role members are left out
+func TestRoleMembers(t *testing.T) {
+	now := time.Now()
+	expired := rdl.Timestamp{Time: now.Add(-time.Minute)}
+	valid := rdl.Timestamp{Time: now.Add(time.Hour)}
+	role := &zms.Role{
+		RoleMembers: []*zms.RoleMember{
+			{MemberName: "user.joe", Expiration: &valid},
+			{MemberName: "user.expired", Expiration: &expired},
+			{MemberName: "user.jane"},
+		},
+		Members: []zms.MemberName{"user.ignored"},
+	}
+	if members := RoleMembers(role, now); !reflect.DeepEqual(members, []string{"user.jane", "user.joe"}) {
+		t.Errorf("Expected the unexpired role members, got %v", members)
+	}
+	role.RoleMembers = nil
+	if members := RoleMembers(role, now); !reflect.DeepEqual(members, []string{"user.ignored"}) {
+		t.Errorf("Expected the members list without role members, got %v", members)
+	}
+	if members := RoleMembers(nil, now); len(members) != 0 {
+		t.Errorf("Expected no members of a nil role, got %v", members)
+	}
+}
+
+// TestDiffSpecs - test the changes computed between AthenzDomain CR specs
+func TestDiffSpecs(t *testing.T) {
+	current := &athenz_domain.AthenzDomainSpec{SignedDomain: getFakeDomain()}
+	desired := current.DeepCopy()
+	desired.Signature = "new-signature"
+	if diff := DiffSpecs(domainName, current, desired); diff.Action != ActionNone {
+		t.Errorf("Expected no change when only the signature differs, got %s", diff)
+	}
+
+	deny := zms.DENY
+	desired.Domain.Roles[0].RoleMembers = append(desired.Domain.Roles[0].RoleMembers, &zms.RoleMember{MemberName: "user.new"})
+	desired.Domain.Roles = desired.Domain.Roles[:1]
+	desired.Domain.Policies.Contents.Policies[0].Assertions[0].Effect = &deny
+	diff := DiffSpecs(domainName, current, desired)
+	expected := &DomainDiff{
+		Domain:            domainName,
+		Action:            ActionUpdate,
+		RolesAdded:        []string{},
+		RolesRemoved:      []string{domainName + ":role.trust"},
+		MembersAdded:      []string{domainName + ":role.admin/user.new"},
+		MembersRemoved:    []string{},
+		PoliciesAdded:     []string{},
+		PoliciesRemoved:   []string{},
+		AssertionsAdded:   []string{domainName + ":policy.admin/DENY " + domainName + ":role.admin * " + domainName + ".test:*"},
+		AssertionsRemoved: []string{domainName + ":policy.admin/ALLOW " + domainName + ":role.admin * " + domainName + ".test:*"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Expected diff %s, got %s", expected, diff)
+	}
+
+	diff = DiffSpecs(domainName, nil, current)
+	if diff.Action != ActionCreate || len(diff.RolesAdded) != 2 || len(diff.PoliciesAdded) != 1 {
+		t.Errorf("Expected a create adding all roles and policies, got %s", diff)
+	}
+	diff = DiffSpecs(domainName, current, nil)
+	if diff.Action != ActionDelete || len(diff.RolesRemoved) != 2 || len(diff.AssertionsRemoved) != 1 {
+		t.Errorf("Expected a delete removing all roles and assertions, got %s", diff)
+	}
+}
+
+// TestDryRun - test that no AthenzDomain CR is written in dry run mode
+func TestDryRun(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	signedDomain := getFakeDomain()
+	c := newCRResource()
+	c.SetDryRun(true)
+
+	cr, err := c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain)
+	if err != nil || cr != nil {
+		t.Errorf("Expected no CR to be written in dry run mode, got %v. Error: %v", cr, err)
+	}
+	if _, err := c.athenzClientset.AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{}); !apiError.IsNotFound(err) {
+		t.Errorf("Expected the CR not to be created in dry run mode. Error: %v", err)
+	}
+	diff, err := c.Diff(domainName, &signedDomain)
+	if err != nil || diff.Action != ActionCreate {
+		t.Errorf("Expected the CR creation to be computed, got %v. Error: %v", diff, err)
+	}
+
+	c.SetDryRun(false)
+	cr, err = c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CrIndexInformer.GetStore().Add(cr)
+	c.SetDryRun(true)
+	if err := c.RemoveAthenzDomain(context.TODO(), domainName); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.athenzClientset.AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{}); err != nil {
+		t.Errorf("Expected the CR not to be deleted in dry run mode. Error: %v", err)
+	}
+	if err := c.UpdateSyncStatus(context.TODO(), domainName, nil, SyncStatus{ZMSReachable: true}); err != nil {
+		t.Error(err)
+	}
+	res, err := c.athenzClientset.AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{})
+	if err != nil || res.Status.SyncAttempts != 0 {
+		t.Errorf("Expected the CR status not to be updated in dry run mode, got %v. Error: %v", res, err)
+	}
+	diff, err = c.Diff(domainName, nil)
+	if err != nil || diff.Action != ActionDelete {
+		t.Errorf("Expected the CR deletion to be computed, got %v. Error: %v", diff, err)
+	}
+}
+
+// TestDumpAthenzDomains - test that the AthenzDomain CRs are written as files that decode back into the CRs
+func TestDumpAthenzDomains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objs := []athenz_domain.AthenzDomain{{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              domainName,
+			ManagedFields:     []metav1.ManagedFieldsEntry{{Manager: "k8s-athenz-syncer"}},
+			ResourceVersion:   "42",
+			UID:               "9b2f4c1e-0d6a-4c55-8f0e-1f2a3b4c5d6e",
+			CreationTimestamp: metav1.Now(),
+		},
+		Spec:   athenz_domain.AthenzDomainSpec{SignedDomain: getFakeDomain()},
+		Status: athenz_domain.AthenzDomainStatus{SyncAttempts: 3},
+	}}
+
+	for _, format := range []string{FormatYAML, FormatJSON} {
+		files, err := DumpAthenzDomains(objs, dir, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := filepath.Join(dir, domainName+"."+format)
+		if !reflect.DeepEqual(files, []string{expected}) {
+			t.Fatalf("Expected file %s, got %v", expected, files)
+		}
+		data, err := ioutil.ReadFile(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := &athenz_domain.AthenzDomain{}
+		if err := yaml.Unmarshal(data, obj); err != nil {
+			t.Fatal(err)
+		}
+		if obj.Kind != "AthenzDomain" || obj.APIVersion != athenz_domain.SchemeGroupVersion.String() || len(obj.ManagedFields) != 0 {
+			t.Errorf("Expected an applicable AthenzDomain object, got %v %v", obj.TypeMeta, obj.ManagedFields)
+		}
+		if obj.ResourceVersion != "" || obj.UID != "" || !obj.CreationTimestamp.IsZero() || !reflect.DeepEqual(obj.Status, athenz_domain.AthenzDomainStatus{}) {
+			t.Errorf("Expected the fields set by the API server to be stripped in %s format, got %v %v", format, obj.ObjectMeta, obj.Status)
+		}
+		if !reflect.DeepEqual(obj.Spec.SignedDomain, decodedDomain(t, getFakeDomain())) {
+			t.Errorf("Expected the dumped spec to decode to the CR spec in %s format", format)
+		}
+	}
+
+	if _, err := DumpAthenzDomains(objs, dir, "xml"); err == nil {
+		t.Error("Expected an error for an unsupported format")
+	}
+}
+
+// TestUpdateCRPatch - test that updates only send the changed fields and apply over concurrent changes
+func TestUpdateCRPatch(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	athenzclientset := fake.NewSimpleClientset()
+	informer := athenzInformer.NewAthenzDomainInformer(athenzclientset, 0, cache.Indexers{})
+	c := NewCRUtil(athenzclientset, informer)
+	signedDomain := getFakeDomain()
+	cr, err := c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.ResourceVersion = "1"
+	c.CrIndexInformer.GetStore().Add(cr)
+
+	// another writer changes the CR after it was cached
+	current, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Labels = map[string]string{"team": "security"}
+	if _, err := athenzclientset.AthenzV1().AthenzDomains().Update(context.TODO(), current, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	athenzclientset.ClearActions()
+	// the patch computed from the stale cached copy conflicts once
+	conflicts := 0
+	athenzclientset.PrependReactor("patch", "athenzdomains", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, apiError.NewConflict(athenz_domain.Resource("athenzdomains"), domainName, fmt.Errorf("the object has been modified"))
+	})
+	signedDomain.Domain.Roles[0].RoleMembers = append(signedDomain.Domain.Roles[0].RoleMembers, &zms.RoleMember{MemberName: "user.new"})
+	if _, err := c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain); err != nil {
+		t.Fatalf("Update should be retried over concurrent changes. Error: %v", err)
+	}
+	actions := athenzclientset.Actions()
+	if len(actions) != 3 || actions[0].GetVerb() != "patch" || actions[1].GetVerb() != "get" || actions[2].GetVerb() != "patch" {
+		t.Fatalf("Expected a conflicting patch, a get of the latest CR and a patch, got %v", actions)
+	}
+	patch := string(actions[0].(k8stesting.PatchAction).GetPatch())
+	if !strings.Contains(patch, `"resourceVersion":"1"`) {
+		t.Errorf("Expected the patch to carry the resource version of the cached CR, got %s", patch)
+	}
+	patch = string(actions[2].(k8stesting.PatchAction).GetPatch())
+	if !strings.Contains(patch, "user.new") || strings.Contains(patch, "policies") || strings.Contains(patch, "status") {
+		t.Errorf("Expected the patch to only carry the changed roles, got %s", patch)
+	}
+	res, err := athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Labels["team"] != "security" || len(res.Spec.Domain.Roles[0].RoleMembers) != 2 {
+		t.Errorf("Expected the patch to keep the concurrent change, got labels %v and members %v", res.Labels, res.Spec.Domain.Roles[0].RoleMembers)
+	}
+
+	// the status of the stale cached copy never reverts the newer spec
+	if err := c.UpdateSyncStatus(context.TODO(), domainName, nil, SyncStatus{ZMSReachable: true}); err != nil {
+		t.Fatal(err)
+	}
+	res, err = athenzclientset.AthenzV1().AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Spec.Domain.Roles[0].RoleMembers) != 2 || res.Status.SyncAttempts != 1 {
+		t.Errorf("Expected only the status to be patched, got members %v and status %+v", res.Spec.Domain.Roles[0].RoleMembers, res.Status)
+	}
+}
+
+// TestCompressedDomain - test that large domains are stored compressed and read back with SignedDomain
+func TestCompressedDomain(t *testing.T) {
+	signedDomain := getFakeDomain()
+	for i := 0; i < 1000; i++ {
+		member := &zms.RoleMember{MemberName: zms.MemberName(fmt.Sprintf("user.member%d", i))}
+		signedDomain.Domain.Roles[0].RoleMembers = append(signedDomain.Domain.Roles[0].RoleMembers, member)
+	}
+	signedDomain = decodedDomain(t, signedDomain)
+	c := newCRResource()
+	c.SetCompressThreshold(10000)
+
+	cr, err := c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Spec.CompressedDomain == "" || cr.Spec.Domain != nil {
+		t.Fatal("Expected the domain data to be stored compressed")
+	}
+	raw, _ := json.Marshal(signedDomain)
+	if len(cr.Spec.CompressedDomain) >= len(raw) {
+		t.Errorf("Expected the compressed domain to be smaller than %d bytes, got %d", len(raw), len(cr.Spec.CompressedDomain))
+	}
+	decoded, err := SignedDomain(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*decoded, signedDomain) {
+		t.Error("Expected SignedDomain to return the full signed domain")
+	}
+	c.CrIndexInformer.GetStore().Add(cr)
+	trustDomains, _ := TrustDomainIndexFunc(cr)
+	if !reflect.DeepEqual(trustDomains, []string{"parent.domain"}) {
+		t.Errorf("Expected the trust domains of the compressed CR, got %v", trustDomains)
+	}
+
+	// a new signature alone does not rewrite the compressed CR
+	signedDomain.Signature = "new-signature"
+	cr, err = c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain)
+	if err != nil || cr != nil {
+		t.Errorf("Expected no update, got %v and error %v", cr, err)
+	}
+	diff, err := c.Diff(domainName, &signedDomain)
+	if err != nil || diff.Action != ActionNone {
+		t.Errorf("Expected no changes, got %v and error %v", diff, err)
+	}
+
+	// the CR switches back to the inline form when compression is disabled
+	c.SetCompressThreshold(0)
+	cr, err = c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Spec.CompressedDomain != "" || !reflect.DeepEqual(cr.Spec.SignedDomain, signedDomain) {
+		t.Error("Expected the domain data to be stored inline")
+	}
+
+	if _, err := SignedDomain(&athenz_domain.AthenzDomain{Spec: athenz_domain.AthenzDomainSpec{CompressedDomain: "invalid"}}); err == nil {
+		t.Error("Expected an error for an invalid compressed domain")
+	}
+}
+
+// TestOrphan - test marking, expiring, unmarking and removing orphaned CRs
+func TestOrphan(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	signedDomain := getFakeDomain()
+	c := newCRResource()
+	c.SetDeletionPolicy(DeletionDelayed, time.Hour)
+	obj, err := c.CreateUpdateAthenzDomain(context.TODO(), domainName, &signedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the informers are not running, keep the store in sync with the clientset
+	syncStore := func() *athenz_domain.AthenzDomain {
+		obj, err := c.athenzClientset.AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.CrIndexInformer.GetStore().Update(obj)
+		return obj
+	}
+	c.CrIndexInformer.GetStore().Add(obj)
+
+	now := time.Now().Truncate(time.Second)
+	if err := c.MarkOrphaned(context.TODO(), obj, now); err != nil {
+		t.Fatal(err)
+	}
+	obj = syncStore()
+	orphanedAt, orphaned := OrphanedAt(obj)
+	if !orphaned || !orphanedAt.Equal(now) || !HasOrphanFinalizer(obj) {
+		t.Fatalf("Expected the CR to be annotated orphaned at %s with the orphan finalizer, got %v %v", now, obj.Annotations, obj.Finalizers)
+	}
+	if c.OrphanExpired(obj, now.Add(time.Minute)) || !c.OrphanExpired(obj, now.Add(time.Hour)) {
+		t.Error("Expected the orphaned CR to expire after the orphan TTL with the delayed policy")
+	}
+	c.SetDeletionPolicy(DeletionRetain, time.Hour)
+	if c.OrphanExpired(obj, now.Add(48*time.Hour)) {
+		t.Error("Expected the orphaned CR never to expire with the retain policy")
+	}
+
+	if err := c.UnmarkOrphaned(context.TODO(), obj); err != nil {
+		t.Fatal(err)
+	}
+	obj = syncStore()
+	if _, orphaned := OrphanedAt(obj); orphaned || HasOrphanFinalizer(obj) {
+		t.Errorf("Expected the orphaned annotation and finalizer to be removed, got %v %v", obj.Annotations, obj.Finalizers)
+	}
+
+	if err := c.MarkOrphaned(context.TODO(), obj, now); err != nil {
+		t.Fatal(err)
+	}
+	syncStore()
+	if err := c.RemoveAthenzDomain(context.TODO(), domainName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.athenzClientset.AthenzDomains().Get(context.TODO(), domainName, v1.GetOptions{}); !apiError.IsNotFound(err) {
+		t.Errorf("Expected the orphaned CR to be deleted once its finalizer is released. Error: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cr
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+)
+
+// actions on the AthenzDomain CR computed by a diff
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	ActionNone   = "none"
+)
+
+// DomainDiff - changes a sync would make to the AthenzDomain CR of a domain. Members are listed as
+// <role>/<member> and assertions as <policy>/<effect> <role> <action> <resource>.
+type DomainDiff struct {
+	Domain            string   `json:"domain"`
+	Action            string   `json:"action"`
+	RolesAdded        []string `json:"rolesAdded,omitempty"`
+	RolesRemoved      []string `json:"rolesRemoved,omitempty"`
+	MembersAdded      []string `json:"membersAdded,omitempty"`
+	MembersRemoved    []string `json:"membersRemoved,omitempty"`
+	PoliciesAdded     []string `json:"policiesAdded,omitempty"`
+	PoliciesRemoved   []string `json:"policiesRemoved,omitempty"`
+	AssertionsAdded   []string `json:"assertionsAdded,omitempty"`
+	AssertionsRemoved []string `json:"assertionsRemoved,omitempty"`
+}
+
+// String - JSON form of the diff for logs
+func (d *DomainDiff) String() string {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Sprintf("%s AthenzDomain %s", d.Action, d.Domain)
+	}
+	return string(b)
+}
+
+// Diff - changes between the AthenzDomain CR of the domain in the informer store and the domain data,
+// a nil domain data computes the deletion of the CR
+func (c *CRUtil) Diff(domain string, domainData *zms.SignedDomain) (*DomainDiff, error) {
+	obj, exists, err := c.GetCRByName(domain)
+	if err != nil {
+		return nil, err
+	}
+	var current *athenz_domain.AthenzDomainSpec
+	if exists {
+		current, err = decodeSpec(&obj.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decompress AthenzDomain CR %s. Error: %v", domain, err)
+		}
+	}
+	var desired *athenz_domain.AthenzDomainSpec
+	if domainData != nil {
+		desired = &athenz_domain.AthenzDomainSpec{SignedDomain: *domainData}
+	}
+	return DiffSpecs(domain, current, desired), nil
+}
+
+// DiffSpecs - changes between the current and the desired AthenzDomain CR specs, nil when the CR does not exist
+func DiffSpecs(domain string, current, desired *athenz_domain.AthenzDomainSpec) *DomainDiff {
+	diff := &DomainDiff{Domain: domain}
+	switch {
+	case current == nil && desired == nil:
+		diff.Action = ActionNone
+		return diff
+	case current == nil:
+		diff.Action = ActionCreate
+	case desired == nil:
+		diff.Action = ActionDelete
+	case specEqual(current, desired):
+		diff.Action = ActionNone
+		return diff
+	default:
+		diff.Action = ActionUpdate
+	}
+	currentRoles, currentMembers := roleEntries(current)
+	desiredRoles, desiredMembers := roleEntries(desired)
+	diff.RolesAdded, diff.RolesRemoved = compare(currentRoles, desiredRoles)
+	diff.MembersAdded, diff.MembersRemoved = compare(currentMembers, desiredMembers)
+	currentPolicies, currentAssertions := policyEntries(current)
+	desiredPolicies, desiredAssertions := policyEntries(desired)
+	diff.PoliciesAdded, diff.PoliciesRemoved = compare(currentPolicies, desiredPolicies)
+	diff.AssertionsAdded, diff.AssertionsRemoved = compare(currentAssertions, desiredAssertions)
+	return diff
+}
+
+// specEqual - compare the specs ignoring the signatures, which change on every ZMS response
+func specEqual(current, desired *athenz_domain.AthenzDomainSpec) bool {
+	currentCopy := current.DeepCopy()
+	desiredCopy := desired.DeepCopy()
+	for _, spec := range []*athenz_domain.AthenzDomainSpec{currentCopy, desiredCopy} {
+		spec.Signature = ""
+		if spec.Domain != nil && spec.Domain.Policies != nil {
+			spec.Domain.Policies.Signature = ""
+		}
+	}
+	return reflect.DeepEqual(currentCopy, desiredCopy)
+}
+
+// roleEntries - role names and <role>/<member> entries of the spec, expired members included as they are
+// part of the CR
+func roleEntries(spec *athenz_domain.AthenzDomainSpec) (map[string]bool, map[string]bool) {
+	roles, members := map[string]bool{}, map[string]bool{}
+	if spec == nil || spec.Domain == nil {
+		return roles, members
+	}
+	for _, role := range spec.Domain.Roles {
+		if role == nil {
+			continue
+		}
+		roles[string(role.Name)] = true
+		for _, member := range RoleMembers(role, time.Time{}) {
+			members[string(role.Name)+"/"+member] = true
+		}
+	}
+	return roles, members
+}
+
+// policyEntries - policy names and <policy>/<effect> <role> <action> <resource> entries of the spec
+func policyEntries(spec *athenz_domain.AthenzDomainSpec) (map[string]bool, map[string]bool) {
+	policies, assertions := map[string]bool{}, map[string]bool{}
+	if spec == nil || spec.Domain == nil || spec.Domain.Policies == nil || spec.Domain.Policies.Contents == nil {
+		return policies, assertions
+	}
+	for _, policy := range spec.Domain.Policies.Contents.Policies {
+		if policy == nil {
+			continue
+		}
+		policies[string(policy.Name)] = true
+		for _, assertion := range policy.Assertions {
+			if assertion == nil {
+				continue
+			}
+			effect := zms.ALLOW
+			if assertion.Effect != nil {
+				effect = *assertion.Effect
+			}
+			assertions[fmt.Sprintf("%s/%s %s %s %s", policy.Name, effect, assertion.Role, assertion.Action, assertion.Resource)] = true
+		}
+	}
+	return policies, assertions
+}
+
+// compare - sorted entries only in desired and only in current
+func compare(current, desired map[string]bool) ([]string, []string) {
+	added, removed := []string{}, []string{}
+	for entry := range desired {
+		if !current[entry] {
+			added = append(added, entry)
+		}
+	}
+	for entry := range current {
+		if !desired[entry] {
+			removed = append(removed, entry)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
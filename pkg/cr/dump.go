@@ -0,0 +1,74 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// dump formats
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// DumpAthenzDomains - write every AthenzDomain CR to <dir>/<name>.<format> in the yaml or json format and
+// return the files written. The objects are written so that they can be applied again with kubectl.
+func DumpAthenzDomains(objs []athenz_domain.AthenzDomain, dir, format string) ([]string, error) {
+	if format != FormatYAML && format != FormatJSON {
+		return nil, fmt.Errorf("Unsupported dump format %s, expected %s or %s", format, FormatYAML, FormatJSON)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create dump directory %s. Error: %v", dir, err)
+	}
+	files := []string{}
+	for i := range objs {
+		obj := objs[i].DeepCopy()
+		// list items carry no type meta
+		obj.APIVersion = athenz_domain.SchemeGroupVersion.String()
+		obj.Kind = "AthenzDomain"
+		// fields set by the API server make the apply fail or conflict
+		obj.ManagedFields = nil
+		obj.ResourceVersion = ""
+		obj.UID = ""
+		obj.CreationTimestamp = metav1.Time{}
+		obj.Status = athenz_domain.AthenzDomainStatus{}
+		var data []byte
+		var err error
+		if format == FormatJSON {
+			data, err = json.MarshalIndent(obj, "", "  ")
+		} else {
+			data, err = yaml.Marshal(obj)
+		}
+		if err != nil {
+			return files, fmt.Errorf("Unable to encode AthenzDomain CR %s. Error: %v", obj.Name, err)
+		}
+		file := filepath.Join(dir, obj.Name+"."+format)
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			return files, fmt.Errorf("Unable to write AthenzDomain CR %s. Error: %v", obj.Name, err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
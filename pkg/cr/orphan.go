@@ -0,0 +1,171 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// deletion policies of the AthenzDomain CRs whose domain is no longer mapped to a namespace, the admin
+// domain, a system domain, a trust domain or a group domain
+const (
+	// DeletionImmediate - delete the CR as soon as it is orphaned
+	DeletionImmediate = "immediate"
+	// DeletionDelayed - mark the CR orphaned and delete it once it stayed orphaned for the orphan TTL
+	DeletionDelayed = "delayed"
+	// DeletionRetain - mark the CR orphaned and keep it until it is deleted by hand
+	DeletionRetain = "retain"
+)
+
+const (
+	// OrphanedAtAnnotation - time the AthenzDomain CR was orphaned, in RFC 3339 format
+	OrphanedAtAnnotation = "athenz.io/orphaned-at"
+	// OrphanFinalizer - finalizer keeping an orphaned AthenzDomain CR until the syncer releases it
+	OrphanFinalizer = "athenz.io/orphan-protection"
+)
+
+// SetDeletionPolicy - set the policy applied to orphaned AthenzDomain CRs and the time delayed CRs are kept
+func (c *CRUtil) SetDeletionPolicy(policy string, ttl time.Duration) {
+	c.deletionPolicy = policy
+	c.orphanTTL = ttl
+}
+
+// DeletionPolicy - policy applied to orphaned AthenzDomain CRs, DeletionImmediate when not set
+func (c *CRUtil) DeletionPolicy() string {
+	if c.deletionPolicy == "" {
+		return DeletionImmediate
+	}
+	return c.deletionPolicy
+}
+
+// OrphanedAt - time the CR was marked orphaned, false when it is not orphaned. A malformed annotation
+// counts as orphaned since the epoch, so that it does not keep the CR forever.
+func OrphanedAt(obj *athenz_domain.AthenzDomain) (time.Time, bool) {
+	if obj == nil {
+		return time.Time{}, false
+	}
+	value, ok := obj.Annotations[OrphanedAtAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	orphanedAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Warnf("Invalid %s annotation %q on AthenzDomain CR %s", OrphanedAtAnnotation, value, obj.Name)
+		return time.Time{}, true
+	}
+	return orphanedAt, true
+}
+
+// OrphanExpired - check if the orphaned CR may be deleted under the deletion policy: right away with the
+// immediate policy, after the orphan TTL with the delayed policy, and only once deleted by hand with the
+// retain policy
+func (c *CRUtil) OrphanExpired(obj *athenz_domain.AthenzDomain, now time.Time) bool {
+	orphanedAt, orphaned := OrphanedAt(obj)
+	if !orphaned {
+		return false
+	}
+	switch c.DeletionPolicy() {
+	case DeletionDelayed:
+		return !now.Before(orphanedAt.Add(c.orphanTTL))
+	case DeletionRetain:
+		return obj.DeletionTimestamp != nil
+	default:
+		return true
+	}
+}
+
+// MarkOrphaned - annotate the CR with the time it was orphaned and add the orphan finalizer, so that it
+// is kept until the syncer releases it
+func (c *CRUtil) MarkOrphaned(ctx context.Context, obj *athenz_domain.AthenzDomain, now time.Time) error {
+	if c.dryRun {
+		log.Infof("Dry run: skipping marking AthenzDomain CR %s orphaned", obj.Name)
+		return nil
+	}
+	finalizers := obj.Finalizers
+	if !HasOrphanFinalizer(obj) {
+		finalizers = append(append([]string{}, finalizers...), OrphanFinalizer)
+	}
+	return c.patchMetadata(ctx, obj, now.UTC().Format(time.RFC3339), finalizers)
+}
+
+// UnmarkOrphaned - remove the orphaned annotation and the orphan finalizer of a CR whose domain is mapped again
+func (c *CRUtil) UnmarkOrphaned(ctx context.Context, obj *athenz_domain.AthenzDomain) error {
+	if c.dryRun {
+		log.Infof("Dry run: skipping removal of the orphaned mark of AthenzDomain CR %s", obj.Name)
+		return nil
+	}
+	return c.patchMetadata(ctx, obj, nil, withoutFinalizer(obj))
+}
+
+// releaseFinalizer - remove the orphan finalizer so that the CR can be deleted
+func (c *CRUtil) releaseFinalizer(ctx context.Context, obj *athenz_domain.AthenzDomain) error {
+	if !HasOrphanFinalizer(obj) {
+		return nil
+	}
+	return c.patchMetadata(ctx, obj, nil, withoutFinalizer(obj))
+}
+
+// patchMetadata - set the orphaned annotation, or remove it when nil, and the finalizers of the CR. The patch
+// carries the resource version as the finalizers list is replaced as a whole.
+func (c *CRUtil) patchMetadata(ctx context.Context, obj *athenz_domain.AthenzDomain, orphanedAt interface{}, finalizers []string) error {
+	if finalizers == nil {
+		finalizers = []string{}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": obj.ResourceVersion,
+			"annotations":     map[string]interface{}{OrphanedAtAnnotation: orphanedAt},
+			"finalizers":      finalizers,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.athenzClientset.AthenzDomains().Patch(ctx, obj.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: FieldManager})
+	if err != nil {
+		return fmt.Errorf("Failed to patch metadata of AthenzDomain CR: %s. Error: %v", obj.Name, err)
+	}
+	return nil
+}
+
+// HasOrphanFinalizer - check if the CR carries the orphan finalizer
+func HasOrphanFinalizer(obj *athenz_domain.AthenzDomain) bool {
+	for _, finalizer := range obj.Finalizers {
+		if finalizer == OrphanFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutFinalizer - finalizers of the CR other than the orphan finalizer
+func withoutFinalizer(obj *athenz_domain.AthenzDomain) []string {
+	finalizers := []string{}
+	for _, finalizer := range obj.Finalizers {
+		if finalizer != OrphanFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	return finalizers
+}
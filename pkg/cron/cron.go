@@ -18,23 +18,32 @@ package cron
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/health"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/metrics"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/priorityqueue"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/util"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/zmsclient"
+	"github.com/ardielle/ardielle-go/rdl"
 	"github.com/cenkalti/backoff"
 	corev1 "k8s.io/api/core/v1"
 	apiError "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/workqueue"
 )
 
 const (
 	trustDomainIndexKey = "trustDomain"
+	groupDomainIndexKey = "groupDomain"
+	// recorded etags further ahead of the local clock are considered invalid
+	maxEtagClockSkew = 5 * time.Minute
 )
 
 // AthenzContactTimeConfigMap for recording the latesttime that the Update Cron contacted Athenz
@@ -42,29 +51,44 @@ type AthenzContactTimeConfigMap struct {
 	Namespace,
 	Name,
 	Key string
+	// Horizon is the maximum age of the recorded etag to resume from, 0 disables the check
+	Horizon time.Duration
 }
 
 // Cron type for cron updates
 type Cron struct {
-	k8sClient     kubernetes.Interface
+	k8sClient kubernetes.Interface
+	// lock guards the intervals which can be reloaded while the crons run
+	lock          sync.RWMutex
 	checkInterval time.Duration
 	syncInterval  time.Duration
+	// the crons restart their sleep when their interval is changed
+	checkReset    chan struct{}
+	syncReset     chan struct{}
 	etag          string
-	zmsClient     *zms.ZMSClient
+	zmsClient     zmsclient.Client
 	nsInformer    cache.SharedIndexInformer
-	queue         workqueue.RateLimitingInterface
+	queue         priorityqueue.Interface
 	util          *util.Util
 	cr            *cr.CRUtil
 	contactTimeCm *AthenzContactTimeConfigMap
+	// etagLock guards the etag and the domains queued by the update cron that are not synced yet, pending
+	// maps them to the index of the etag they were modified since in checkpoints
+	etagLock    sync.Mutex
+	pending     map[string]int
+	checkpoints []string
 }
 
 // NewCron - creates new cron object
-func NewCron(k8sClient kubernetes.Interface, checkInterval time.Duration, syncInterval time.Duration, etag string, zmsClient *zms.ZMSClient, informer cache.SharedIndexInformer, queue workqueue.RateLimitingInterface, util *util.Util, cr *cr.CRUtil, cm *AthenzContactTimeConfigMap) *Cron {
+func NewCron(k8sClient kubernetes.Interface, checkInterval time.Duration, syncInterval time.Duration, etag string, zmsClient zmsclient.Client, informer cache.SharedIndexInformer, queue priorityqueue.Interface, util *util.Util, cr *cr.CRUtil, cm *AthenzContactTimeConfigMap) *Cron {
 	return &Cron{
 		k8sClient:     k8sClient,
 		checkInterval: checkInterval,
 		syncInterval:  syncInterval,
+		checkReset:    make(chan struct{}, 1),
+		syncReset:     make(chan struct{}, 1),
 		etag:          etag,
+		pending:       map[string]int{},
 		zmsClient:     zmsClient,
 		nsInformer:    informer,
 		queue:         queue,
@@ -76,15 +100,49 @@ func NewCron(k8sClient kubernetes.Interface, checkInterval time.Duration, syncIn
 
 // SetEtag - set initial etag in cron field
 func (c *Cron) SetEtag(timestamp string) {
+	c.etagLock.Lock()
 	c.etag = timestamp
+	c.etagLock.Unlock()
+	metrics.SetEtag(timestamp)
+}
+
+// SetIntervals - change the update cron and full resync cron intervals, a running sleep is restarted
+// with the new interval
+func (c *Cron) SetIntervals(checkInterval, syncInterval time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if checkInterval != c.checkInterval {
+		c.checkInterval = checkInterval
+		notify(c.checkReset)
+	}
+	if syncInterval != c.syncInterval {
+		c.syncInterval = syncInterval
+		notify(c.syncReset)
+	}
+}
+
+// getIntervals - get the current update cron and full resync cron intervals
+func (c *Cron) getIntervals() (time.Duration, time.Duration) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.checkInterval, c.syncInterval
+}
+
+// notify - send on the channel without blocking when a notification is already pending
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
 }
 
 // getExponentialBackoff - set parameters for exponential retries
 func (c *Cron) getExponentialBackoff() *backoff.ExponentialBackOff {
+	checkInterval, _ := c.getIntervals()
 	b := backoff.NewExponentialBackOff()
 	b.InitialInterval = 2 * time.Second
 	b.Multiplier = 2
-	b.MaxElapsedTime = c.checkInterval / 2
+	b.MaxElapsedTime = checkInterval / 2
 	return b
 }
 
@@ -97,35 +155,105 @@ func notifyOnErr(err error, backoffDelay time.Duration) {
 func (c *Cron) requestCall() error {
 	master := false
 	conditions := false
+	start := time.Now()
 	domains, etag, err := c.zmsClient.GetSignedDomains("", "true", "", &master, &conditions, c.etag)
+	metrics.ObserveZMSRequest(metrics.CallGetModifiedDomain, start, err)
+	metrics.RecordCronRequest(err)
 	if err != nil {
 		return fmt.Errorf("Error getting latest updated domains from ZMS API. Error: %v", err)
 	}
+	health.RecordZMSSuccess()
+	queued := []string{}
 	if err == nil && domains != nil && len(domains.Domains) > 0 {
 		for _, domain := range domains.Domains {
 			domainName := string(domain.Domain.Name)
 			valid := c.ValidateDomain(domainName)
 			if valid {
-				c.queue.AddRateLimited(domainName)
+				queued = append(queued, domainName)
 			}
 		}
 	}
+	// tracked before they are queued, so that a worker syncing them right away finds them
+	c.trackPending(queued)
+	for _, domainName := range queued {
+		c.queue.AddWithPriority(domainName, priorityqueue.PriorityHigh)
+	}
 	if etag != "" {
-		c.etag = etag
-		c.UpdateAthenzContactTime(etag)
+		c.SetEtag(etag)
+		c.etagLock.Lock()
+		defer c.etagLock.Unlock()
+		if checkpoint := c.checkpoint(); checkpoint != "" {
+			c.UpdateAthenzContactTime(checkpoint)
+		}
 	}
 	return nil
 }
 
+// trackPending - record the domains queued by the update cron as modified since the current etag, a domain
+// already pending keeps its older etag
+func (c *Cron) trackPending(domains []string) {
+	if len(domains) == 0 {
+		return
+	}
+	c.etagLock.Lock()
+	defer c.etagLock.Unlock()
+	if len(c.pending) == 0 {
+		c.checkpoints = nil
+	}
+	index := len(c.checkpoints)
+	c.checkpoints = append(c.checkpoints, c.etag)
+	for _, domain := range domains {
+		if _, ok := c.pending[domain]; !ok {
+			c.pending[domain] = index
+		}
+	}
+}
+
+// checkpoint - etag to resume from after a restart: the current etag once all the domains queued by the update
+// cron are synced, otherwise the etag the oldest pending domain was modified since, so that it is fetched again.
+// The etagLock must be held.
+func (c *Cron) checkpoint() string {
+	oldest := -1
+	for _, index := range c.pending {
+		if oldest < 0 || index < oldest {
+			oldest = index
+		}
+	}
+	if oldest < 0 {
+		return c.etag
+	}
+	return c.checkpoints[oldest]
+}
+
+// MarkSynced - record that the domain was synced, the etag recorded in the contact time config map moves ahead
+// once the domains queued before it are all synced
+func (c *Cron) MarkSynced(domain string) {
+	c.etagLock.Lock()
+	defer c.etagLock.Unlock()
+	if _, ok := c.pending[domain]; !ok {
+		return
+	}
+	previous := c.checkpoint()
+	delete(c.pending, domain)
+	if checkpoint := c.checkpoint(); checkpoint != previous && checkpoint != "" {
+		c.UpdateAthenzContactTime(checkpoint)
+	}
+}
+
 // UpdateCron - Run starts the main controller loop running sync at every poll interval
 func (c *Cron) UpdateCron(stopCh <-chan struct{}) {
 	for {
-		log.Infoln("Athenz Update Cron Sleeping for", c.checkInterval)
+		checkInterval, _ := c.getIntervals()
+		// an iteration sleeps for the interval and retries for up to half of it
+		health.Beat(health.LoopUpdateCron, checkInterval+checkInterval/2)
+		log.Infoln("Athenz Update Cron Sleeping for", checkInterval)
 		select {
 		case <-stopCh:
 			log.Infoln("Update Cron is stopped.")
 			return
-		case <-time.After(c.checkInterval):
+		case <-c.checkReset:
+			log.Infoln("Update Cron interval changed.")
+		case <-time.After(checkInterval):
 			log.Infoln("Update Cron start to process updated Athenz Domains")
 			backoff.RetryNotify(c.requestCall, c.getExponentialBackoff(), notifyOnErr)
 		}
@@ -135,46 +263,86 @@ func (c *Cron) UpdateCron(stopCh <-chan struct{}) {
 // FullResync - add all namespaces to the queue for full resync
 func (c *Cron) FullResync(stopCh <-chan struct{}) {
 	for {
-		log.Infoln("Full Resync Cron Sleeping for ", c.syncInterval)
+		_, syncInterval := c.getIntervals()
+		log.Infoln("Full Resync Cron Sleeping for ", syncInterval)
 		select {
 		case <-stopCh:
 			log.Infoln("Resync Cron is stopped.")
 			return
-		case <-time.After(c.syncInterval):
+		case <-c.syncReset:
+			log.Infoln("Full Resync Cron interval changed.")
+		case <-time.After(syncInterval):
 			log.Infoln("Full Resync Cron start to add all namespaces to work queue")
-			// handle namespaces
-			nslist := c.nsInformer.GetStore().List()
-			for _, ns := range nslist {
-				namespace, ok := ns.(*corev1.Namespace)
-				if !ok {
-					log.Error("Error occurred when casting namespace into string")
-					continue
-				}
-				if c.util.IsNamespaceExcluded(namespace.ObjectMeta.Name) {
-					log.Infof("Skip processing excluded namespace: %s", namespace.ObjectMeta.Name)
-					continue
-				}
-				domainName := c.util.NamespaceToDomain(namespace.ObjectMeta.Name)
-				c.queue.AddRateLimited(domainName)
-			}
-			// handle admin domain and system namespaces
-			c.AddAdminSystemDomains()
-			// handle trust domains
-			// ListIndexFuncValues returns the list of keys of a particular index
-			// it returns all the trust domains even if they're not used anymore
-			trustdomains := c.cr.CrIndexInformer.GetIndexer().ListIndexFuncValues(trustDomainIndexKey)
-			for _, domain := range trustdomains {
-				// if the trust domain exist in informer store then we add to the queue
-				_, exist, err := c.cr.CrIndexInformer.GetStore().GetByKey(domain)
-				if err != nil {
-					log.Errorf("Error occurred when checking trust domains in informder store. %v", err)
-					continue
-				}
-				if exist {
-					c.queue.AddRateLimited(domain)
-				}
+			c.CollectOrphans()
+			c.ResyncAll()
+		}
+	}
+}
+
+// ResyncAll - add all namespaces, the admin domain, the system domains and the trust domains to the queue
+func (c *Cron) ResyncAll() {
+	// handle namespaces
+	nslist := c.nsInformer.GetStore().List()
+	for _, ns := range nslist {
+		namespace, ok := ns.(*corev1.Namespace)
+		if !ok {
+			log.Error("Error occurred when casting namespace into string")
+			continue
+		}
+		domainName := c.util.GetNamespaceDomain(namespace)
+		if !c.util.IsNamespaceSynced(namespace) {
+			// the CR of a namespace that stopped matching the namespace filter is removed by the sync
+			if _, exists, _ := c.cr.GetCRByName(domainName); !exists {
+				log.Infof("Skip processing excluded namespace: %s", namespace.ObjectMeta.Name)
+				continue
 			}
 		}
+		c.queue.AddWithPriority(domainName, priorityqueue.PriorityLow)
+	}
+	// handle admin domain and system namespaces
+	c.AddAdminSystemDomains()
+	// handle trust domains
+	// ListIndexFuncValues returns the list of keys of a particular index
+	// it returns all the trust domains even if they're not used anymore
+	trustdomains := c.cr.CrIndexInformer.GetIndexer().ListIndexFuncValues(trustDomainIndexKey)
+	for _, domain := range trustdomains {
+		// if the trust domain exist in informer store then we add to the queue
+		_, exist, err := c.cr.CrIndexInformer.GetStore().GetByKey(domain)
+		if err != nil {
+			log.Errorf("Error occurred when checking trust domains in informder store. %v", err)
+			continue
+		}
+		if exist {
+			c.queue.AddWithPriority(domain, priorityqueue.PriorityLow)
+		}
+	}
+	// handle the domains owning groups that are role members of other domains
+	for _, domain := range c.cr.CrIndexInformer.GetIndexer().ListIndexFuncValues(groupDomainIndexKey) {
+		if _, exist, _ := c.cr.CrIndexInformer.GetStore().GetByKey(domain); exist {
+			c.queue.AddWithPriority(domain, priorityqueue.PriorityLow)
+		}
+	}
+}
+
+// CollectOrphans - garbage collector pass adding the AthenzDomain CRs whose domain is no longer mapped to
+// the queue, unless they are orphaned CRs the deletion policy keeps for now. The sync of the domain
+// marks or deletes the CR.
+func (c *Cron) CollectOrphans() {
+	now := time.Now()
+	for _, item := range c.cr.CrIndexInformer.GetStore().List() {
+		obj, ok := item.(*athenz_domain.AthenzDomain)
+		if !ok {
+			log.Error("Error occurred when casting AthenzDomain CR")
+			continue
+		}
+		if c.ValidateDomain(obj.Name) {
+			continue
+		}
+		if _, orphaned := cr.OrphanedAt(obj); orphaned && !c.cr.OrphanExpired(obj, now) {
+			continue
+		}
+		log.Infof("Collecting orphaned AthenzDomain CR %s", obj.Name)
+		c.queue.AddWithPriority(obj.Name, priorityqueue.PriorityLow)
 	}
 }
 
@@ -182,27 +350,40 @@ func (c *Cron) FullResync(stopCh <-chan struct{}) {
 func (c *Cron) AddAdminSystemDomains() {
 	adminDomain := c.util.GetAdminDomain()
 	if adminDomain != "" {
-		c.queue.AddRateLimited(adminDomain)
+		c.queue.AddWithPriority(adminDomain, priorityqueue.PriorityLow)
 	}
 	for _, domain := range c.util.GetSystemNSDomains() {
 		if domain != "" {
-			c.queue.AddRateLimited(domain)
+			c.queue.AddWithPriority(domain, priorityqueue.PriorityLow)
 		}
 	}
 }
 
-// ValidateDomain - validate if the domain is whether a namespace, admin domain, system domain or trust domain
+// ValidateDomain - validate if the domain is whether a namespace, admin domain, system domain, trust domain or group domain
 func (c *Cron) ValidateDomain(domain string) bool {
-	namespace := c.util.DomainToNamespace(domain)
-	_, exists, _ := c.nsInformer.GetIndexer().GetByKey(namespace)
-	if exists || c.util.IsAdminDomain(domain) || c.cr.IsTrustDomain(domain) {
+	if len(c.DomainNamespaces(domain)) > 0 || c.util.IsAdminDomain(domain) || c.cr.IsTrustDomain(domain) || c.cr.IsGroupDomain(domain) {
 		return true
 	}
 	return false
 }
 
-// UpdateAthenzContactTime - update the latest athenz contact timestamp in config map
+// DomainNamespaces - get the synced namespaces mapped to the domain by their name or their domain annotation
+func (c *Cron) DomainNamespaces(domain string) []string {
+	namespaces, err := c.util.GetDomainNamespaces(c.nsInformer.GetIndexer(), domain)
+	if err != nil {
+		log.Errorf("Error occurred when looking up the namespaces of domain %s. Error: %v", domain, err)
+		return nil
+	}
+	return namespaces
+}
+
+// UpdateAthenzContactTime - update the latest athenz contact timestamp in config map. Nothing is recorded
+// in dry run mode as the domains were not written, they are fetched again once dry run is turned off.
 func (c *Cron) UpdateAthenzContactTime(etag string) {
+	if c.cr != nil && c.cr.DryRun() {
+		log.Infof("Dry run: skipping update of the contact time config map with etag %s", etag)
+		return
+	}
 	configmap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: c.contactTimeCm.Name,
@@ -225,3 +406,45 @@ func (c *Cron) UpdateAthenzContactTime(etag string) {
 		}
 	}
 }
+
+// ResumeEtag - restore the etag recorded in the contact time config map. It returns false when no valid
+// etag is recorded or when it is older than the horizon, the update cron then falls back to the latest
+// modified time of the AthenzDomain CRs.
+func (c *Cron) ResumeEtag() (string, bool) {
+	etag, ok := c.recordedEtag()
+	if ok {
+		log.Infof("Resuming update cron from etag %s", etag)
+		return etag, true
+	}
+	etag = c.cr.GetLatestTimestamp()
+	log.Infof("Starting update cron from the latest modified time of the AthenzDomain CRs %q", etag)
+	return etag, false
+}
+
+// recordedEtag - etag recorded in the contact time config map, false when it is missing or invalid
+func (c *Cron) recordedEtag() (string, bool) {
+	configMap, err := c.k8sClient.CoreV1().ConfigMaps(c.contactTimeCm.Namespace).Get(context.TODO(), c.contactTimeCm.Name, metav1.GetOptions{})
+	if err != nil {
+		if !apiError.IsNotFound(err) {
+			log.Errorf("Error occurred during GET config map. Error: %v", err)
+		}
+		log.Infof("No etag recorded in config map %s/%s", c.contactTimeCm.Namespace, c.contactTimeCm.Name)
+		return "", false
+	}
+	etag := configMap.Data[c.contactTimeCm.Key]
+	timestamp, err := rdl.TimestampParse(strings.Trim(etag, "\""))
+	if err != nil {
+		log.Errorf("Invalid etag %q recorded in config map %s/%s. Error: %v", etag, c.contactTimeCm.Namespace, c.contactTimeCm.Name, err)
+		return "", false
+	}
+	now := time.Now()
+	if timestamp.Time.After(now.Add(maxEtagClockSkew)) {
+		log.Errorf("Etag %s recorded in config map %s/%s is in the future", etag, c.contactTimeCm.Namespace, c.contactTimeCm.Name)
+		return "", false
+	}
+	if c.contactTimeCm.Horizon > 0 && now.Sub(timestamp.Time) > c.contactTimeCm.Horizon {
+		log.Infof("Etag %s recorded in config map %s/%s is older than %s", etag, c.contactTimeCm.Namespace, c.contactTimeCm.Name, c.contactTimeCm.Horizon)
+		return "", false
+	}
+	return etag, true
+}
@@ -17,21 +17,20 @@ package cron
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
-	"net"
 	"net/http"
-	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/client/clientset/versioned/fake"
 	athenzInformer "github.com/AthenZ/k8s-athenz-syncer/pkg/client/informers/externalversions/athenz/v1"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/priorityqueue"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/ratelimiter"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/util"
+	fakezms "github.com/AthenZ/k8s-athenz-syncer/pkg/zmsclient/fake"
 	"github.com/ardielle/ardielle-go/rdl"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
@@ -47,17 +46,20 @@ func newCron() *Cron {
 	zmsClient := zms.NewClient("https://zms.athenz.com", &http.Transport{})
 	clientset := k8sfake.NewSimpleClientset()
 	rateLimiter := ratelimiter.NewRateLimiter(250 * time.Millisecond)
-	queue := workqueue.NewRateLimitingQueue(rateLimiter)
-	util := util.NewUtil("test.domain", []string{"kube-system"}, []string{"acceptance-test"}, false)
+	queue := priorityqueue.New(rateLimiter, priorityqueue.Config{DelayInterval: 250 * time.Millisecond})
 	athenzclientset := fake.NewSimpleClientset()
 	informer := athenzInformer.NewAthenzDomainInformer(athenzclientset, 0, cache.Indexers{
 		"trustDomain": cr.TrustDomainIndexFunc,
+		"groupDomain": cr.GroupDomainIndexFunc,
 	})
 	nsListWatcher := cache.NewListWatchFromClient(clientset.CoreV1().RESTClient(), "namespaces", corev1.NamespaceAll, fields.Everything())
-	nsIndexInformer := cache.NewSharedIndexInformer(nsListWatcher, &corev1.Namespace{}, time.Hour, cache.Indexers{})
+	nsIndexInformer := cache.NewSharedIndexInformer(nsListWatcher, &corev1.Namespace{}, time.Hour, cache.Indexers{
+		util.DomainIndexKey: util.DomainIndexFunc,
+	})
 	nsIndexInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
 		Name: "home-test",
 	}})
+	util := util.NewUtil("test.domain", []string{"kube-system"}, []string{"acceptance-test"}, false)
 	cr := cr.NewCRUtil(athenzclientset, informer)
 	cm := &AthenzContactTimeConfigMap{
 		Namespace: "kube-yahoo",
@@ -69,64 +71,83 @@ func newCron() *Cron {
 
 func TestRequestCall(t *testing.T) {
 	log.InitLogger("/tmp/log/test.log", "info")
-	newtime, err := time.Parse(time.RFC3339, "2019-07-05T21:53:45Z")
+	server := fakezms.NewServer()
+	defer server.Close()
+	server.AddDomain(&zms.DomainData{Name: zms.DomainName("home.test")})
+	c := newCron()
+	c.zmsClient = server.Client()
+	err := c.requestCall()
 	if err != nil {
-		t.Errorf("Failed to parse fake time. Error: %v", err)
-	}
-	domain := zms.DomainData{
-		Name: zms.DomainName("home.test"),
-		Modified: rdl.Timestamp{
-			Time: newtime,
-		},
+		t.Error("Failed to get signed domain", err)
 	}
-	d := zms.SignedDomain{
-		Domain: &domain,
+	if c.queue.Len() != 1 {
+		t.Error("Expected queue length is 1. Failed to add to queue.")
 	}
-	arr := make([]*zms.SignedDomain, 1)
-	arr[0] = &d
-	signedDomain := zms.SignedDomains{
-		Domains: arr,
+	if c.etag == "2019-07-01T21:53:45Z" {
+		t.Errorf("Failed to update to new etag after update cron runs. Current etag: %s", c.etag)
 	}
-	js, err := json.Marshal(&signedDomain)
-	if err != nil {
-		t.Errorf("Failed to marshal signedDomain into json. Error: %v", err)
+	if recorded := getRecordedEtag(t, c); recorded != "2019-07-01T21:53:45Z" {
+		t.Errorf("Expected the previous etag to be recorded while the domains are queued, got %s", recorded)
 	}
-	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Etag", "2019-07-05T21:53:45Z")
-		w.Write(js)
-	})
-	httpClient, teardown := testingHTTPClient(h)
-	defer teardown()
-	c := newCron()
-	c.zmsClient.Transport = httpClient.Transport
+
+	// nothing was modified since the etag, zms responds with 304
+	etag := c.etag
+	item, _ := c.queue.Get()
+	c.queue.Done(item)
 	err = c.requestCall()
 	if err != nil {
-		t.Error("Failed to get signed domain", err)
+		t.Error("Failed to get modified domains", err)
 	}
-	if c.queue.Len() != 1 {
-		t.Error("Expected queue length is 1. Failed to add to queue.")
+	if c.queue.Len() != 0 {
+		t.Error("Expected queue length is 0 when no domain was modified.")
 	}
-	if c.etag != "2019-07-05T21:53:45Z" {
-		t.Errorf("Failed to update to new etag after update cron runs. Current etag: %s", c.etag)
+	if c.etag == etag {
+		t.Error("Failed to update to new etag after a not modified response")
+	}
+	if recorded := getRecordedEtag(t, c); recorded != "2019-07-01T21:53:45Z" {
+		t.Errorf("Expected the previous etag to be recorded until the queued domain is synced, got %s", recorded)
+	}
+	c.MarkSynced("home.test")
+	if recorded := getRecordedEtag(t, c); recorded != c.etag {
+		t.Errorf("Expected the new etag %s to be recorded once the queued domain is synced, got %s", c.etag, recorded)
+	}
+
+	server.InjectFault(fakezms.Fault{Call: fakezms.CallModifiedDomains, Code: 503, Count: 1})
+	err = c.requestCall()
+	if err == nil {
+		t.Error("Expected an error when zms is unavailable")
 	}
 }
 
-// testingHTTPClient - helper function to mock http requests
-func testingHTTPClient(handler http.Handler) (*http.Client, func()) {
-	s := httptest.NewTLSServer(handler)
+// TestMarkSynced - test that the recorded etag only moves past the domains queued under an older etag once they are synced
+func TestMarkSynced(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	c := newCron()
+	c.trackPending([]string{"home.a"})
+	c.SetEtag("2019-07-01T21:54:45Z")
+	c.trackPending([]string{"home.b", "home.a"})
+	c.SetEtag("2019-07-01T21:55:45Z")
 
-	cli := &http.Client{
-		Transport: &http.Transport{
-			DialContext: func(_ context.Context, network, _ string) (net.Conn, error) {
-				return net.Dial(network, s.Listener.Addr().String())
-			},
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+	c.MarkSynced("home.b")
+	if _, err := c.k8sClient.CoreV1().ConfigMaps(c.contactTimeCm.Namespace).Get(context.TODO(), c.contactTimeCm.Name, metav1.GetOptions{}); err == nil {
+		t.Error("Expected no etag to be recorded while the oldest domain is not synced")
+	}
+	c.MarkSynced("home.a")
+	if recorded := getRecordedEtag(t, c); recorded != c.etag {
+		t.Errorf("Expected the latest etag %s to be recorded once all the domains are synced, got %s", c.etag, recorded)
 	}
 
-	return cli, s.Close
+	c.trackPending([]string{"home.c"})
+	c.SetEtag("2019-07-01T21:56:45Z")
+	c.trackPending([]string{"home.d"})
+	c.MarkSynced("home.c")
+	if recorded := getRecordedEtag(t, c); recorded != "2019-07-01T21:56:45Z" {
+		t.Errorf("Expected the etag of the oldest pending domain to be recorded, got %s", recorded)
+	}
+	c.MarkSynced("home.unknown")
+	if len(c.pending) != 1 {
+		t.Errorf("Expected only home.d to be pending, got %v", c.pending)
+	}
 }
 
 // TestAddAdminSystemDomains - add admin domains
@@ -158,6 +179,27 @@ func TestValidateDomain(t *testing.T) {
 	if !res2 {
 		t.Error("test.domain.kube-system is a valid domain")
 	}
+	if c.ValidateDomain("other.domain") {
+		t.Error("other.domain is not a valid domain")
+	}
+	c.cr.CrIndexInformer.GetIndexer().Add(&athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test.domain",
+		},
+		Spec: athenz_domain.AthenzDomainSpec{
+			SignedDomain: zms.SignedDomain{
+				Domain: &zms.DomainData{
+					Name: "test.domain",
+					Roles: []*zms.Role{
+						{RoleMembers: []*zms.RoleMember{{MemberName: "other.domain:group.devs"}}},
+					},
+				},
+			},
+		},
+	})
+	if !c.ValidateDomain("other.domain") {
+		t.Error("other.domain owns a group member of test.domain and is a valid domain")
+	}
 }
 
 // UpdateAthenzContactTime - test for update athenz contact time in configmap
@@ -178,3 +220,164 @@ func TestUpdateAthenzContactTime(t *testing.T) {
 		t.Error("Failed to update the latest timestamp")
 	}
 }
+
+// getRecordedEtag - get the etag recorded in the contact time config map
+func getRecordedEtag(t *testing.T, c *Cron) string {
+	configMap, err := c.k8sClient.CoreV1().ConfigMaps(c.contactTimeCm.Namespace).Get(context.TODO(), c.contactTimeCm.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configMap.Data[c.contactTimeCm.Key]
+}
+
+// TestResumeEtag - test restoring the etag from the contact time config map and the fallback to the CRs
+func TestResumeEtag(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	recent := rdl.Timestamp{Time: time.Now().Add(-time.Hour)}.String()
+	tests := []struct {
+		name     string
+		recorded string
+		horizon  time.Duration
+		// modified time of an AthenzDomain CR in the store
+		modified string
+		expected string
+		resumed  bool
+	}{
+		{name: "no config map", expected: "", resumed: false},
+		{name: "no config map with CRs", modified: "2019-07-02T10:00:00Z", expected: "2019-07-02T10:00:00Z", resumed: false},
+		{name: "older than horizon with CRs", recorded: "2019-07-01T21:53:45.000Z", horizon: 24 * time.Hour, modified: "2019-07-02T10:00:00Z", expected: "2019-07-02T10:00:00Z", resumed: false},
+		{name: "recent etag", recorded: recent, horizon: 24 * time.Hour, expected: recent, resumed: true},
+		{name: "quoted etag", recorded: "\"" + recent + "\"", horizon: 24 * time.Hour, expected: "\"" + recent + "\"", resumed: true},
+		{name: "no horizon", recorded: "2019-07-01T21:53:45.000Z", expected: "2019-07-01T21:53:45.000Z", resumed: true},
+		{name: "older than horizon", recorded: "2019-07-01T21:53:45.000Z", horizon: 24 * time.Hour, expected: "", resumed: false},
+		{name: "invalid etag", recorded: "latest", horizon: 24 * time.Hour, expected: "", resumed: false},
+		{name: "etag in the future", recorded: rdl.Timestamp{Time: time.Now().Add(time.Hour)}.String(), expected: "", resumed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newCron()
+			c.contactTimeCm.Horizon = test.horizon
+			if test.modified != "" {
+				modified, err := rdl.TimestampParse(test.modified)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.cr.CrIndexInformer.GetStore().Add(&athenz_domain.AthenzDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "home.test"},
+					Spec: athenz_domain.AthenzDomainSpec{
+						SignedDomain: zms.SignedDomain{Domain: &zms.DomainData{Name: "home.test", Modified: modified}},
+					},
+				})
+			}
+			if test.recorded != "" {
+				c.UpdateAthenzContactTime(test.recorded)
+			}
+			etag, resumed := c.ResumeEtag()
+			if etag != test.expected || resumed != test.resumed {
+				t.Errorf("Expected etag %q and resumed %v, got %q and %v", test.expected, test.resumed, etag, resumed)
+			}
+		})
+	}
+}
+
+// TestResyncAll - test that all namespaces, admin and system domains are added to the queue
+func TestResyncAll(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	c := newCron()
+	c.nsInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "acceptance-test"}})
+	c.ResyncAll()
+	time.Sleep(time.Second)
+	// home.test namespace, test.domain admin domain and kube-system system domain
+	if c.queue.Len() != 3 {
+		t.Errorf("Expected queue length 3, got %d", c.queue.Len())
+	}
+}
+
+// TestResyncAllNamespaceFilter - test that namespaces not matching the namespace filter are only queued to remove their CR
+func TestResyncAllNamespaceFilter(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	c := newCron()
+	c.queue = priorityqueue.New(workqueue.NewItemExponentialFailureRateLimiter(0, 0), priorityqueue.Config{})
+	filter, err := util.NewNamespaceFilter("athenz.io/sync=true", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.util.SetNamespaceFilter(filter)
+	c.nsInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-prod", Labels: map[string]string{"athenz.io/sync": "true"}}})
+	c.nsInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-dev"}})
+	c.nsInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-stage"}})
+	c.cr.CrIndexInformer.GetStore().Add(&athenz_domain.AthenzDomain{ObjectMeta: metav1.ObjectMeta{Name: "team.stage"}})
+	c.ResyncAll()
+	time.Sleep(100 * time.Millisecond)
+
+	queued := map[string]bool{}
+	for c.queue.Len() > 0 {
+		item, _ := c.queue.Get()
+		queued[item.(string)] = true
+		c.queue.Done(item)
+	}
+	if !queued["team.prod"] || !queued["team.stage"] || queued["team.dev"] {
+		t.Errorf("Expected the opted in domain and the domain with a CR to remove to be queued, got %v", queued)
+	}
+	if c.ValidateDomain("team.stage") {
+		t.Error("Domain of a namespace not matching the namespace filter should not be valid")
+	}
+}
+
+// TestCollectOrphans - test that the CRs of domains no longer mapped are queued unless the deletion policy keeps them
+func TestCollectOrphans(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	c := newCron()
+	c.queue = priorityqueue.New(workqueue.NewItemExponentialFailureRateLimiter(0, 0), priorityqueue.Config{})
+	c.cr.SetDeletionPolicy(cr.DeletionDelayed, time.Hour)
+	orphanedAt := func(d time.Duration) map[string]string {
+		return map[string]string{cr.OrphanedAtAnnotation: time.Now().Add(-d).UTC().Format(time.RFC3339)}
+	}
+	store := c.cr.CrIndexInformer.GetStore()
+	store.Add(&athenz_domain.AthenzDomain{ObjectMeta: metav1.ObjectMeta{Name: "home.test"}})
+	store.Add(&athenz_domain.AthenzDomain{ObjectMeta: metav1.ObjectMeta{Name: "home.removed"}})
+	store.Add(&athenz_domain.AthenzDomain{ObjectMeta: metav1.ObjectMeta{Name: "home.recent", Annotations: orphanedAt(time.Minute)}})
+	store.Add(&athenz_domain.AthenzDomain{ObjectMeta: metav1.ObjectMeta{Name: "home.expired", Annotations: orphanedAt(2 * time.Hour)}})
+	c.CollectOrphans()
+	time.Sleep(100 * time.Millisecond)
+
+	queued := map[string]bool{}
+	for c.queue.Len() > 0 {
+		item, _ := c.queue.Get()
+		queued[item.(string)] = true
+		c.queue.Done(item)
+	}
+	if !queued["home.removed"] || !queued["home.expired"] || len(queued) != 2 {
+		t.Errorf("Expected the unmarked and the expired orphans to be queued, got %v", queued)
+	}
+}
+
+// TestSetIntervals - test that changing an interval restarts the sleep of its cron
+func TestSetIntervals(t *testing.T) {
+	c := newCron()
+	c.SetIntervals(20*time.Second, 2*time.Minute)
+	select {
+	case <-c.checkReset:
+		t.Error("Update cron should not be reset when its interval is unchanged")
+	default:
+	}
+	select {
+	case <-c.syncReset:
+	default:
+		t.Error("Full resync cron should be reset when its interval changes")
+	}
+	if check, sync := c.getIntervals(); check != 20*time.Second || sync != 2*time.Minute {
+		t.Errorf("Expected intervals 20s and 2m, got %s and %s", check, sync)
+	}
+
+	log.InitLogger("/tmp/log/test.log", "info")
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	c.nsInformer.GetStore().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "home-other"}})
+	go c.FullResync(stopCh)
+	c.SetIntervals(20*time.Second, 10*time.Millisecond)
+	time.Sleep(time.Second)
+	if c.queue.Len() == 0 {
+		t.Error("Full resync should run with the new interval without waiting for the previous one")
+	}
+}
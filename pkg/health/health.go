@@ -0,0 +1,182 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+)
+
+// loops reporting heartbeats
+const (
+	LoopUpdateCron = "update_cron"
+)
+
+var (
+	lock sync.RWMutex
+	// readiness requires a successful ZMS call within zmsWindow
+	zmsWindow = 5 * time.Minute
+	// liveness fails when a loop or an item is stuck for longer than stallTimeout
+	stallTimeout    = 10 * time.Minute
+	informersSynced bool
+	leading         bool
+	lastZMSSuccess  time.Time
+	// deadline of the next heartbeat for each loop
+	loopDeadlines = map[string]time.Time{}
+	// start time of each item currently processed by the workers
+	itemsInFlight = map[string]time.Time{}
+)
+
+// Configure - set the readiness ZMS window and the liveness stall timeout
+func Configure(window, stall time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+	zmsWindow = window
+	stallTimeout = stall
+}
+
+// SetInformersSynced - record whether the informer caches have synced
+func SetInformersSynced(synced bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	informersSynced = synced
+}
+
+// SetLeading - record whether this replica runs the workers and crons. Standby replicas make no ZMS
+// calls and run no loops, so only the informers are checked for them.
+func SetLeading(isLeading bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	leading = isLeading
+	// loops start beating again once leading, stale deadlines of a previous term must not count
+	loopDeadlines = map[string]time.Time{}
+}
+
+// RecordZMSSuccess - record a successful ZMS call
+func RecordZMSSuccess() {
+	lock.Lock()
+	defer lock.Unlock()
+	lastZMSSuccess = time.Now()
+}
+
+// Beat - record a heartbeat of a loop that beats at least once every period
+func Beat(loop string, period time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+	loopDeadlines[loop] = time.Now().Add(period + stallTimeout)
+}
+
+// StartItem - record that a worker started processing the item
+func StartItem(key string) {
+	lock.Lock()
+	defer lock.Unlock()
+	itemsInFlight[key] = time.Now()
+}
+
+// FinishItem - record that a worker finished processing the item
+func FinishItem(key string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(itemsInFlight, key)
+}
+
+// Ready - check that the informers synced and, when leading, that ZMS was reached recently
+func Ready() error {
+	lock.RLock()
+	defer lock.RUnlock()
+	if !informersSynced {
+		return fmt.Errorf("informer caches have not synced")
+	}
+	if !leading {
+		return nil
+	}
+	if lastZMSSuccess.IsZero() {
+		return fmt.Errorf("no successful ZMS call yet")
+	}
+	if since := time.Since(lastZMSSuccess); since > zmsWindow {
+		return fmt.Errorf("last successful ZMS call was %s ago, longer than %s", since.Round(time.Second), zmsWindow)
+	}
+	return nil
+}
+
+// Alive - check that no loop missed its heartbeat and no worker is stuck on an item
+func Alive() error {
+	lock.RLock()
+	defer lock.RUnlock()
+	if !leading {
+		return nil
+	}
+	now := time.Now()
+	loops := make([]string, 0, len(loopDeadlines))
+	for loop := range loopDeadlines {
+		loops = append(loops, loop)
+	}
+	sort.Strings(loops)
+	for _, loop := range loops {
+		if now.After(loopDeadlines[loop]) {
+			return fmt.Errorf("%s missed its heartbeat, last expected by %s", loop, loopDeadlines[loop].Format(time.RFC3339))
+		}
+	}
+	for key, start := range itemsInFlight {
+		if since := now.Sub(start); since > stallTimeout {
+			return fmt.Errorf("worker has been processing %s for %s", key, since.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// Handler returns the http handler serving the /healthz and /readyz endpoints
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", check(Alive))
+	mux.HandleFunc("/readyz", check(Ready))
+	return mux
+}
+
+// check - respond 200 when the check passes and 503 with the reason otherwise
+func check(fn func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := fn(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
+
+// Serve starts the health http server on the given address and shuts it down when stopCh is closed
+func Serve(addr string, stopCh <-chan struct{}) {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: Handler(),
+	}
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	log.Infof("Starting health server on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Health server stopped unexpectedly. Error: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// reset - restore the initial state between tests
+func reset() {
+	lock.Lock()
+	defer lock.Unlock()
+	zmsWindow = 5 * time.Minute
+	stallTimeout = 10 * time.Minute
+	informersSynced = false
+	leading = false
+	lastZMSSuccess = time.Time{}
+	loopDeadlines = map[string]time.Time{}
+	itemsInFlight = map[string]time.Time{}
+}
+
+func TestReady(t *testing.T) {
+	reset()
+	if Ready() == nil {
+		t.Error("Should not be ready before the informers synced")
+	}
+	SetInformersSynced(true)
+	if err := Ready(); err != nil {
+		t.Errorf("Standby replica should be ready once the informers synced. Error: %v", err)
+	}
+	SetLeading(true)
+	if Ready() == nil {
+		t.Error("Leader should not be ready before a successful ZMS call")
+	}
+	RecordZMSSuccess()
+	if err := Ready(); err != nil {
+		t.Errorf("Leader should be ready after a successful ZMS call. Error: %v", err)
+	}
+	Configure(time.Millisecond, 10*time.Minute)
+	time.Sleep(5 * time.Millisecond)
+	if Ready() == nil {
+		t.Error("Leader should not be ready when the last successful ZMS call is outside of the window")
+	}
+}
+
+func TestAlive(t *testing.T) {
+	reset()
+	Configure(5*time.Minute, 20*time.Millisecond)
+	Beat(LoopUpdateCron, 0)
+	StartItem("home.domain")
+	time.Sleep(30 * time.Millisecond)
+	if err := Alive(); err != nil {
+		t.Errorf("Standby replica should always be alive. Error: %v", err)
+	}
+
+	SetLeading(true)
+	Beat(LoopUpdateCron, time.Minute)
+	if err := Alive(); err == nil {
+		t.Error("Worker stuck on an item should fail liveness")
+	}
+	FinishItem("home.domain")
+	if err := Alive(); err != nil {
+		t.Errorf("Should be alive once the item is done. Error: %v", err)
+	}
+
+	Beat(LoopUpdateCron, 0)
+	time.Sleep(30 * time.Millisecond)
+	if err := Alive(); err == nil {
+		t.Error("Loop that missed its heartbeat should fail liveness")
+	}
+	SetLeading(true)
+	if err := Alive(); err != nil {
+		t.Errorf("Heartbeats of a previous leader term should be dropped. Error: %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reset()
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{path: "/healthz", code: http.StatusOK},
+		{path: "/readyz", code: http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		resp, err := server.Client().Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("Expected status %d for %s, got %d", test.code, test.path, resp.StatusCode)
+		}
+	}
+}
@@ -16,10 +16,10 @@ import (
 	"sync"
 	"time"
 
-	"github.com/AthenZ/athenz/clients/go/zms"
 	"github.com/AthenZ/athenz/libs/go/zmssvctoken"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/crypto"
 	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/zmsclient"
 	"github.com/pkg/errors"
 )
 
@@ -41,7 +41,7 @@ type TokenProvider struct {
 
 // Config is the token provider configuration.
 type Config struct {
-	Client             *zms.ZMSClient
+	Client             zmsclient.Client
 	Header             string
 	Domain             string             // Athenz domain
 	Service            string             // Athenz service
@@ -0,0 +1,383 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package istio
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/util"
+	apiError "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// DefaultTrustDomain - SPIFFE trust domain of the mesh workload identities
+	DefaultTrustDomain = "cluster.local"
+	// DomainLabel - label with the Athenz domain of the source policies
+	DomainLabel = "athenz.io/domain"
+	// ServiceLabel - label with the Athenz service the AuthorizationPolicy applies to
+	ServiceLabel = "athenz.io/service"
+	// WorkloadLabel - workload label matched by the AuthorizationPolicy selector
+	WorkloadLabel = "app"
+
+	namePrefix = "athenz-"
+	userDomain = "user."
+)
+
+// AuthorizationPolicyResource - Istio AuthorizationPolicy resource
+var AuthorizationPolicyResource = schema.GroupVersionResource{
+	Group:    "security.istio.io",
+	Version:  "v1beta1",
+	Resource: "authorizationpolicies",
+}
+
+// actionMethods - HTTP methods matched by the Athenz actions of service assertions, the HTTP methods
+// themselves and the usual read and write actions. The * action matches all methods.
+var actionMethods = map[string][]interface{}{
+	"get":     {"GET"},
+	"head":    {"HEAD"},
+	"post":    {"POST"},
+	"put":     {"PUT"},
+	"patch":   {"PATCH"},
+	"delete":  {"DELETE"},
+	"options": {"OPTIONS"},
+	"read":    {"GET", "HEAD"},
+	"create":  {"POST"},
+	"update":  {"PUT", "PATCH"},
+	"write":   {"POST", "PUT", "PATCH", "DELETE"},
+}
+
+// serviceRegex - service resources of the form <service>[/<path>] following the domain:: prefix
+var serviceRegex = regexp.MustCompile(`^(?P<service>[a-z0-9*][a-z0-9*-]*)(?P<path>/.*)?$`)
+
+// Change - create, update or delete of an AuthorizationPolicy planned by the reconciler
+type Change struct {
+	Verb      string
+	Namespace string
+	Name      string
+}
+
+// String - readable form of the change for logs
+func (c Change) String() string {
+	return fmt.Sprintf("%s AuthorizationPolicy %s/%s", c.Verb, c.Namespace, c.Name)
+}
+
+// Reconciler - converts the assertions on service resources of the domain into Istio AuthorizationPolicy
+// objects in the namespaces mapped to the domain. An assertion on resource <domain>::<service>[/<path>]
+// becomes a rule of the ALLOW or DENY policy selecting the workloads labeled app=<service>, with the
+// HTTP methods of the assertion action and the SPIFFE principals of the role members as sources. Generated
+// objects are owned by the AthenzDomain CR, and generated objects no longer derived from it are deleted.
+// In dry run mode the changes are only logged.
+type Reconciler struct {
+	dynamicClient dynamic.Interface
+	util          *util.Util
+	namespaces    NamespaceLookup
+	trustDomain   string
+	dryRun        bool
+}
+
+// NamespaceLookup - get the namespaces mapped to the domain, by their name or their domain annotation
+type NamespaceLookup func(domain string) []string
+
+// NewReconciler - create a reconciler writing AuthorizationPolicy objects through the dynamic client. The
+// namespaces of the principals are resolved with the lookup, the namespace named after the domain is used
+// for domains without namespace.
+func NewReconciler(dynamicClient dynamic.Interface, util *util.Util, namespaces NamespaceLookup, trustDomain string, dryRun bool) *Reconciler {
+	return &Reconciler{
+		dynamicClient: dynamicClient,
+		util:          util,
+		namespaces:    namespaces,
+		trustDomain:   trustDomain,
+		dryRun:        dryRun,
+	}
+}
+
+// Reconcile - apply the AuthorizationPolicy objects derived from the AthenzDomain CR in the namespaces
+func (r *Reconciler) Reconcile(ctx context.Context, obj *athenz_domain.AthenzDomain, namespaces []string) error {
+	if obj == nil {
+		return nil
+	}
+	_, err := r.reconcile(ctx, obj, namespaces)
+	return err
+}
+
+// reconcile - apply the AuthorizationPolicy objects and return the changes made, or planned in dry run mode
+func (r *Reconciler) reconcile(ctx context.Context, obj *athenz_domain.AthenzDomain, namespaces []string) ([]Change, error) {
+	signedDomain, err := cr.SignedDomain(obj)
+	if err != nil {
+		return nil, err
+	}
+	desired := r.Generate(signedDomain.Domain, time.Now())
+	owner := cr.OwnerReference(obj)
+	changes := []Change{}
+	errs := []error{}
+	for _, namespace := range namespaces {
+		client := r.dynamicClient.Resource(AuthorizationPolicyResource).Namespace(namespace)
+		list, err := client.List(ctx, managedSelector(obj.Name))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Unable to list AuthorizationPolicies in namespace %s. Error: %v", namespace, err))
+			continue
+		}
+		existing := map[string]*unstructured.Unstructured{}
+		for i := range list.Items {
+			if generatedFrom(&list.Items[i], obj.Name) {
+				existing[list.Items[i].GetName()] = &list.Items[i]
+			}
+		}
+		for _, policy := range desired {
+			policy = policy.DeepCopy()
+			policy.SetNamespace(namespace)
+			policy.SetOwnerReferences([]metav1.OwnerReference{owner})
+			current, ok := existing[policy.GetName()]
+			delete(existing, policy.GetName())
+			if !ok {
+				changes = append(changes, r.apply(Change{"create", namespace, policy.GetName()}, &errs, func() error {
+					_, err := client.Create(ctx, policy, metav1.CreateOptions{})
+					return err
+				}))
+				continue
+			}
+			if reflect.DeepEqual(current.Object["spec"], policy.Object["spec"]) &&
+				reflect.DeepEqual(current.GetLabels(), policy.GetLabels()) &&
+				reflect.DeepEqual(current.GetOwnerReferences(), policy.GetOwnerReferences()) {
+				continue
+			}
+			policy.SetResourceVersion(current.GetResourceVersion())
+			changes = append(changes, r.apply(Change{"update", namespace, policy.GetName()}, &errs, func() error {
+				_, err := client.Update(ctx, policy, metav1.UpdateOptions{})
+				return err
+			}))
+		}
+		names := []string{}
+		for name := range existing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			name := name
+			changes = append(changes, r.apply(Change{"delete", namespace, name}, &errs, func() error {
+				err := client.Delete(ctx, name, metav1.DeleteOptions{})
+				if apiError.IsNotFound(err) {
+					return nil
+				}
+				return err
+			}))
+		}
+	}
+	return changes, utilerrors.NewAggregate(errs)
+}
+
+// managedSelector - list options selecting the objects generated from the domain. Domains that are not valid
+// label values are not labeled on the objects and are left to generatedFrom.
+func managedSelector(domain string) metav1.ListOptions {
+	selector := cr.ManagedByLabel + "=" + cr.ManagedByValue
+	if len(validation.IsValidLabelValue(domain)) == 0 {
+		selector += "," + DomainLabel + "=" + domain
+	}
+	return metav1.ListOptions{LabelSelector: selector}
+}
+
+// generatedFrom - check if the generated object was derived from the domain, by its domain label or else by
+// its owner, so that the objects of the other domains mapped to the namespace are never deleted
+func generatedFrom(obj *unstructured.Unstructured, domain string) bool {
+	if value, ok := obj.GetLabels()[DomainLabel]; ok {
+		return value == domain
+	}
+	for _, owner := range obj.GetOwnerReferences() {
+		if owner.Kind == "AthenzDomain" && owner.Name == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// apply - log the change and make it with write unless in dry run mode, errors are collected into errs
+func (r *Reconciler) apply(change Change, errs *[]error, write func() error) Change {
+	if r.dryRun {
+		log.Infof("Dry run: would %s", change)
+		return change
+	}
+	if err := write(); err != nil {
+		*errs = append(*errs, fmt.Errorf("Unable to %s. Error: %v", change, err))
+		return change
+	}
+	log.Infof("Applied %s", change)
+	return change
+}
+
+// Generate - derive the AuthorizationPolicy objects from the assertions on service resources of the domain,
+// one per service and effect. The objects are returned without namespace and owner.
+func (r *Reconciler) Generate(domainData *zms.DomainData, now time.Time) []*unstructured.Unstructured {
+	if domainData == nil || domainData.Policies == nil || domainData.Policies.Contents == nil {
+		return nil
+	}
+	domain := string(domainData.Name)
+	prefix := domain + "::"
+	roles := map[string]*zms.Role{}
+	for _, role := range domainData.Roles {
+		if role != nil {
+			roles[string(role.Name)] = role
+		}
+	}
+
+	// rules keyed by service and effect, in the order of the assertions
+	rules := map[string][]interface{}{}
+	for _, policy := range domainData.Policies.Contents.Policies {
+		if policy == nil || (policy.Active != nil && !*policy.Active) {
+			continue
+		}
+		for _, assertion := range policy.Assertions {
+			if assertion == nil || !strings.HasPrefix(assertion.Resource, prefix) {
+				continue
+			}
+			match := serviceRegex.FindStringSubmatch(strings.TrimPrefix(assertion.Resource, prefix))
+			if match == nil {
+				continue
+			}
+			principals := r.principals(roles[assertion.Role], now)
+			// a rule without sources would match every request
+			if len(principals) == 0 {
+				continue
+			}
+			effect := "ALLOW"
+			if assertion.Effect != nil && *assertion.Effect == zms.DENY {
+				effect = "DENY"
+			}
+			methods, ok := actionMethods[strings.ToLower(assertion.Action)]
+			if !ok && assertion.Action != "*" {
+				// fail closed: an ALLOW is not generated and a DENY applies to all methods
+				if effect == "ALLOW" {
+					log.Warnf("Skipping ALLOW assertion on %s, action %q is not an HTTP method", assertion.Resource, assertion.Action)
+					continue
+				}
+				log.Warnf("Denying all methods for DENY assertion on %s, action %q is not an HTTP method", assertion.Resource, assertion.Action)
+			}
+			key := match[1] + "/" + effect
+			rules[key] = append(rules[key], rule(principals, methods, match[2]))
+		}
+	}
+
+	keys := []string{}
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	policies := []*unstructured.Unstructured{}
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 2)
+		service, effect := parts[0], parts[1]
+		spec := map[string]interface{}{
+			"action": effect,
+			"rules":  rules[key],
+		}
+		name := namePrefix + strings.ToLower(effect)
+		if service != "*" {
+			name = namePrefix + service + "-" + strings.ToLower(effect)
+			spec["selector"] = map[string]interface{}{
+				"matchLabels": map[string]interface{}{WorkloadLabel: service},
+			}
+		}
+		policy := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": AuthorizationPolicyResource.GroupVersion().String(),
+			"kind":       "AuthorizationPolicy",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"spec": spec,
+		}}
+		policy.SetLabels(objectLabels(domain, service))
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// rule - AuthorizationPolicy rule matching the principals on the methods and path of the assertion, all
+// methods are matched when there are none
+func rule(principals []interface{}, methods []interface{}, path string) interface{} {
+	operation := map[string]interface{}{}
+	if len(methods) > 0 {
+		operation["methods"] = methods
+	}
+	if path != "" {
+		operation["paths"] = []interface{}{path}
+	}
+	rule := map[string]interface{}{
+		"from": []interface{}{
+			map[string]interface{}{"source": map[string]interface{}{"principals": principals}},
+		},
+	}
+	if len(operation) > 0 {
+		rule["to"] = []interface{}{map[string]interface{}{"operation": operation}}
+	}
+	return rule
+}
+
+// principals - SPIFFE principals of the service members of the role, <trust-domain>/ns/<namespace>/sa/<service>.
+// Users and groups are not mesh workloads and are skipped, a wildcard member matches all services of its domain.
+func (r *Reconciler) principals(role *zms.Role, now time.Time) []interface{} {
+	principals := []interface{}{}
+	for _, member := range cr.RoleMembers(role, now) {
+		i := strings.LastIndex(member, ".")
+		if strings.HasPrefix(member, userDomain) || strings.Contains(member, ":") || i <= 0 {
+			continue
+		}
+		domain, service := member[:i], member[i+1:]
+		if strings.Contains(domain, "*") || (service != "*" && strings.Contains(service, "*")) {
+			continue
+		}
+		for _, namespace := range r.domainNamespaces(domain) {
+			principals = append(principals, fmt.Sprintf("%s/ns/%s/sa/%s", r.trustDomain, namespace, service))
+		}
+	}
+	return principals
+}
+
+// domainNamespaces - namespaces of the service accounts of the domain, the namespace named after the domain
+// when no namespace is mapped to it
+func (r *Reconciler) domainNamespaces(domain string) []string {
+	if r.namespaces != nil {
+		if namespaces := r.namespaces(domain); len(namespaces) > 0 {
+			return namespaces
+		}
+	}
+	return []string{r.util.DomainToNamespace(domain)}
+}
+
+// objectLabels - labels of a generated object, values that are not valid label values are left out
+func objectLabels(domain, service string) map[string]string {
+	labels := map[string]string{cr.ManagedByLabel: cr.ManagedByValue}
+	for key, value := range map[string]string{DomainLabel: domain, ServiceLabel: service} {
+		if len(validation.IsValidLabelValue(value)) == 0 {
+			labels[key] = value
+		}
+	}
+	return labels
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package istio
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/util"
+	"github.com/ardielle/ardielle-go/rdl"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+const domainName = "home.domain"
+
+func init() {
+	log.InitLogger("/tmp/log/test.log", "info")
+}
+
+// getDomainData - domain allowing the frontend to read the api service and denying the batch jobs
+func getDomainData(now time.Time) *zms.DomainData {
+	allow := zms.ALLOW
+	deny := zms.DENY
+	expired := rdl.Timestamp{Time: now.Add(-time.Hour)}
+	return &zms.DomainData{
+		Name: domainName,
+		Roles: []*zms.Role{
+			{
+				Name: domainName + ":role.readers",
+				RoleMembers: []*zms.RoleMember{
+					{MemberName: "sports.frontend.web"},
+					{MemberName: "user.jane"},
+					{MemberName: "home.domain.expired", Expiration: &expired},
+				},
+			},
+			{
+				Name:    domainName + ":role.batch",
+				Members: []zms.MemberName{"sports.batch.*"},
+			},
+			{
+				Name:    domainName + ":role.users",
+				Members: []zms.MemberName{"user.joe"},
+			},
+		},
+		Policies: &zms.SignedPolicies{
+			Contents: &zms.DomainPolicies{
+				Domain: domainName,
+				Policies: []*zms.Policy{
+					{
+						Name: domainName + ":policy.api",
+						Assertions: []*zms.Assertion{
+							{Role: domainName + ":role.readers", Resource: domainName + "::api/v1/*", Action: "get", Effect: &allow},
+							{Role: domainName + ":role.batch", Resource: domainName + "::api", Action: "*", Effect: &deny},
+							// users are not mesh workloads
+							{Role: domainName + ":role.users", Resource: domainName + "::api", Action: "*", Effect: &allow},
+							// not a service resource
+							{Role: domainName + ":role.readers", Resource: domainName + ":get:pods", Action: "*", Effect: &allow},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newReconciler(dryRun bool, objects ...runtime.Object) (*Reconciler, *dynamicfake.FakeDynamicClient) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		AuthorizationPolicyResource: "AuthorizationPolicyList",
+	}, objects...)
+	u := util.NewUtil("admin.domain", []string{"kube-system"}, []string{}, false)
+	return NewReconciler(client, u, nil, DefaultTrustDomain, dryRun), client
+}
+
+func TestGenerate(t *testing.T) {
+	now := time.Now()
+	r, _ := newReconciler(false)
+	policies := r.Generate(getDomainData(now), now)
+	if len(policies) != 2 {
+		t.Fatalf("Expected an ALLOW and a DENY AuthorizationPolicy for the api service, got %d", len(policies))
+	}
+
+	allow := policies[0]
+	if allow.GetName() != "athenz-api-allow" {
+		t.Errorf("Expected AuthorizationPolicy named after the service, got %s", allow.GetName())
+	}
+	expectedLabels := map[string]string{cr.ManagedByLabel: cr.ManagedByValue, DomainLabel: domainName, ServiceLabel: "api"}
+	if !reflect.DeepEqual(allow.GetLabels(), expectedLabels) {
+		t.Errorf("Expected labels %v, got %v", expectedLabels, allow.GetLabels())
+	}
+	expectedSpec := map[string]interface{}{
+		"action":   "ALLOW",
+		"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "api"}},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"from": []interface{}{map[string]interface{}{"source": map[string]interface{}{
+					"principals": []interface{}{"cluster.local/ns/sports-frontend/sa/web"},
+				}}},
+				"to": []interface{}{map[string]interface{}{"operation": map[string]interface{}{
+					"methods": []interface{}{"GET"},
+					"paths":   []interface{}{"/v1/*"},
+				}}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(allow.Object["spec"], expectedSpec) {
+		t.Errorf("Expected spec %v, got %v", expectedSpec, allow.Object["spec"])
+	}
+
+	deny := policies[1]
+	expectedSpec = map[string]interface{}{
+		"action":   "DENY",
+		"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "api"}},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"from": []interface{}{map[string]interface{}{"source": map[string]interface{}{
+					"principals": []interface{}{"cluster.local/ns/sports-batch/sa/*"},
+				}}},
+			},
+		},
+	}
+	if deny.GetName() != "athenz-api-deny" || !reflect.DeepEqual(deny.Object["spec"], expectedSpec) {
+		t.Errorf("Expected DENY policy with spec %v, got %s with %v", expectedSpec, deny.GetName(), deny.Object["spec"])
+	}
+}
+
+// TestGenerateActions - test that actions are matched as HTTP methods and that unknown actions fail closed
+func TestGenerateActions(t *testing.T) {
+	now := time.Now()
+	r, _ := newReconciler(false)
+	data := getDomainData(now)
+	allow := zms.ALLOW
+	deny := zms.DENY
+	data.Policies.Contents.Policies[0].Assertions = []*zms.Assertion{
+		{Role: domainName + ":role.readers", Resource: domainName + "::api", Action: "read", Effect: &allow},
+		{Role: domainName + ":role.readers", Resource: domainName + "::api", Action: "assume", Effect: &allow},
+		{Role: domainName + ":role.batch", Resource: domainName + "::api", Action: "Update", Effect: &deny},
+		{Role: domainName + ":role.batch", Resource: domainName + "::api", Action: "assume", Effect: &deny},
+	}
+	policies := r.Generate(data, now)
+	if len(policies) != 2 {
+		t.Fatalf("Expected an ALLOW and a DENY AuthorizationPolicy, got %d", len(policies))
+	}
+	methods := func(rule interface{}) interface{} {
+		to, ok := rule.(map[string]interface{})["to"]
+		if !ok {
+			return nil
+		}
+		return to.([]interface{})[0].(map[string]interface{})["operation"].(map[string]interface{})["methods"]
+	}
+	allowRules := policies[0].Object["spec"].(map[string]interface{})["rules"].([]interface{})
+	if len(allowRules) != 1 || !reflect.DeepEqual(methods(allowRules[0]), []interface{}{"GET", "HEAD"}) {
+		t.Errorf("Expected only the read assertion to be allowed on GET and HEAD, got %v", allowRules)
+	}
+	denyRules := policies[1].Object["spec"].(map[string]interface{})["rules"].([]interface{})
+	if len(denyRules) != 2 || !reflect.DeepEqual(methods(denyRules[0]), []interface{}{"PUT", "PATCH"}) || methods(denyRules[1]) != nil {
+		t.Errorf("Expected the update assertion to deny PUT and PATCH and the unknown action all methods, got %v", denyRules)
+	}
+}
+
+// TestPrincipalNamespaces - test that the principals use the namespaces mapped to the domain of the members
+func TestPrincipalNamespaces(t *testing.T) {
+	now := time.Now()
+	r, _ := newReconciler(false)
+	r.namespaces = func(domain string) []string {
+		if domain == "sports.frontend" {
+			return []string{"web-frontend"}
+		}
+		return nil
+	}
+	policies := r.Generate(getDomainData(now), now)
+	if len(policies) != 2 {
+		t.Fatalf("Expected an ALLOW and a DENY AuthorizationPolicy, got %d", len(policies))
+	}
+	principals := func(policy *unstructured.Unstructured) interface{} {
+		rule := policy.Object["spec"].(map[string]interface{})["rules"].([]interface{})[0].(map[string]interface{})
+		return rule["from"].([]interface{})[0].(map[string]interface{})["source"].(map[string]interface{})["principals"]
+	}
+	if p := principals(policies[0]); !reflect.DeepEqual(p, []interface{}{"cluster.local/ns/web-frontend/sa/web"}) {
+		t.Errorf("Expected the principal in the annotated namespace of the domain, got %v", p)
+	}
+	if p := principals(policies[1]); !reflect.DeepEqual(p, []interface{}{"cluster.local/ns/sports-batch/sa/*"}) {
+		t.Errorf("Expected the principal in the namespace named after the unmapped domain, got %v", p)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	stale := &unstructured.Unstructured{}
+	stale.SetGroupVersionKind(AuthorizationPolicyResource.GroupVersion().WithKind("AuthorizationPolicy"))
+	stale.SetName("athenz-removed-allow")
+	stale.SetNamespace("home-domain")
+	stale.SetLabels(map[string]string{cr.ManagedByLabel: cr.ManagedByValue, DomainLabel: domainName})
+	// generated from another domain mapped to the namespace
+	other := stale.DeepCopy()
+	other.SetName("athenz-other-allow")
+	other.SetLabels(map[string]string{cr.ManagedByLabel: cr.ManagedByValue, DomainLabel: "other.domain"})
+	r, client := newReconciler(false, stale, other)
+	obj := &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: domainName, UID: "uid"},
+		Spec: athenz_domain.AthenzDomainSpec{
+			SignedDomain: zms.SignedDomain{Domain: getDomainData(now)},
+		},
+	}
+
+	changes, err := r.reconcile(context.TODO(), obj, []string{"home-domain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{"create", "home-domain", "athenz-api-allow"},
+		{"create", "home-domain", "athenz-api-deny"},
+		{"delete", "home-domain", "athenz-removed-allow"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+	policy, err := client.Resource(AuthorizationPolicyResource).Namespace("home-domain").Get(context.TODO(), "athenz-api-allow", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owners := policy.GetOwnerReferences(); len(owners) != 1 || owners[0].UID != "uid" {
+		t.Errorf("Generated objects should be owned by the AthenzDomain CR, got %v", owners)
+	}
+	if _, err := client.Resource(AuthorizationPolicyResource).Namespace("home-domain").Get(context.TODO(), "athenz-other-allow", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the AuthorizationPolicy of the other domain to be kept. Error: %v", err)
+	}
+
+	// nothing changes when reconciled again
+	changes, err = r.reconcile(context.TODO(), obj, []string{"home-domain"})
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v. Error: %v", changes, err)
+	}
+
+	obj.Spec.Domain.Roles[0].RoleMembers[0].MemberName = "sports.frontend.mobile"
+	changes, err = r.reconcile(context.TODO(), obj, []string{"home-domain"})
+	if err != nil || !reflect.DeepEqual(changes, []Change{{"update", "home-domain", "athenz-api-allow"}}) {
+		t.Errorf("Expected the ALLOW policy to be updated, got %v. Error: %v", changes, err)
+	}
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	now := time.Now()
+	r, client := newReconciler(true)
+	obj := &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: domainName, UID: "uid"},
+		Spec: athenz_domain.AthenzDomainSpec{
+			SignedDomain: zms.SignedDomain{Domain: getDomainData(now)},
+		},
+	}
+	changes, err := r.reconcile(context.TODO(), obj, []string{"home-domain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("Expected the planned changes to be returned, got %v", changes)
+	}
+	list, err := client.Resource(AuthorizationPolicyResource).Namespace("home-domain").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 0 {
+		t.Errorf("Dry run should not write AuthorizationPolicies, got %d", len(list.Items))
+	}
+}
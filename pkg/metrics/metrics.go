@@ -0,0 +1,418 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/ardielle/ardielle-go/rdl"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const namespace = "athenz_syncer"
+
+// sync results recorded by the controller for every processed domain
+const (
+	ResultCreated   = "created"
+	ResultUpdated   = "updated"
+	ResultUnchanged = "unchanged"
+	ResultDeleted   = "deleted"
+	ResultError     = "error"
+	ResultDeferred  = "deferred"
+)
+
+// ZMS calls made by the syncer
+const (
+	CallGetSignedDomain   = "get_signed_domain"
+	CallGetModifiedDomain = "get_modified_domains"
+)
+
+// reasons ZMS requests are held back by the ZMS request limiter
+const (
+	ThrottleBudget     = "budget"
+	ThrottleRetryAfter = "retry_after"
+)
+
+// reasons deletions of AthenzDomain CRs are deferred by the safety guard
+const (
+	DeferBreaker = "breaker_open"
+	DeferGrace   = "grace_period"
+	DeferBudget  = "deletion_budget"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	syncTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_total",
+		Help:      "Number of AthenzDomain syncs processed by the controller, partitioned by result.",
+	}, []string{"result"})
+
+	syncRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_retries_total",
+		Help:      "Number of failed AthenzDomain syncs that were requeued for another attempt.",
+	})
+
+	domainFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "domain_consecutive_failures",
+		Help:      "Number of consecutive failed syncs of the domains currently failing, partitioned by domain.",
+	}, []string{"domain"})
+
+	deletionsDeferredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deletions_deferred_total",
+		Help:      "Number of AthenzDomain CR deletions held back by the safety guard, partitioned by reason (breaker_open, grace_period or deletion_budget).",
+	}, []string{"reason"})
+
+	breakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deletion_breaker_open",
+		Help:      "1 while the circuit breaker stops all AthenzDomain CR deletions because ZMS reports too many domains missing.",
+	})
+
+	lastSyncTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last AthenzDomain sync that completed without error.",
+	})
+
+	zmsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "zms_request_duration_seconds",
+		Help:      "Latency of ZMS GetSignedDomains calls, partitioned by call type and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"call", "code"})
+
+	zmsThrottledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "zms_throttled_seconds_total",
+		Help:      "Time ZMS requests waited for the ZMS request limiter, partitioned by reason (budget or retry_after).",
+	}, []string{"reason"})
+
+	zmsRetryAfterTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "zms_retry_after_total",
+		Help:      "Number of throttled ZMS responses with a Retry-After header pausing all ZMS requests, partitioned by status code.",
+	}, []string{"code"})
+
+	cronRunsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "update_cron_requests_total",
+		Help:      "Number of update cron ZMS requests, partitioned by result (success or failure).",
+	}, []string{"result"})
+
+	signatureFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signature_verification_failures_total",
+		Help:      "Number of signed domains from ZMS rejected because their signatures could not be verified.",
+	})
+
+	dryRunActionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dry_run_actions_total",
+		Help:      "Number of AthenzDomain CR writes skipped in dry run mode, partitioned by action (create, update or delete).",
+	}, []string{"action"})
+
+	dryRunChangesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dry_run_changes_total",
+		Help:      "Number of roles, members, policies and assertions dry run syncs would add or remove, partitioned by kind and change.",
+	}, []string{"kind", "change"})
+
+	etagAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "etag_age_seconds",
+		Help:      "Age in seconds of the etag currently used by the update cron.",
+	}, currentEtagAge)
+
+	workqueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "depth",
+		Help:      "Current depth of the workqueue.",
+	}, []string{"name"})
+
+	workqueueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "adds_total",
+		Help:      "Total number of adds handled by the workqueue.",
+	}, []string{"name"})
+
+	workqueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "queue_duration_seconds",
+		Help:      "How long in seconds an item stays in the workqueue before being requested.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"name"})
+
+	workqueueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "work_duration_seconds",
+		Help:      "How long in seconds processing an item from the workqueue takes.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"name"})
+
+	workqueueUnfinishedWork = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "unfinished_work_seconds",
+		Help:      "How many seconds of work has been done that is in progress and hasn't been observed by work_duration.",
+	}, []string{"name"})
+
+	workqueueLongestRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "longest_running_processor_seconds",
+		Help:      "How many seconds has the longest running processor for the workqueue been running.",
+	}, []string{"name"})
+
+	workqueueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "retries_total",
+		Help:      "Total number of retries handled by the workqueue.",
+	}, []string{"name"})
+
+	etagLock sync.RWMutex
+	etagTime time.Time
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		syncTotal,
+		syncRetriesTotal,
+		domainFailures,
+		deletionsDeferredTotal,
+		breakerOpen,
+		lastSyncTimestamp,
+		zmsRequestDuration,
+		zmsThrottledSeconds,
+		zmsRetryAfterTotal,
+		cronRunsTotal,
+		signatureFailuresTotal,
+		dryRunActionsTotal,
+		dryRunChangesTotal,
+		etagAge,
+		workqueueDepth,
+		workqueueAdds,
+		workqueueLatency,
+		workqueueWorkDuration,
+		workqueueUnfinishedWork,
+		workqueueLongestRunning,
+		workqueueRetries,
+	)
+}
+
+// Handler returns the http handler serving all syncer metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Serve starts the metrics http server on the given address and shuts it down when stopCh is closed
+func Serve(addr string, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	log.Infof("Starting metrics server on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Metrics server stopped unexpectedly. Error: %v", err)
+	}
+}
+
+// RecordSync - record the outcome of a single controller sync
+func RecordSync(result string) {
+	syncTotal.WithLabelValues(result).Inc()
+	if result != ResultError && result != ResultDeferred {
+		lastSyncTimestamp.SetToCurrentTime()
+	}
+}
+
+// RecordRetry - record a failed sync that was added back to the queue
+func RecordRetry() {
+	syncRetriesTotal.Inc()
+}
+
+// SetDomainFailures - record the number of consecutive failed syncs of a domain
+func SetDomainFailures(domain string, failures int) {
+	domainFailures.WithLabelValues(domain).Set(float64(failures))
+}
+
+// ClearDomainFailures - remove the failure count of a domain once it synced successfully
+func ClearDomainFailures(domain string) {
+	domainFailures.DeleteLabelValues(domain)
+}
+
+// RecordDeletionDeferred - record an AthenzDomain CR deletion held back by the safety guard
+func RecordDeletionDeferred(reason string) {
+	deletionsDeferredTotal.WithLabelValues(reason).Inc()
+}
+
+// SetBreakerOpen - record whether the circuit breaker stops all AthenzDomain CR deletions
+func SetBreakerOpen(open bool) {
+	if open {
+		breakerOpen.Set(1)
+		return
+	}
+	breakerOpen.Set(0)
+}
+
+// ObserveZMSRequest - record the latency and status code of a ZMS call
+func ObserveZMSRequest(call string, start time.Time, err error) {
+	zmsRequestDuration.WithLabelValues(call, statusCode(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveZMSThrottled - record the time a ZMS request waited for the ZMS request limiter
+func ObserveZMSThrottled(reason string, wait time.Duration) {
+	zmsThrottledSeconds.WithLabelValues(reason).Add(wait.Seconds())
+}
+
+// RecordZMSRetryAfter - record a throttled ZMS response pausing all ZMS requests
+func RecordZMSRetryAfter(code int) {
+	zmsRetryAfterTotal.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+// RecordCronRequest - record the outcome of an update cron ZMS request
+func RecordCronRequest(err error) {
+	if err != nil {
+		cronRunsTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	cronRunsTotal.WithLabelValues("success").Inc()
+}
+
+// RecordSignatureFailure - record a signed domain that failed signature verification
+func RecordSignatureFailure() {
+	signatureFailuresTotal.Inc()
+}
+
+// RecordDryRunAction - record an AthenzDomain CR write skipped in dry run mode
+func RecordDryRunAction(action string) {
+	dryRunActionsTotal.WithLabelValues(action).Inc()
+}
+
+// RecordDryRunChanges - record the entries of a kind a dry run sync would add and remove
+func RecordDryRunChanges(kind string, added, removed int) {
+	dryRunChangesTotal.WithLabelValues(kind, "added").Add(float64(added))
+	dryRunChangesTotal.WithLabelValues(kind, "removed").Add(float64(removed))
+}
+
+// SetEtag - record the etag currently used by the update cron. The etag is a
+// ZMS timestamp, anything that does not parse as one resets the age to zero.
+func SetEtag(etag string) {
+	var t time.Time
+	if etag != "" {
+		timestamp, err := rdl.TimestampParse(trimQuotes(etag))
+		if err != nil {
+			log.Warnf("Unable to parse etag %s as a timestamp for metrics. Error: %v", etag, err)
+		} else {
+			t = timestamp.Time
+		}
+	}
+	etagLock.Lock()
+	etagTime = t
+	etagLock.Unlock()
+}
+
+// currentEtagAge - compute the age of the current etag, 0 when no etag is set
+func currentEtagAge() float64 {
+	etagLock.RLock()
+	t := etagTime
+	etagLock.RUnlock()
+	if t.IsZero() {
+		return 0
+	}
+	return time.Since(t).Seconds()
+}
+
+// statusCode - derive the status code label from a ZMS client error
+func statusCode(err error) string {
+	if err == nil {
+		return "200"
+	}
+	if rdlErr, ok := err.(rdl.ResourceError); ok {
+		return strconv.Itoa(rdlErr.Code)
+	}
+	return "error"
+}
+
+// trimQuotes - strip the double quotes surrounding an http etag value
+func trimQuotes(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// workqueueProvider implements the client-go workqueue.MetricsProvider interface
+type workqueueProvider struct{}
+
+// WorkqueueProvider returns the metrics provider to be used with the controller workqueue
+func WorkqueueProvider() workqueue.MetricsProvider {
+	return workqueueProvider{}
+}
+
+func (workqueueProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return workqueueLatency.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return workqueueWorkDuration.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueUnfinishedWork.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueLongestRunning.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return workqueueRetries.WithLabelValues(name)
+}
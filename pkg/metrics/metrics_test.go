@@ -0,0 +1,176 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/ardielle/ardielle-go/rdl"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestRecordSync(t *testing.T) {
+	before := testutil.ToFloat64(syncTotal.WithLabelValues(ResultCreated))
+	RecordSync(ResultCreated)
+	if testutil.ToFloat64(syncTotal.WithLabelValues(ResultCreated)) != before+1 {
+		t.Error("sync_total for created result should be incremented by 1")
+	}
+	if testutil.ToFloat64(lastSyncTimestamp) == 0 {
+		t.Error("last successful sync timestamp should be set after a successful sync")
+	}
+}
+
+func TestDomainFailures(t *testing.T) {
+	SetDomainFailures("home.domain", 4)
+	if testutil.ToFloat64(domainFailures.WithLabelValues("home.domain")) != 4 {
+		t.Error("Consecutive failures of home.domain should be 4")
+	}
+	ClearDomainFailures("home.domain")
+	if testutil.CollectAndCount(domainFailures) != 0 {
+		t.Error("Consecutive failures of home.domain should be removed after a successful sync")
+	}
+}
+
+func TestDeletionDeferred(t *testing.T) {
+	RecordDeletionDeferred(DeferGrace)
+	if testutil.ToFloat64(deletionsDeferredTotal.WithLabelValues(DeferGrace)) != 1 {
+		t.Error("Deferred deletions for the grace period should be incremented by 1")
+	}
+	SetBreakerOpen(true)
+	if testutil.ToFloat64(breakerOpen) != 1 {
+		t.Error("Breaker open gauge should be 1 once the breaker opened")
+	}
+	SetBreakerOpen(false)
+	if testutil.ToFloat64(breakerOpen) != 0 {
+		t.Error("Breaker open gauge should be 0 once the breaker closed")
+	}
+}
+
+func TestObserveZMSRequest(t *testing.T) {
+	ObserveZMSRequest(CallGetSignedDomain, time.Now(), nil)
+	ObserveZMSRequest(CallGetSignedDomain, time.Now(), rdl.ResourceError{Code: 429, Message: "Too Many Requests"})
+	ObserveZMSRequest(CallGetSignedDomain, time.Now(), errors.New("connection refused"))
+	if testutil.CollectAndCount(zmsRequestDuration) != 3 {
+		t.Error("Expected one histogram series for each of the 200, 429 and error status codes")
+	}
+}
+
+func TestZMSThrottled(t *testing.T) {
+	ObserveZMSThrottled(ThrottleRetryAfter, 1500*time.Millisecond)
+	if testutil.ToFloat64(zmsThrottledSeconds.WithLabelValues(ThrottleRetryAfter)) != 1.5 {
+		t.Error("Throttled seconds should be 1.5 after a 1.5s pause")
+	}
+	RecordZMSRetryAfter(429)
+	if testutil.ToFloat64(zmsRetryAfterTotal.WithLabelValues("429")) != 1 {
+		t.Error("Retry-After counter should be incremented by 1")
+	}
+}
+
+func TestRecordCronRequest(t *testing.T) {
+	success := testutil.ToFloat64(cronRunsTotal.WithLabelValues("success"))
+	failure := testutil.ToFloat64(cronRunsTotal.WithLabelValues("failure"))
+	RecordCronRequest(nil)
+	RecordCronRequest(errors.New("zms unavailable"))
+	if testutil.ToFloat64(cronRunsTotal.WithLabelValues("success")) != success+1 {
+		t.Error("Cron success counter should be incremented by 1")
+	}
+	if testutil.ToFloat64(cronRunsTotal.WithLabelValues("failure")) != failure+1 {
+		t.Error("Cron failure counter should be incremented by 1")
+	}
+}
+
+func TestRecordSignatureFailure(t *testing.T) {
+	before := testutil.ToFloat64(signatureFailuresTotal)
+	RecordSignatureFailure()
+	if testutil.ToFloat64(signatureFailuresTotal) != before+1 {
+		t.Error("Signature verification failure counter should be incremented by 1")
+	}
+}
+
+func TestRecordDryRun(t *testing.T) {
+	before := testutil.ToFloat64(dryRunActionsTotal.WithLabelValues("update"))
+	added := testutil.ToFloat64(dryRunChangesTotal.WithLabelValues("member", "added"))
+	RecordDryRunAction("update")
+	RecordDryRunChanges("member", 2, 0)
+	if testutil.ToFloat64(dryRunActionsTotal.WithLabelValues("update")) != before+1 {
+		t.Error("Dry run update counter should be incremented by 1")
+	}
+	if testutil.ToFloat64(dryRunChangesTotal.WithLabelValues("member", "added")) != added+2 {
+		t.Error("Dry run added member counter should be incremented by 2")
+	}
+}
+
+func TestSetEtag(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	SetEtag("")
+	if currentEtagAge() != 0 {
+		t.Error("Etag age should be 0 when no etag is set")
+	}
+	SetEtag(time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	age := currentEtagAge()
+	if age < 3599 || age > 3700 {
+		t.Errorf("Etag age should be around 1 hour, got %f seconds", age)
+	}
+	SetEtag("\"" + time.Now().Add(-time.Minute).UTC().Format(time.RFC3339) + "\"")
+	age = currentEtagAge()
+	if age < 59 || age > 160 {
+		t.Errorf("Quoted etag age should be around 1 minute, got %f seconds", age)
+	}
+	SetEtag("not-a-timestamp")
+	if currentEtagAge() != 0 {
+		t.Error("Etag age should be reset when the etag cannot be parsed")
+	}
+}
+
+func TestWorkqueueProvider(t *testing.T) {
+	queue := workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{
+		Name:            "metrics-test",
+		MetricsProvider: WorkqueueProvider(),
+	})
+	defer queue.ShutDown()
+	queue.Add("home.domain")
+	if testutil.ToFloat64(workqueueDepth.WithLabelValues("metrics-test")) != 1 {
+		t.Error("Workqueue depth should be 1 after adding an item")
+	}
+	if testutil.ToFloat64(workqueueAdds.WithLabelValues("metrics-test")) != 1 {
+		t.Error("Workqueue adds should be 1 after adding an item")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	RecordSync(ResultUnchanged)
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "athenz_syncer_sync_total") {
+		t.Error("Metrics handler should expose athenz_syncer_sync_total")
+	}
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package priorityqueue
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Priority - lane of a queued item, lower values are handed out first
+type Priority int
+
+const (
+	// PriorityHigh - new namespaces and domains changed in ZMS, synced first
+	PriorityHigh Priority = iota
+	// PriorityMedium - trust domains of the delegated roles of a synced domain
+	PriorityMedium
+	// PriorityLow - full resyncs and AthenzDomain CR events, synced last
+	PriorityLow
+	numPriorities
+)
+
+// unfinishedWorkUpdatePeriod - interval of the in-flight work metrics updates, as in client-go
+const unfinishedWorkUpdatePeriod = 500 * time.Millisecond
+
+// Interface - rate limiting workqueue handing out its items by priority
+type Interface interface {
+	workqueue.RateLimitingInterface
+	// AddWithPriority - add the item in the lane of the priority. An item is only queued once, an item
+	// added again with a higher priority moves to the higher priority lane.
+	AddWithPriority(item interface{}, priority Priority)
+}
+
+// Config - settings of the priority queue
+type Config struct {
+	// Name of the queue in the metrics
+	Name string
+	// DelayInterval is the minimum time between two items handed out by Get
+	DelayInterval time.Duration
+	// MetricsProvider records the workqueue metrics, none are recorded when nil
+	MetricsProvider workqueue.MetricsProvider
+}
+
+// PriorityQueue - workqueue with a FIFO lane per priority. Like the client-go workqueue, an item is never
+// handed out while it is processed, an item added while processed is handed out again once done, and the
+// items still queued are handed out after ShutDown. Get hands out at most one item per delay interval, whatever
+// its lane, and the lanes only decide which item goes next, so that items added with a high priority are
+// processed within one interval however long the low priority lanes are. Items added with AddRateLimited or
+// AddAfter keep the priority they were queued or processed with.
+type PriorityQueue struct {
+	cond          *sync.Cond
+	lanes         [numPriorities][]interface{}
+	queued        map[interface{}]Priority
+	processing    map[interface{}]Priority
+	waiting       int
+	addedAt       map[interface{}]time.Time
+	startedAt     map[interface{}]time.Time
+	next          time.Time
+	delayInterval time.Duration
+	rateLimiter   workqueue.RateLimiter
+	shuttingDown  bool
+	drain         bool
+	metrics       queueMetrics
+}
+
+// New - create a priority queue delaying the items added with AddRateLimited by the rate limiter
+func New(rateLimiter workqueue.RateLimiter, config Config) *PriorityQueue {
+	q := &PriorityQueue{
+		cond:          sync.NewCond(&sync.Mutex{}),
+		queued:        map[interface{}]Priority{},
+		processing:    map[interface{}]Priority{},
+		addedAt:       map[interface{}]time.Time{},
+		startedAt:     map[interface{}]time.Time{},
+		delayInterval: config.DelayInterval,
+		rateLimiter:   rateLimiter,
+		metrics:       newQueueMetrics(config.MetricsProvider, config.Name),
+	}
+	if config.MetricsProvider != nil {
+		go q.updateUnfinishedWorkLoop()
+	}
+	return q
+}
+
+// Add - add the item with the priority it is queued or processed with, PriorityHigh otherwise
+func (q *PriorityQueue) Add(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.add(item, q.priorityOf(item))
+}
+
+// AddWithPriority - add the item in the lane of the priority, see Interface
+func (q *PriorityQueue) AddWithPriority(item interface{}, priority Priority) {
+	if priority < PriorityHigh || priority >= numPriorities {
+		priority = PriorityLow
+	}
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.add(item, priority)
+}
+
+// add - queue the item, the lock must be held
+func (q *PriorityQueue) add(item interface{}, priority Priority) {
+	if q.shuttingDown {
+		return
+	}
+	if current, ok := q.queued[item]; ok {
+		if priority >= current {
+			return
+		}
+		// the entry left in the lower priority lane is skipped by Get
+		q.queued[item] = priority
+		if _, ok := q.processing[item]; !ok {
+			q.lanes[priority] = append(q.lanes[priority], item)
+			q.cond.Broadcast()
+		}
+		return
+	}
+	q.metrics.adds.Inc()
+	q.queued[item] = priority
+	if _, ok := q.processing[item]; ok {
+		// queued again once done
+		return
+	}
+	q.push(item, priority)
+}
+
+// push - append the item to its lane and wake up the waiting Get calls, the lock must be held. The condition
+// is shared with ShutDownWithDrain, so all waiters are woken up.
+func (q *PriorityQueue) push(item interface{}, priority Priority) {
+	q.lanes[priority] = append(q.lanes[priority], item)
+	q.waiting++
+	q.addedAt[item] = time.Now()
+	q.metrics.depth.Inc()
+	q.cond.Broadcast()
+}
+
+// priorityOf - priority the item is queued or processed with, PriorityHigh otherwise, the lock must be held
+func (q *PriorityQueue) priorityOf(item interface{}) Priority {
+	if priority, ok := q.queued[item]; ok {
+		return priority
+	}
+	if priority, ok := q.processing[item]; ok {
+		return priority
+	}
+	return PriorityHigh
+}
+
+// Len - number of items waiting to be handed out
+func (q *PriorityQueue) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.waiting
+}
+
+// LenByPriority - number of items waiting to be handed out in the lane of the priority
+func (q *PriorityQueue) LenByPriority(priority Priority) int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	count := 0
+	for item, p := range q.queued {
+		if _, ok := q.processing[item]; !ok && p == priority {
+			count++
+		}
+	}
+	return count
+}
+
+// Get - block until an item can be handed out and return the first item of the highest priority lane,
+// shutdown is true once the queue is shut down and empty
+func (q *PriorityQueue) Get() (item interface{}, shutdown bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for {
+		for q.waiting == 0 && !q.shuttingDown {
+			q.cond.Wait()
+		}
+		if q.waiting == 0 {
+			return nil, true
+		}
+		now := time.Now()
+		if wait := q.next.Sub(now); wait > 0 {
+			// the item is picked after the wait, so that items added meanwhile with a higher priority go first
+			timer := time.AfterFunc(wait, func() {
+				q.cond.L.Lock()
+				defer q.cond.L.Unlock()
+				q.cond.Broadcast()
+			})
+			q.cond.Wait()
+			timer.Stop()
+			continue
+		}
+		priority := q.first()
+		item := q.pop(priority)
+		q.next = now.Add(q.delayInterval)
+		delete(q.queued, item)
+		q.processing[item] = priority
+		q.waiting--
+		q.metrics.depth.Dec()
+		q.metrics.latency.Observe(now.Sub(q.addedAt[item]).Seconds())
+		delete(q.addedAt, item)
+		q.startedAt[item] = now
+		return item, false
+	}
+}
+
+// first - highest priority lane with an item. The lock must be held and an item be waiting.
+func (q *PriorityQueue) first() Priority {
+	for priority := PriorityHigh; priority < numPriorities; priority++ {
+		if q.head(priority) {
+			return priority
+		}
+	}
+	// unreachable while waiting is consistent with the lanes
+	panic("priorityqueue: no item waiting")
+}
+
+// head - drop the entries left behind by items moved to a higher priority lane or processed from the front
+// of the lane, and check if an item is left. The lock must be held.
+func (q *PriorityQueue) head(priority Priority) bool {
+	for len(q.lanes[priority]) > 0 {
+		item := q.lanes[priority][0]
+		current, queued := q.queued[item]
+		_, processing := q.processing[item]
+		if queued && current == priority && !processing {
+			return true
+		}
+		q.lanes[priority][0] = nil
+		q.lanes[priority] = q.lanes[priority][1:]
+	}
+	return false
+}
+
+// pop - remove and return the first item of the lane, head must have returned true. The lock must be held.
+func (q *PriorityQueue) pop(priority Priority) interface{} {
+	item := q.lanes[priority][0]
+	q.lanes[priority][0] = nil
+	q.lanes[priority] = q.lanes[priority][1:]
+	return item
+}
+
+// Done - mark the item as processed, it is queued again when added while processed
+func (q *PriorityQueue) Done(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if started, ok := q.startedAt[item]; ok {
+		q.metrics.workDuration.Observe(time.Since(started).Seconds())
+		delete(q.startedAt, item)
+	}
+	delete(q.processing, item)
+	if priority, ok := q.queued[item]; ok {
+		q.push(item, priority)
+	}
+	if len(q.processing) == 0 {
+		// wake up ShutDownWithDrain
+		q.cond.Broadcast()
+	}
+}
+
+// ShutDown - stop accepting items, Get hands out the items still queued and then returns shutdown
+func (q *PriorityQueue) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+// ShutDownWithDrain - shut down the queue and wait until all the items handed out are done
+func (q *PriorityQueue) ShutDownWithDrain() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.shuttingDown = true
+	q.drain = true
+	q.cond.Broadcast()
+	for len(q.processing) > 0 && q.drain {
+		q.cond.Wait()
+	}
+}
+
+// ShuttingDown - true once the queue is shut down
+func (q *PriorityQueue) ShuttingDown() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.shuttingDown
+}
+
+// AddAfter - add the item with the priority it is queued or processed with once the duration elapsed
+func (q *PriorityQueue) AddAfter(item interface{}, duration time.Duration) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	priority := q.priorityOf(item)
+	if duration <= 0 {
+		q.add(item, priority)
+		return
+	}
+	if q.shuttingDown {
+		return
+	}
+	time.AfterFunc(duration, func() {
+		q.AddWithPriority(item, priority)
+	})
+}
+
+// AddRateLimited - add the item after the delay of the rate limiter
+func (q *PriorityQueue) AddRateLimited(item interface{}) {
+	q.metrics.retries.Inc()
+	q.AddAfter(item, q.rateLimiter.When(item))
+}
+
+// Forget - reset the rate limiter of the item
+func (q *PriorityQueue) Forget(item interface{}) {
+	q.rateLimiter.Forget(item)
+}
+
+// NumRequeues - number of times the item was added with AddRateLimited since it was forgotten
+func (q *PriorityQueue) NumRequeues(item interface{}) int {
+	return q.rateLimiter.NumRequeues(item)
+}
+
+// updateUnfinishedWorkLoop - update the in-flight work metrics until the queue is shut down
+func (q *PriorityQueue) updateUnfinishedWorkLoop() {
+	ticker := time.NewTicker(unfinishedWorkUpdatePeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.cond.L.Lock()
+		if q.shuttingDown {
+			q.cond.L.Unlock()
+			return
+		}
+		now := time.Now()
+		var total, longest float64
+		for _, started := range q.startedAt {
+			elapsed := now.Sub(started).Seconds()
+			total += elapsed
+			if elapsed > longest {
+				longest = elapsed
+			}
+		}
+		q.cond.L.Unlock()
+		q.metrics.unfinishedWork.Set(total)
+		q.metrics.longestRunning.Set(longest)
+	}
+}
+
+// queueMetrics - workqueue metrics of the queue
+type queueMetrics struct {
+	depth          workqueue.GaugeMetric
+	adds           workqueue.CounterMetric
+	latency        workqueue.HistogramMetric
+	workDuration   workqueue.HistogramMetric
+	unfinishedWork workqueue.SettableGaugeMetric
+	longestRunning workqueue.SettableGaugeMetric
+	retries        workqueue.CounterMetric
+}
+
+// newQueueMetrics - metrics of the provider, discarded when the provider is nil
+func newQueueMetrics(provider workqueue.MetricsProvider, name string) queueMetrics {
+	if provider == nil {
+		return queueMetrics{noopMetric{}, noopMetric{}, noopMetric{}, noopMetric{}, noopMetric{}, noopMetric{}, noopMetric{}}
+	}
+	return queueMetrics{
+		depth:          provider.NewDepthMetric(name),
+		adds:           provider.NewAddsMetric(name),
+		latency:        provider.NewLatencyMetric(name),
+		workDuration:   provider.NewWorkDurationMetric(name),
+		unfinishedWork: provider.NewUnfinishedWorkSecondsMetric(name),
+		longestRunning: provider.NewLongestRunningProcessorSecondsMetric(name),
+		retries:        provider.NewRetriesMetric(name),
+	}
+}
+
+// noopMetric - metric discarding its values
+type noopMetric struct{}
+
+func (noopMetric) Inc()            {}
+func (noopMetric) Dec()            {}
+func (noopMetric) Set(float64)     {}
+func (noopMetric) Observe(float64) {}
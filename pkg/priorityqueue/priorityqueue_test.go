@@ -0,0 +1,203 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package priorityqueue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func newQueue(delayInterval time.Duration) *PriorityQueue {
+	return New(workqueue.NewItemExponentialFailureRateLimiter(0, 0), Config{DelayInterval: delayInterval})
+}
+
+// drain - get all the queued items in order
+func drain(q *PriorityQueue) []string {
+	items := []string{}
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		items = append(items, item.(string))
+		q.Done(item)
+	}
+	return items
+}
+
+func TestPriorityOrder(t *testing.T) {
+	q := newQueue(0)
+	q.AddWithPriority("resync.a", PriorityLow)
+	q.AddWithPriority("resync.b", PriorityLow)
+	q.AddWithPriority("trust.domain", PriorityMedium)
+	q.AddWithPriority("new.namespace", PriorityHigh)
+	q.AddWithPriority("changed.domain", PriorityHigh)
+	expected := []string{"new.namespace", "changed.domain", "trust.domain", "resync.a", "resync.b"}
+	if items := drain(q); !reflect.DeepEqual(items, expected) {
+		t.Errorf("Expected %v, got %v", expected, items)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	q := newQueue(0)
+	q.AddWithPriority("resync.a", PriorityLow)
+	q.AddWithPriority("resync.b", PriorityLow)
+	q.AddWithPriority("resync.b", PriorityLow)
+	// moved ahead of the resync
+	q.AddWithPriority("resync.b", PriorityHigh)
+	// not moved back
+	q.AddWithPriority("resync.b", PriorityLow)
+	if q.Len() != 2 || q.LenByPriority(PriorityHigh) != 1 || q.LenByPriority(PriorityLow) != 1 {
+		t.Errorf("Expected one high and one low priority item, got %d high and %d low", q.LenByPriority(PriorityHigh), q.LenByPriority(PriorityLow))
+	}
+	expected := []string{"resync.b", "resync.a"}
+	if items := drain(q); !reflect.DeepEqual(items, expected) {
+		t.Errorf("Expected %v, got %v", expected, items)
+	}
+}
+
+func TestAddWhileProcessing(t *testing.T) {
+	q := newQueue(0)
+	q.AddWithPriority("home.domain", PriorityLow)
+	item, _ := q.Get()
+	q.AddWithPriority("home.domain", PriorityMedium)
+	if q.Len() != 0 {
+		t.Error("An item being processed should not be handed out again")
+	}
+	q.Done(item)
+	if q.LenByPriority(PriorityMedium) != 1 {
+		t.Error("An item added while processed should be queued once done")
+	}
+	item, _ = q.Get()
+
+	// retries keep the priority the item was processed with
+	q.AddRateLimited(item)
+	q.Done(item)
+	time.Sleep(10 * time.Millisecond)
+	if q.LenByPriority(PriorityMedium) != 1 || q.NumRequeues(item) != 1 {
+		t.Errorf("Expected the retry to be queued with medium priority, got %d items and %d requeues", q.LenByPriority(PriorityMedium), q.NumRequeues(item))
+	}
+	q.Forget(item)
+	if q.NumRequeues(item) != 0 {
+		t.Error("Expected the requeues to be reset")
+	}
+	q.Add("other.domain")
+	if q.LenByPriority(PriorityHigh) != 1 {
+		t.Error("Expected items added without priority to be queued with high priority")
+	}
+}
+
+func TestDelayInterval(t *testing.T) {
+	delayInterval := 50 * time.Millisecond
+	q := newQueue(delayInterval)
+	for _, item := range []string{"a", "b", "c"} {
+		q.AddWithPriority(item, PriorityLow)
+	}
+	start := time.Now()
+	item, _ := q.Get()
+	if time.Since(start) > delayInterval/2 {
+		t.Error("Expected the first item to be handed out immediately")
+	}
+	q.Done(item)
+	// added while the worker waits for the next interval, handed out before the low priority items
+	go func() {
+		time.Sleep(delayInterval / 5)
+		q.AddWithPriority("urgent", PriorityHigh)
+	}()
+	item, _ = q.Get()
+	if item != "urgent" {
+		t.Errorf("Expected the high priority item to be handed out next, got %v", item)
+	}
+	if elapsed := time.Since(start); elapsed < delayInterval {
+		t.Errorf("Expected the high priority item to wait for the delay interval, took %s", elapsed)
+	}
+	q.Done(item)
+	drain(q)
+	if elapsed := time.Since(start); elapsed < 3*delayInterval {
+		t.Errorf("Expected 4 items to take at least 3 delay intervals, took %s", elapsed)
+	}
+}
+
+// TestConcurrentWorkers - test that concurrent workers share the delay interval whatever the lanes of the items
+func TestConcurrentWorkers(t *testing.T) {
+	delayInterval := time.Hour
+	q := newQueue(delayInterval)
+	q.AddWithPriority("resync.a", PriorityLow)
+	q.AddWithPriority("trust.domain", PriorityMedium)
+	q.AddWithPriority("new.namespace", PriorityHigh)
+	handedOut := make(chan interface{}, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			item, _ := q.Get()
+			handedOut <- item
+		}()
+	}
+	select {
+	case item := <-handedOut:
+		if item != "new.namespace" {
+			t.Errorf("Expected the high priority item first, got %v", item)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the first item to be handed out immediately")
+	}
+	select {
+	case item := <-handedOut:
+		t.Errorf("Expected the other workers to wait for the delay interval, got %v", item)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if q.Len() != 2 {
+		t.Errorf("Expected 2 items waiting, got %d", q.Len())
+	}
+	q.ShutDown()
+}
+
+func TestShutDown(t *testing.T) {
+	q := newQueue(0)
+	q.AddWithPriority("a", PriorityLow)
+	q.ShutDown()
+	q.AddWithPriority("b", PriorityHigh)
+	if !q.ShuttingDown() {
+		t.Error("Expected the queue to be shutting down")
+	}
+	item, shutdown := q.Get()
+	if item != "a" || shutdown {
+		t.Errorf("Expected the queued item to be handed out after shut down, got %v", item)
+	}
+	q.Done(item)
+	if _, shutdown := q.Get(); !shutdown {
+		t.Error("Expected Get to return shutdown once the queue is empty")
+	}
+
+	q = newQueue(0)
+	q.AddWithPriority("a", PriorityLow)
+	item, _ = q.Get()
+	done := make(chan struct{})
+	go func() {
+		q.ShutDownWithDrain()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected ShutDownWithDrain to wait for the items being processed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.Done(item)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected ShutDownWithDrain to return once the items are done")
+	}
+}
@@ -16,21 +16,31 @@ limitations under the License.
 package ratelimiter
 
 import (
+	"math/rand"
 	"sync"
 	"time"
 )
 
+// backoffJitter - fraction of the per item backoff randomly taken off, so that items failing together
+// do not all come back at the same time
+const backoffJitter = 0.2
+
 // RateLimiter will rate limit by delaying queue additions by a specified time
 // interval plus the timestamp of a previously added item. For example, if there
 // are 2 queue additions with the delayInterval set to 1 second, the first item
 // will be added after a 1 second sleep, the second will be added after the
 // first item delay along with another 1 second delay interval addition
 // resulting in a 2 second sleep.
+//
+// With a backoff set, an item failing repeatedly additionally waits for an
+// exponential backoff of its own, see SetBackoff.
 type RateLimiter struct {
 	failuresLock  sync.Mutex
 	failures      map[interface{}]int
 	currentDelay  time.Time
 	delayInterval time.Duration
+	baseDelay     time.Duration
+	maxDelay      time.Duration
 }
 
 // NewRateLimiter will return a new rate limiter object to be used with the
@@ -43,24 +53,60 @@ func NewRateLimiter(delayInterval time.Duration) *RateLimiter {
 	}
 }
 
+// SetBackoff sets the per item exponential backoff. The n-th consecutive failure
+// of an item waits baseDelay * 2^(n-1), capped at maxDelay and jittered, unless
+// the global spacing is longer. A baseDelay of 0 disables the backoff.
+func (r *RateLimiter) SetBackoff(baseDelay, maxDelay time.Duration) {
+	r.failuresLock.Lock()
+	defer r.failuresLock.Unlock()
+
+	if maxDelay < baseDelay {
+		maxDelay = baseDelay
+	}
+
+	r.baseDelay = baseDelay
+	r.maxDelay = maxDelay
+}
+
 // When returns the time when the item should be added onto the workqueue. Uses
-// the previously set time to calculate the new sleep interval.
+// the previously set time to calculate the new sleep interval, or the backoff of
+// the item when it is longer.
 func (r *RateLimiter) When(item interface{}) time.Duration {
 	r.failuresLock.Lock()
 	defer r.failuresLock.Unlock()
 
 	r.failures[item] = r.failures[item] + 1
+	backoff := r.backoff(r.failures[item])
 
 	now := time.Now()
 	newDelay := r.currentDelay.Add(r.delayInterval)
-	// directly return 0 if currentDelay + delayInterval is in the past
+	// no spacing needed if currentDelay + delayInterval is in the past
 	if now.After(newDelay) {
 		r.currentDelay = now
-		return 0
+		return backoff
 	}
 
 	r.currentDelay = newDelay
-	return r.currentDelay.Sub(now)
+	if spacing := r.currentDelay.Sub(now); spacing > backoff {
+		return spacing
+	}
+	return backoff
+}
+
+// backoff returns the jittered exponential backoff of an item after its n-th
+// consecutive failure, 0 when no backoff is set
+func (r *RateLimiter) backoff(failures int) time.Duration {
+	if r.baseDelay <= 0 || failures < 1 {
+		return 0
+	}
+	delay := r.baseDelay
+	for i := 1; i < failures && delay < r.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > r.maxDelay {
+		delay = r.maxDelay
+	}
+	return delay - time.Duration(rand.Float64()*backoffJitter*float64(delay))
 }
 
 // Forget removes the failure count for an item
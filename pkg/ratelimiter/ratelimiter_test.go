@@ -96,3 +96,42 @@ func TestNumRequeues(t *testing.T) {
 		t.Error("Num of requeues should be 0 for nonexistent key")
 	}
 }
+
+func TestBackoff(t *testing.T) {
+	rateLimiter := NewRateLimiter(0)
+	rateLimiter.SetBackoff(time.Second, 10*time.Second)
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, max := range expected {
+		sleepTime := rateLimiter.When("key")
+		min := max - time.Duration(backoffJitter*float64(max))
+		if sleepTime > max || sleepTime < min {
+			t.Errorf("Failure %d: sleep time should be between %s and %s, got %s", i+1, min, max, sleepTime)
+		}
+	}
+	if rateLimiter.NumRequeues("key") != len(expected) {
+		t.Errorf("Num of requeues should be equal to %d", len(expected))
+	}
+
+	// other items are not slowed down by the failures of the key
+	sleepTime := rateLimiter.When("other-key")
+	if sleepTime > time.Second {
+		t.Errorf("Sleep time of a first failure should be at most 1s, got %s", sleepTime)
+	}
+
+	rateLimiter.Forget("key")
+	sleepTime = rateLimiter.When("key")
+	if sleepTime > time.Second {
+		t.Errorf("Backoff should start over after Forget, got %s", sleepTime)
+	}
+}
+
+func TestBackoffSpacing(t *testing.T) {
+	rateLimiter := NewRateLimiter(time.Second)
+	rateLimiter.SetBackoff(100*time.Millisecond, time.Minute)
+	rateLimiter.When("key-one")
+	// the global spacing is longer than the first backoff of key-two
+	sleepTime := rateLimiter.When("key-two")
+	if sleepTime > 1001*time.Millisecond || sleepTime < 999*time.Millisecond {
+		t.Errorf("Sleep time should be the global spacing of 1s, got %s", sleepTime)
+	}
+}
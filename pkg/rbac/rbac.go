@@ -0,0 +1,415 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rbac
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiError "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultGrammar - assertion resource grammar granting a verb on a k8s resource of the domain namespace
+	DefaultGrammar = "{domain}:{verb}:{resource}"
+	// DomainLabel - label with the Athenz domain of the source policy
+	DomainLabel = "athenz.io/domain"
+	// PolicyLabel - label with the name of the source policy
+	PolicyLabel = "athenz.io/policy"
+	// RoleLabel - label with the name of the Athenz role bound by the RoleBinding
+	RoleLabel = "athenz.io/role"
+	// PolicyAnnotation - full resource name of the source policy, kept when it is too long for a label
+	PolicyAnnotation = "athenz.io/policy"
+
+	namePrefix = "athenz:"
+)
+
+// grammar placeholders and the patterns they match in an assertion resource
+var placeholders = map[string]string{
+	"{domain}":   "",
+	"{verb}":     `(?P<verb>[a-z*]+)`,
+	"{resource}": `(?P<resource>[a-z0-9*][a-z0-9.*/-]*)`,
+}
+
+var placeholderRegex = regexp.MustCompile(`\{[^{}]*\}`)
+
+var verbRegex = regexp.MustCompile(`^[a-z*]+$`)
+
+// Grammar - pattern of the assertion resources that grant access to k8s resources. The {domain} and
+// {resource} placeholders are required, the verb is taken from the assertion action unless the
+// grammar has a {verb} placeholder. Resources are given as <resource>[.<group>][/<subresource>].
+type Grammar struct {
+	parts []string
+	verb  bool
+}
+
+// ParseGrammar - parse an assertion resource grammar such as DefaultGrammar
+func ParseGrammar(grammar string) (*Grammar, error) {
+	g := &Grammar{}
+	counts := map[string]int{}
+	last := 0
+	for _, loc := range placeholderRegex.FindAllStringIndex(grammar, -1) {
+		placeholder := grammar[loc[0]:loc[1]]
+		if _, ok := placeholders[placeholder]; !ok {
+			return nil, fmt.Errorf("Unknown placeholder %s in RBAC resource grammar %q", placeholder, grammar)
+		}
+		counts[placeholder]++
+		if loc[0] > last {
+			g.parts = append(g.parts, grammar[last:loc[0]])
+		}
+		g.parts = append(g.parts, placeholder)
+		last = loc[1]
+	}
+	if last < len(grammar) {
+		g.parts = append(g.parts, grammar[last:])
+	}
+	for placeholder := range placeholders {
+		if counts[placeholder] > 1 {
+			return nil, fmt.Errorf("Placeholder %s is repeated in RBAC resource grammar %q", placeholder, grammar)
+		}
+	}
+	if counts["{domain}"] != 1 || counts["{resource}"] != 1 {
+		return nil, fmt.Errorf("RBAC resource grammar %q must contain the {domain} and {resource} placeholders", grammar)
+	}
+	g.verb = counts["{verb}"] == 1
+	return g, nil
+}
+
+// regex - regex matching the assertion resources of the domain
+func (g *Grammar) regex(domain string) *regexp.Regexp {
+	pattern := "^"
+	for _, part := range g.parts {
+		switch part {
+		case "{domain}":
+			pattern += regexp.QuoteMeta(domain)
+		case "{verb}", "{resource}":
+			pattern += placeholders[part]
+		default:
+			pattern += regexp.QuoteMeta(part)
+		}
+	}
+	return regexp.MustCompile(pattern + "$")
+}
+
+// rule - convert an assertion matching the grammar into a policy rule
+func (g *Grammar) rule(regex *regexp.Regexp, assertion *zms.Assertion) (rbacv1.PolicyRule, bool) {
+	match := regex.FindStringSubmatch(assertion.Resource)
+	if match == nil {
+		return rbacv1.PolicyRule{}, false
+	}
+	verb := strings.ToLower(assertion.Action)
+	resource := ""
+	for i, name := range regex.SubexpNames() {
+		switch name {
+		case "verb":
+			verb = match[i]
+		case "resource":
+			resource = match[i]
+		}
+	}
+	if !verbRegex.MatchString(verb) {
+		return rbacv1.PolicyRule{}, false
+	}
+	subresource := ""
+	if i := strings.Index(resource, "/"); i >= 0 {
+		resource, subresource = resource[:i], resource[i:]
+	}
+	group := ""
+	if resource == "*" {
+		group = "*"
+	} else if i := strings.Index(resource, "."); i >= 0 {
+		resource, group = resource[:i], resource[i+1:]
+	}
+	return rbacv1.PolicyRule{
+		Verbs:     []string{verb},
+		APIGroups: []string{group},
+		Resources: []string{resource + subresource},
+	}, true
+}
+
+// Generate - derive a Role and a RoleBinding for every Athenz role granted k8s resources by an allow
+// assertion of a policy. Deny assertions cannot be expressed in RBAC and are ignored. The objects are
+// returned without namespace and owner.
+func (g *Grammar) Generate(domainData *zms.DomainData, now time.Time) ([]*rbacv1.Role, []*rbacv1.RoleBinding) {
+	if domainData == nil || domainData.Policies == nil || domainData.Policies.Contents == nil {
+		return nil, nil
+	}
+	domain := string(domainData.Name)
+	regex := g.regex(domain)
+	roles := map[string]*zms.Role{}
+	for _, role := range domainData.Roles {
+		if role != nil {
+			roles[string(role.Name)] = role
+		}
+	}
+
+	rbacRoles := []*rbacv1.Role{}
+	rbacBindings := []*rbacv1.RoleBinding{}
+	for _, policy := range domainData.Policies.Contents.Policies {
+		if policy == nil || (policy.Active != nil && !*policy.Active) {
+			continue
+		}
+		rules := map[string][]rbacv1.PolicyRule{}
+		for _, assertion := range policy.Assertions {
+			if assertion == nil || (assertion.Effect != nil && *assertion.Effect == zms.DENY) {
+				continue
+			}
+			if rule, ok := g.rule(regex, assertion); ok {
+				rules[assertion.Role] = append(rules[assertion.Role], rule)
+			}
+		}
+		policyName := shortName(string(policy.Name), ":policy.")
+		for roleName, roleRules := range rules {
+			name := namePrefix + policyName + ":" + shortName(roleName, ":role.")
+			meta := metav1.ObjectMeta{
+				Name:        name,
+				Labels:      objectLabels(domain, policyName, shortName(roleName, ":role.")),
+				Annotations: map[string]string{PolicyAnnotation: string(policy.Name)},
+			}
+			rbacRoles = append(rbacRoles, &rbacv1.Role{
+				ObjectMeta: *meta.DeepCopy(),
+				Rules:      roleRules,
+			})
+			rbacBindings = append(rbacBindings, &rbacv1.RoleBinding{
+				ObjectMeta: *meta.DeepCopy(),
+				Subjects:   subjects(roles[roleName], now),
+				RoleRef: rbacv1.RoleRef{
+					APIGroup: rbacv1.GroupName,
+					Kind:     "Role",
+					Name:     name,
+				},
+			})
+		}
+	}
+	sort.Slice(rbacRoles, func(i, j int) bool { return rbacRoles[i].Name < rbacRoles[j].Name })
+	sort.Slice(rbacBindings, func(i, j int) bool { return rbacBindings[i].Name < rbacBindings[j].Name })
+	return rbacRoles, rbacBindings
+}
+
+// shortName - strip the domain and the kind from an Athenz resource name such as domain:role.admin
+func shortName(name, separator string) string {
+	if i := strings.Index(name, separator); i >= 0 {
+		return name[i+len(separator):]
+	}
+	return name
+}
+
+// objectLabels - labels of a generated object, values that are not valid label values are left out
+func objectLabels(domain, policy, role string) map[string]string {
+	labels := map[string]string{cr.ManagedByLabel: cr.ManagedByValue}
+	for key, value := range map[string]string{DomainLabel: domain, PolicyLabel: policy, RoleLabel: role} {
+		if len(validation.IsValidLabelValue(value)) == 0 {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// subjects - RoleBinding subjects of the role members that are not expired. Athenz groups are bound as
+// groups and wildcard members are skipped as RBAC cannot match them.
+func subjects(role *zms.Role, now time.Time) []rbacv1.Subject {
+	subjects := []rbacv1.Subject{}
+	for _, member := range cr.RoleMembers(role, now) {
+		if strings.Contains(member, "*") {
+			log.Infof("Skipping wildcard member %s of role %s in RoleBinding", member, role.Name)
+			continue
+		}
+		kind := rbacv1.UserKind
+		if strings.Contains(member, cr.GroupSeparator) {
+			kind = rbacv1.GroupKind
+		}
+		subjects = append(subjects, rbacv1.Subject{
+			Kind:     kind,
+			APIGroup: rbacv1.GroupName,
+			Name:     member,
+		})
+	}
+	return subjects
+}
+
+// Reconciler - keeps the Roles and RoleBindings generated from the domain policies up to date in the
+// namespaces mapped to the domain. Generated objects are owned by the AthenzDomain CR so that they are
+// garbage collected with it, and generated objects no longer derived from the policies are deleted.
+type Reconciler struct {
+	k8sClient kubernetes.Interface
+	grammar   *Grammar
+}
+
+// NewReconciler - create a reconciler generating RBAC objects for the assertions matching the grammar
+func NewReconciler(k8sClient kubernetes.Interface, grammar string) (*Reconciler, error) {
+	g, err := ParseGrammar(grammar)
+	if err != nil {
+		return nil, err
+	}
+	return &Reconciler{
+		k8sClient: k8sClient,
+		grammar:   g,
+	}, nil
+}
+
+// Reconcile - create, update and delete the generated RBAC objects of the AthenzDomain CR in the namespaces
+func (r *Reconciler) Reconcile(ctx context.Context, obj *athenz_domain.AthenzDomain, namespaces []string) error {
+	if obj == nil {
+		return nil
+	}
+	signedDomain, err := cr.SignedDomain(obj)
+	if err != nil {
+		return err
+	}
+	roles, bindings := r.grammar.Generate(signedDomain.Domain, time.Now())
+	owner := cr.OwnerReference(obj)
+	errs := []error{}
+	for _, namespace := range namespaces {
+		if err := r.reconcileRoles(ctx, namespace, obj.Name, owner, roles); err != nil {
+			errs = append(errs, err)
+		}
+		if err := r.reconcileRoleBindings(ctx, namespace, obj.Name, owner, bindings); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// managedSelector - list options selecting the objects generated from the domain. Domains that are not valid
+// label values are not labeled on the objects and are left to generatedFrom.
+func managedSelector(domain string) metav1.ListOptions {
+	selector := cr.ManagedByLabel + "=" + cr.ManagedByValue
+	if len(validation.IsValidLabelValue(domain)) == 0 {
+		selector += "," + DomainLabel + "=" + domain
+	}
+	return metav1.ListOptions{LabelSelector: selector}
+}
+
+// generatedFrom - check if the generated object was derived from the domain, by its domain label or else by
+// its owner, so that the objects of the other domains mapped to the namespace are never pruned
+func generatedFrom(meta metav1.ObjectMeta, domain string) bool {
+	if value, ok := meta.Labels[DomainLabel]; ok {
+		return value == domain
+	}
+	for _, owner := range meta.OwnerReferences {
+		if owner.Kind == "AthenzDomain" && owner.Name == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileRoles - apply the desired Roles in the namespace and delete the other Roles generated from the domain
+func (r *Reconciler) reconcileRoles(ctx context.Context, namespace, domain string, owner metav1.OwnerReference, desired []*rbacv1.Role) error {
+	client := r.k8sClient.RbacV1().Roles(namespace)
+	list, err := client.List(ctx, managedSelector(domain))
+	if err != nil {
+		return fmt.Errorf("Unable to list Roles in namespace %s. Error: %v", namespace, err)
+	}
+	existing := map[string]*rbacv1.Role{}
+	for i := range list.Items {
+		if generatedFrom(list.Items[i].ObjectMeta, domain) {
+			existing[list.Items[i].Name] = &list.Items[i]
+		}
+	}
+	errs := []error{}
+	for _, role := range desired {
+		role = role.DeepCopy()
+		role.Namespace = namespace
+		role.OwnerReferences = []metav1.OwnerReference{owner}
+		current, ok := existing[role.Name]
+		delete(existing, role.Name)
+		if !ok {
+			if _, err := client.Create(ctx, role, metav1.CreateOptions{}); err != nil {
+				errs = append(errs, fmt.Errorf("Unable to create Role %s/%s. Error: %v", namespace, role.Name, err))
+			}
+			continue
+		}
+		if reflect.DeepEqual(current.Rules, role.Rules) && metaEqual(current.ObjectMeta, role.ObjectMeta) {
+			continue
+		}
+		role.ResourceVersion = current.ResourceVersion
+		if _, err := client.Update(ctx, role, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to update Role %s/%s. Error: %v", namespace, role.Name, err))
+		}
+	}
+	for name := range existing {
+		if err := client.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apiError.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("Unable to delete Role %s/%s. Error: %v", namespace, name, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// reconcileRoleBindings - apply the desired RoleBindings in the namespace and delete the other RoleBindings
+// generated from the domain
+func (r *Reconciler) reconcileRoleBindings(ctx context.Context, namespace, domain string, owner metav1.OwnerReference, desired []*rbacv1.RoleBinding) error {
+	client := r.k8sClient.RbacV1().RoleBindings(namespace)
+	list, err := client.List(ctx, managedSelector(domain))
+	if err != nil {
+		return fmt.Errorf("Unable to list RoleBindings in namespace %s. Error: %v", namespace, err)
+	}
+	existing := map[string]*rbacv1.RoleBinding{}
+	for i := range list.Items {
+		if generatedFrom(list.Items[i].ObjectMeta, domain) {
+			existing[list.Items[i].Name] = &list.Items[i]
+		}
+	}
+	errs := []error{}
+	for _, binding := range desired {
+		binding = binding.DeepCopy()
+		binding.Namespace = namespace
+		binding.OwnerReferences = []metav1.OwnerReference{owner}
+		current, ok := existing[binding.Name]
+		delete(existing, binding.Name)
+		if !ok {
+			if _, err := client.Create(ctx, binding, metav1.CreateOptions{}); err != nil {
+				errs = append(errs, fmt.Errorf("Unable to create RoleBinding %s/%s. Error: %v", namespace, binding.Name, err))
+			}
+			continue
+		}
+		if reflect.DeepEqual(current.Subjects, binding.Subjects) && current.RoleRef == binding.RoleRef && metaEqual(current.ObjectMeta, binding.ObjectMeta) {
+			continue
+		}
+		// the role reference is immutable, it never changes as the binding is named after its role
+		binding.ResourceVersion = current.ResourceVersion
+		if _, err := client.Update(ctx, binding, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to update RoleBinding %s/%s. Error: %v", namespace, binding.Name, err))
+		}
+	}
+	for name := range existing {
+		if err := client.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apiError.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("Unable to delete RoleBinding %s/%s. Error: %v", namespace, name, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// metaEqual - check if the metadata set by the reconciler is unchanged
+func metaEqual(current, desired metav1.ObjectMeta) bool {
+	return reflect.DeepEqual(current.Labels, desired.Labels) &&
+		reflect.DeepEqual(current.Annotations, desired.Annotations) &&
+		reflect.DeepEqual(current.OwnerReferences, desired.OwnerReferences)
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rbac
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	athenz_domain "github.com/AthenZ/k8s-athenz-syncer/pkg/apis/athenz/v1"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/cr"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/ardielle/ardielle-go/rdl"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+const domainName = "home.domain"
+
+func init() {
+	log.InitLogger("/tmp/log/test.log", "info")
+}
+
+// getDomainData - domain granting the admin role all resources and the reader role read access to pods
+func getDomainData(now time.Time) *zms.DomainData {
+	allow := zms.ALLOW
+	deny := zms.DENY
+	expired := rdl.Timestamp{Time: now.Add(-time.Hour)}
+	return &zms.DomainData{
+		Name: domainName,
+		Roles: []*zms.Role{
+			{
+				Name: domainName + ":role.admin",
+				RoleMembers: []*zms.RoleMember{
+					{MemberName: "user.jane"},
+					{MemberName: "user.expired", Expiration: &expired},
+					{MemberName: "home.domain:group.ops"},
+				},
+			},
+			{
+				Name:    domainName + ":role.reader",
+				Members: []zms.MemberName{"user.joe", "user.*"},
+			},
+		},
+		Policies: &zms.SignedPolicies{
+			Contents: &zms.DomainPolicies{
+				Domain: domainName,
+				Policies: []*zms.Policy{
+					{
+						Name: domainName + ":policy.admin",
+						Assertions: []*zms.Assertion{
+							{Role: domainName + ":role.admin", Resource: domainName + ":*:*", Action: "*", Effect: &allow},
+							// not a k8s resource
+							{Role: domainName + ":role.admin", Resource: domainName + ":service.api", Action: "read", Effect: &allow},
+						},
+					},
+					{
+						Name: domainName + ":policy.reader",
+						Assertions: []*zms.Assertion{
+							{Role: domainName + ":role.reader", Resource: domainName + ":get:pods", Action: "*", Effect: &allow},
+							{Role: domainName + ":role.reader", Resource: domainName + ":list:deployments.apps/scale", Action: "*", Effect: &allow},
+							{Role: domainName + ":role.reader", Resource: domainName + ":delete:pods", Action: "*", Effect: &deny},
+							// resource of another domain
+							{Role: domainName + ":role.reader", Resource: "other.domain:get:pods", Action: "*", Effect: &allow},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestParseGrammar(t *testing.T) {
+	tests := []struct {
+		grammar string
+		valid   bool
+		verb    bool
+	}{
+		{grammar: DefaultGrammar, valid: true, verb: true},
+		{grammar: "{domain}:k8s.{resource}", valid: true},
+		{grammar: "{domain}:{resource}:{verb}:{resource}"},
+		{grammar: "{verb}:{resource}"},
+		{grammar: "{domain}:{verb}"},
+		{grammar: "{domain}:{group}:{resource}"},
+	}
+	for _, test := range tests {
+		t.Run(test.grammar, func(t *testing.T) {
+			g, err := ParseGrammar(test.grammar)
+			if !test.valid {
+				if err == nil {
+					t.Error("Expected an error parsing the grammar")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g.verb != test.verb {
+				t.Errorf("Expected verb placeholder %t, got %t", test.verb, g.verb)
+			}
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	now := time.Now()
+	g, err := ParseGrammar(DefaultGrammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles, bindings := g.Generate(getDomainData(now), now)
+	if len(roles) != 2 || len(bindings) != 2 {
+		t.Fatalf("Expected a Role and a RoleBinding per policy, got %d and %d", len(roles), len(bindings))
+	}
+
+	admin := roles[0]
+	if admin.Name != "athenz:admin:admin" {
+		t.Errorf("Expected Role named after the policy and the role, got %s", admin.Name)
+	}
+	expectedRules := []rbacv1.PolicyRule{{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}}}
+	if !reflect.DeepEqual(admin.Rules, expectedRules) {
+		t.Errorf("Expected rules %v, got %v", expectedRules, admin.Rules)
+	}
+	expectedLabels := map[string]string{cr.ManagedByLabel: cr.ManagedByValue, DomainLabel: domainName, PolicyLabel: "admin", RoleLabel: "admin"}
+	if !reflect.DeepEqual(admin.Labels, expectedLabels) || admin.Annotations[PolicyAnnotation] != domainName+":policy.admin" {
+		t.Errorf("Expected labels back to the source policy, got %v and %v", admin.Labels, admin.Annotations)
+	}
+	expectedSubjects := []rbacv1.Subject{
+		{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "home.domain:group.ops"},
+		{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "user.jane"},
+	}
+	if !reflect.DeepEqual(bindings[0].Subjects, expectedSubjects) {
+		t.Errorf("Expected subjects %v, got %v", expectedSubjects, bindings[0].Subjects)
+	}
+	if bindings[0].RoleRef.Name != admin.Name || bindings[0].RoleRef.Kind != "Role" {
+		t.Errorf("RoleBinding should reference its Role, got %v", bindings[0].RoleRef)
+	}
+
+	reader := roles[1]
+	expectedRules = []rbacv1.PolicyRule{
+		{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+		{Verbs: []string{"list"}, APIGroups: []string{"apps"}, Resources: []string{"deployments/scale"}},
+	}
+	if !reflect.DeepEqual(reader.Rules, expectedRules) {
+		t.Errorf("Expected rules %v, got %v", expectedRules, reader.Rules)
+	}
+	expectedSubjects = []rbacv1.Subject{{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "user.joe"}}
+	if !reflect.DeepEqual(bindings[1].Subjects, expectedSubjects) {
+		t.Errorf("Expected subjects %v, got %v", expectedSubjects, bindings[1].Subjects)
+	}
+
+	// the verb is taken from the action when the grammar has no verb placeholder
+	g, err = ParseGrammar("{domain}:k8s.{resource}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := getDomainData(now)
+	data.Policies.Contents.Policies[0].Assertions[0].Resource = domainName + ":k8s.secrets"
+	data.Policies.Contents.Policies[0].Assertions[0].Action = "GET"
+	roles, _ = g.Generate(data, now)
+	expectedRules = []rbacv1.PolicyRule{{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"secrets"}}}
+	if len(roles) != 1 || !reflect.DeepEqual(roles[0].Rules, expectedRules) {
+		t.Errorf("Expected the action as verb, got %v", roles)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	k8sClient := k8sfake.NewSimpleClientset()
+	r, err := NewReconciler(k8sClient, DefaultGrammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &athenz_domain.AthenzDomain{
+		ObjectMeta: metav1.ObjectMeta{Name: domainName, UID: "uid"},
+		Spec: athenz_domain.AthenzDomainSpec{
+			SignedDomain: zms.SignedDomain{Domain: getDomainData(now)},
+		},
+	}
+	// generated object left behind by a removed policy, an object generated from another domain mapped to the
+	// namespace and an object not managed by the syncer
+	stale := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{
+		Name:      "athenz:removed:admin",
+		Namespace: "home-domain",
+		Labels:    map[string]string{cr.ManagedByLabel: cr.ManagedByValue, DomainLabel: domainName},
+	}}
+	other := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{
+		Name:      "athenz:other:admin",
+		Namespace: "home-domain",
+		Labels:    map[string]string{cr.ManagedByLabel: cr.ManagedByValue, DomainLabel: "other.domain"},
+	}}
+	unmanaged := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: "custom", Namespace: "home-domain"}}
+	for _, role := range []*rbacv1.Role{stale, other, unmanaged} {
+		if _, err := k8sClient.RbacV1().Roles("home-domain").Create(context.TODO(), role, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.Reconcile(context.TODO(), obj, []string{"home-domain"}); err != nil {
+		t.Fatal(err)
+	}
+	roles, err := k8sClient.RbacV1().Roles("home-domain").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, role := range roles.Items {
+		names = append(names, role.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"athenz:admin:admin", "athenz:other:admin", "athenz:reader:reader", "custom"}) {
+		t.Errorf("Expected the generated Roles, the Role of the other domain and the unmanaged Role, got %v", names)
+	}
+	binding, err := k8sClient.RbacV1().RoleBindings("home-domain").Get(context.TODO(), "athenz:admin:admin", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(binding.OwnerReferences) != 1 || binding.OwnerReferences[0].UID != "uid" || binding.OwnerReferences[0].Kind != "AthenzDomain" {
+		t.Errorf("Generated objects should be owned by the AthenzDomain CR, got %v", binding.OwnerReferences)
+	}
+
+	// removing the reader role member updates its binding, removing the admin policy deletes its objects
+	obj.Spec.Domain.Roles[1].Members = nil
+	obj.Spec.Domain.Policies.Contents.Policies = obj.Spec.Domain.Policies.Contents.Policies[1:]
+	if err := r.Reconcile(context.TODO(), obj, []string{"home-domain"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k8sClient.RbacV1().RoleBindings("home-domain").Get(context.TODO(), "athenz:admin:admin", metav1.GetOptions{}); err == nil {
+		t.Error("RoleBinding of a removed policy should be deleted")
+	}
+	binding, err = k8sClient.RbacV1().RoleBindings("home-domain").Get(context.TODO(), "athenz:reader:reader", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(binding.Subjects) != 0 {
+		t.Errorf("Expected the RoleBinding subjects to be updated, got %v", binding.Subjects)
+	}
+}
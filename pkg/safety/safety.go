@@ -0,0 +1,235 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package safety
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/metrics"
+)
+
+// Config - settings of the Guard
+type Config struct {
+	// GraceChecks - consecutive checks a domain must be missing from ZMS before its CR is deleted
+	GraceChecks int
+	// GraceInterval - minimum time between two checks counted towards GraceChecks
+	GraceInterval time.Duration
+	// MaxDeletions - CR deletions allowed per DeletionInterval, 0 for no limit
+	MaxDeletions     int
+	DeletionInterval time.Duration
+	// BreakerThreshold - ratio of missing domains in the ZMS responses of the BreakerWindow above which
+	// the breaker opens and stops all deletions, 0 disables the breaker
+	BreakerThreshold float64
+	// BreakerMinRequests - ZMS responses needed in the window before the breaker may open
+	BreakerMinRequests int
+	// BreakerWindow - window of the ZMS responses the ratio is computed over, and the minimum time the
+	// breaker stays open
+	BreakerWindow time.Duration
+}
+
+// DeferredError - error returned for a deletion of an AthenzDomain CR held back by the Guard
+type DeferredError struct {
+	Domain string
+	// Reason - metrics.DeferBreaker, metrics.DeferGrace or metrics.DeferBudget
+	Reason     string
+	Message    string
+	RetryAfter time.Duration
+}
+
+// Error - implement the error interface
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("Deletion of AthenzDomain %s deferred: %s", e.Domain, e.Message)
+}
+
+// observation - a ZMS response returning or missing a domain
+type observation struct {
+	time    time.Time
+	missing bool
+}
+
+// missingDomain - checks of a domain missing from ZMS
+type missingDomain struct {
+	checks int
+	last   time.Time
+}
+
+// Guard - keeps a ZMS incident from deleting the AthenzDomain CRs of the cluster. A circuit breaker stops
+// all deletions while ZMS reports too many domains missing, a domain must be missing on several
+// consecutive checks before its CR is deleted, and the deletions are limited to a budget per interval.
+// A nil Guard allows all deletions.
+type Guard struct {
+	config       Config
+	lock         sync.Mutex
+	observations []observation
+	openUntil    time.Time
+	missing      map[string]*missingDomain
+	deletions    []time.Time
+	now          func() time.Time
+}
+
+// NewGuard - create a guard with the given settings
+func NewGuard(config Config) *Guard {
+	if config.GraceChecks < 1 {
+		config.GraceChecks = 1
+	}
+	return &Guard{
+		config:  config,
+		missing: map[string]*missingDomain{},
+		now:     time.Now,
+	}
+}
+
+// Found - record a ZMS response returning the domain, which resets its missing checks
+func (g *Guard) Found(domain string) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.observe(g.now(), false)
+	delete(g.missing, domain)
+}
+
+// Missing - record a ZMS response reporting the domain missing, by a 404 or an empty response, and
+// return a DeferredError unless its CR may be deleted. Checks within the grace interval of the
+// previous one are not counted, nor are checks while the breaker is open.
+func (g *Guard) Missing(domain string) error {
+	if g == nil {
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := g.now()
+	g.observe(now, true)
+	if err := g.breakerError(domain, now); err != nil {
+		return err
+	}
+	state, ok := g.missing[domain]
+	if !ok {
+		state = &missingDomain{}
+		g.missing[domain] = state
+	}
+	if state.checks == 0 || now.Sub(state.last) >= g.config.GraceInterval {
+		state.checks++
+		state.last = now
+	}
+	if state.checks < g.config.GraceChecks {
+		return &DeferredError{
+			Domain:     domain,
+			Reason:     metrics.DeferGrace,
+			Message:    fmt.Sprintf("domain was missing on %d of %d consecutive checks", state.checks, g.config.GraceChecks),
+			RetryAfter: g.config.GraceInterval - now.Sub(state.last),
+		}
+	}
+	return nil
+}
+
+// Delete - take a deletion of the domain CR from the budget, a DeferredError is returned while the
+// breaker is open or when the budget of the interval is used up
+func (g *Guard) Delete(domain string) error {
+	if g == nil {
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := g.now()
+	if err := g.breakerError(domain, now); err != nil {
+		return err
+	}
+	if g.config.MaxDeletions > 0 {
+		start := now.Add(-g.config.DeletionInterval)
+		i := 0
+		for i < len(g.deletions) && !g.deletions[i].After(start) {
+			i++
+		}
+		g.deletions = g.deletions[i:]
+		if len(g.deletions) >= g.config.MaxDeletions {
+			return &DeferredError{
+				Domain:     domain,
+				Reason:     metrics.DeferBudget,
+				Message:    fmt.Sprintf("%d AthenzDomain CRs were already deleted in the last %s", len(g.deletions), g.config.DeletionInterval),
+				RetryAfter: g.deletions[0].Sub(start),
+			}
+		}
+		g.deletions = append(g.deletions, now)
+	}
+	delete(g.missing, domain)
+	return nil
+}
+
+// Open - check if the breaker currently stops all deletions
+func (g *Guard) Open() bool {
+	if g == nil {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.now().Before(g.openUntil)
+}
+
+// breakerError - DeferredError of a deletion while the breaker is open, nil when it is closed
+func (g *Guard) breakerError(domain string, now time.Time) error {
+	if !now.Before(g.openUntil) {
+		return nil
+	}
+	return &DeferredError{
+		Domain:     domain,
+		Reason:     metrics.DeferBreaker,
+		Message:    "ZMS reports too many domains missing, all deletions are stopped",
+		RetryAfter: g.openUntil.Sub(now),
+	}
+}
+
+// observe - add a ZMS response to the breaker window and open the breaker when the ratio of missing
+// domains exceeds the threshold. The missing checks recorded so far are dropped when it opens as they
+// may be part of the incident.
+func (g *Guard) observe(now time.Time, missing bool) {
+	if g.config.BreakerThreshold <= 0 {
+		return
+	}
+	start := now.Add(-g.config.BreakerWindow)
+	i := 0
+	for i < len(g.observations) && !g.observations[i].time.After(start) {
+		i++
+	}
+	g.observations = append(g.observations[i:], observation{time: now, missing: missing})
+	wasOpen := now.Before(g.openUntil)
+	if !wasOpen {
+		metrics.SetBreakerOpen(false)
+	}
+	if len(g.observations) < g.config.BreakerMinRequests {
+		return
+	}
+	count := 0
+	for _, o := range g.observations {
+		if o.missing {
+			count++
+		}
+	}
+	ratio := float64(count) / float64(len(g.observations))
+	if ratio < g.config.BreakerThreshold {
+		return
+	}
+	g.openUntil = now.Add(g.config.BreakerWindow)
+	if !wasOpen {
+		log.Warnf("ZMS reported %d of the last %d domains missing, stopping all AthenzDomain CR deletions for %s", count, len(g.observations), g.config.BreakerWindow)
+		metrics.SetBreakerOpen(true)
+		g.missing = map[string]*missingDomain{}
+	}
+}
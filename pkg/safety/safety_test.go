@@ -0,0 +1,135 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package safety
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/metrics"
+)
+
+// newTestGuard - guard with a clock advanced by the tests
+func newTestGuard(config Config) (*Guard, *time.Time) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := NewGuard(config)
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+// deferReason - reason of the deferred error, empty when the error is nil
+func deferReason(t *testing.T, err error) string {
+	if err == nil {
+		return ""
+	}
+	deferred, ok := err.(*DeferredError)
+	if !ok {
+		t.Fatalf("Expected a DeferredError, got %v", err)
+	}
+	return deferred.Reason
+}
+
+func TestGracePeriod(t *testing.T) {
+	g, now := newTestGuard(Config{GraceChecks: 3, GraceInterval: time.Minute})
+	if reason := deferReason(t, g.Missing("home.domain")); reason != metrics.DeferGrace {
+		t.Errorf("Expected the first check to be deferred by the grace period, got %q", reason)
+	}
+	// checks within the grace interval are not counted
+	*now = now.Add(10 * time.Second)
+	err := g.Missing("home.domain")
+	if deferReason(t, err) != metrics.DeferGrace || err.(*DeferredError).RetryAfter != 50*time.Second {
+		t.Errorf("Expected the check to be retried after the rest of the grace interval, got %v", err)
+	}
+	*now = now.Add(time.Minute)
+	if reason := deferReason(t, g.Missing("home.domain")); reason != metrics.DeferGrace {
+		t.Errorf("Expected the second check to be deferred by the grace period, got %q", reason)
+	}
+	// a domain found again starts over
+	g.Found("home.domain")
+	*now = now.Add(time.Minute)
+	if reason := deferReason(t, g.Missing("home.domain")); reason != metrics.DeferGrace {
+		t.Errorf("Expected the checks to start over once the domain was found, got %q", reason)
+	}
+	for i := 0; i < 2; i++ {
+		*now = now.Add(time.Minute)
+		g.Missing("home.domain")
+	}
+	if err := g.Missing("home.domain"); err != nil {
+		t.Errorf("Expected the deletion to be allowed after 3 checks. Error: %v", err)
+	}
+}
+
+func TestDeletionBudget(t *testing.T) {
+	g, now := newTestGuard(Config{MaxDeletions: 2, DeletionInterval: 10 * time.Minute})
+	for i := 0; i < 2; i++ {
+		if err := g.Delete(fmt.Sprintf("domain%d", i)); err != nil {
+			t.Fatalf("Expected deletion %d to be allowed. Error: %v", i, err)
+		}
+		*now = now.Add(time.Minute)
+	}
+	err := g.Delete("domain2")
+	if deferReason(t, err) != metrics.DeferBudget || err.(*DeferredError).RetryAfter != 8*time.Minute {
+		t.Errorf("Expected the deletion to wait 8m for the budget, got %v", err)
+	}
+	*now = now.Add(8 * time.Minute)
+	if err := g.Delete("domain2"); err != nil {
+		t.Errorf("Expected the deletion to be allowed once the first one left the interval. Error: %v", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	g, now := newTestGuard(Config{GraceChecks: 1, BreakerThreshold: 0.5, BreakerMinRequests: 4, BreakerWindow: 5 * time.Minute})
+	g.Found("domain0")
+	g.Found("domain1")
+	if err := g.Missing("domain2"); err != nil {
+		t.Errorf("Expected no deferral below the minimum number of requests. Error: %v", err)
+	}
+	if reason := deferReason(t, g.Missing("domain3")); reason != metrics.DeferBreaker {
+		t.Errorf("Expected the breaker to open at half of the domains missing, got %q", reason)
+	}
+	if !g.Open() {
+		t.Error("Expected the breaker to be open")
+	}
+	if reason := deferReason(t, g.Delete("domain4")); reason != metrics.DeferBreaker {
+		t.Errorf("Expected the breaker to stop the deletions of all domains, got %q", reason)
+	}
+	// the breaker stays open for the window after the last response over the threshold
+	*now = now.Add(4 * time.Minute)
+	for i := 0; i < 4; i++ {
+		g.Found(fmt.Sprintf("domain%d", i))
+	}
+	if reason := deferReason(t, g.Missing("domain2")); reason != metrics.DeferBreaker {
+		t.Errorf("Expected the breaker to stay open for the window, got %q", reason)
+	}
+	*now = now.Add(2 * time.Minute)
+	if err := g.Missing("domain2"); err != nil {
+		t.Errorf("Expected the breaker to close after the window. Error: %v", err)
+	}
+	if g.Open() {
+		t.Error("Expected the breaker to be closed")
+	}
+}
+
+func TestNilGuard(t *testing.T) {
+	var g *Guard
+	g.Found("home.domain")
+	if g.Missing("home.domain") != nil || g.Delete("home.domain") != nil || g.Open() {
+		t.Error("A nil guard should allow all deletions")
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// DomainAnnotation - namespace annotation declaring the Athenz domain of the namespace, it overrides
+	// the domain derived from the namespace name
+	DomainAnnotation = "athenz.io/domain"
+	// DomainIndexKey - namespace informer index of the domains declared with the domain annotation
+	DomainIndexKey = "athenzDomain"
+)
+
+// DomainIndexFunc - index namespaces by the domain declared in their domain annotation
+func DomainIndexFunc(obj interface{}) ([]string, error) {
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("Error occurred when casting object into namespace")
+	}
+	if domain := namespace.Annotations[DomainAnnotation]; domain != "" {
+		return []string{domain}, nil
+	}
+	return []string{}, nil
+}
+
+// GetNamespaceDomain - get the domain of the namespace from its domain annotation, or from its name
+// when it is not annotated
+func (u *Util) GetNamespaceDomain(namespace *corev1.Namespace) string {
+	if domain := namespace.Annotations[DomainAnnotation]; domain != "" {
+		return domain
+	}
+	return u.NamespaceToDomain(namespace.Name)
+}
+
+// GetDomainNamespaces - get the sorted names of the synced namespaces mapped to the domain from the namespace
+// informer indexer. The indexer must have the DomainIndexKey index. More than one namespace means that
+// the namespaces conflict over the domain.
+func (u *Util) GetDomainNamespaces(indexer cache.Indexer, domain string) ([]string, error) {
+	namespaces := []string{}
+	annotated, err := indexer.ByIndex(DomainIndexKey, domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range annotated {
+		if namespace, ok := item.(*corev1.Namespace); ok && u.IsNamespaceSynced(namespace) {
+			namespaces = append(namespaces, namespace.Name)
+		}
+	}
+	// the namespace named after the domain is not mapped to it when annotated with another domain
+	item, exists, err := indexer.GetByKey(u.DomainToNamespace(domain))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		namespace, ok := item.(*corev1.Namespace)
+		if ok && namespace.Annotations[DomainAnnotation] == "" && u.NamespaceToDomain(namespace.Name) == domain && u.IsNamespaceSynced(namespace) {
+			namespaces = append(namespaces, namespace.Name)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// NamespaceFilter - selects the namespaces to sync by their labels and names, unset fields match all namespaces
+type NamespaceFilter struct {
+	// IncludeSelector - only namespaces with matching labels are synced
+	IncludeSelector labels.Selector
+	// ExcludeSelector - namespaces with matching labels are not synced
+	ExcludeSelector labels.Selector
+	// IncludeRegex - only namespaces with a matching name are synced
+	IncludeRegex *regexp.Regexp
+	// ExcludeRegex - namespaces with a matching name are not synced
+	ExcludeRegex *regexp.Regexp
+}
+
+// NewNamespaceFilter - parse the label selectors and the name regexes of a namespace filter, empty
+// values are left unset. The regexes must match the whole namespace name.
+func NewNamespaceFilter(includeSelector, excludeSelector, includeRegex, excludeRegex string) (*NamespaceFilter, error) {
+	filter := &NamespaceFilter{}
+	var err error
+	if includeSelector != "" {
+		if filter.IncludeSelector, err = labels.Parse(includeSelector); err != nil {
+			return nil, fmt.Errorf("Invalid include namespace selector %q. Error: %v", includeSelector, err)
+		}
+	}
+	if excludeSelector != "" {
+		if filter.ExcludeSelector, err = labels.Parse(excludeSelector); err != nil {
+			return nil, fmt.Errorf("Invalid exclude namespace selector %q. Error: %v", excludeSelector, err)
+		}
+	}
+	if includeRegex != "" {
+		if filter.IncludeRegex, err = regexp.Compile("^(?:" + includeRegex + ")$"); err != nil {
+			return nil, fmt.Errorf("Invalid include namespace regex %q. Error: %v", includeRegex, err)
+		}
+	}
+	if excludeRegex != "" {
+		if filter.ExcludeRegex, err = regexp.Compile("^(?:" + excludeRegex + ")$"); err != nil {
+			return nil, fmt.Errorf("Invalid exclude namespace regex %q. Error: %v", excludeRegex, err)
+		}
+	}
+	return filter, nil
+}
+
+// matches - check the namespace labels and name against the filter
+func (f *NamespaceFilter) matches(namespace *corev1.Namespace) bool {
+	nsLabels := labels.Set(namespace.Labels)
+	if f.IncludeSelector != nil && !f.IncludeSelector.Matches(nsLabels) {
+		return false
+	}
+	if f.ExcludeSelector != nil && f.ExcludeSelector.Matches(nsLabels) {
+		return false
+	}
+	if f.IncludeRegex != nil && !f.IncludeRegex.MatchString(namespace.Name) {
+		return false
+	}
+	if f.ExcludeRegex != nil && f.ExcludeRegex.MatchString(namespace.Name) {
+		return false
+	}
+	return true
+}
+
+// SetNamespaceFilter - replace the filter selecting the namespaces to sync, nil syncs all namespaces
+func (u *Util) SetNamespaceFilter(filter *NamespaceFilter) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.namespaceFilter = filter
+}
+
+// IsNamespaceSynced - check if the namespace is synced. System namespaces are always synced, other
+// namespaces must not be excluded and must match the namespace filter.
+func (u *Util) IsNamespaceSynced(namespace *corev1.Namespace) bool {
+	if u.isSystemNamespace(namespace.Name) {
+		return true
+	}
+	if u.IsNamespaceExcluded(namespace.Name) {
+		return false
+	}
+	u.lock.RLock()
+	filter := u.namespaceFilter
+	u.lock.RUnlock()
+	return filter == nil || filter.matches(namespace)
+}
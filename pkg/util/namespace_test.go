@@ -0,0 +1,171 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newNamespace(name, domain string) *corev1.Namespace {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if domain != "" {
+		namespace.Annotations = map[string]string{DomainAnnotation: domain}
+	}
+	return namespace
+}
+
+func TestGetNamespaceDomain(t *testing.T) {
+	u := newUtil()
+	if domain := u.GetNamespaceDomain(newNamespace("team-prod", "")); domain != "team.prod" {
+		t.Errorf("Expected domain derived from the namespace name, got %s", domain)
+	}
+	if domain := u.GetNamespaceDomain(newNamespace("kube-system", "")); domain != "admin.domain.kube-system" {
+		t.Errorf("Expected system domain, got %s", domain)
+	}
+	if domain := u.GetNamespaceDomain(newNamespace("payments", "corp.payments-team")); domain != "corp.payments-team" {
+		t.Errorf("Expected domain from the annotation, got %s", domain)
+	}
+}
+
+func TestGetDomainNamespaces(t *testing.T) {
+	u := newUtil()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{DomainIndexKey: DomainIndexFunc})
+	indexer.Add(newNamespace("team-prod", ""))
+	indexer.Add(newNamespace("payments", "corp.payments-team"))
+	indexer.Add(newNamespace("home-domain", "home.other"))
+	indexer.Add(newNamespace("team-dev", "team.prod"))
+	indexer.Add(newNamespace("kube-system", ""))
+
+	tests := []struct {
+		domain   string
+		expected []string
+	}{
+		{domain: "corp.payments-team", expected: []string{"payments"}},
+		{domain: "home.other", expected: []string{"home-domain"}},
+		// the namespace named after the domain is annotated with another domain
+		{domain: "home.domain", expected: []string{}},
+		// conflict between a namespace named after the domain and an annotated namespace
+		{domain: "team.prod", expected: []string{"team-dev", "team-prod"}},
+		{domain: "admin.domain.kube-system", expected: []string{"kube-system"}},
+		{domain: "team.missing", expected: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.domain, func(t *testing.T) {
+			namespaces, err := u.GetDomainNamespaces(indexer, test.domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(namespaces, test.expected) {
+				t.Errorf("Expected namespaces %v, got %v", test.expected, namespaces)
+			}
+		})
+	}
+
+	if _, err := u.GetDomainNamespaces(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}), "team.prod"); err == nil {
+		t.Error("Expected an error without the domain index")
+	}
+}
+
+func TestNewNamespaceFilter(t *testing.T) {
+	filter, err := NewNamespaceFilter("athenz.io/sync=true", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.IncludeSelector == nil || filter.ExcludeSelector != nil || filter.IncludeRegex != nil || filter.ExcludeRegex != nil {
+		t.Errorf("Only the include selector should be set, got %+v", filter)
+	}
+
+	tests := []struct {
+		name            string
+		includeSelector string
+		excludeSelector string
+		includeRegex    string
+		excludeRegex    string
+	}{
+		{name: "invalid include selector", includeSelector: "athenz.io/sync in true"},
+		{name: "invalid exclude selector", excludeSelector: "env in (dev"},
+		{name: "invalid include regex", includeRegex: "team-("},
+		{name: "invalid exclude regex", excludeRegex: "*-test"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewNamespaceFilter(test.includeSelector, test.excludeSelector, test.includeRegex, test.excludeRegex); err == nil {
+				t.Error("Expected an error parsing the namespace filter")
+			}
+		})
+	}
+}
+
+func TestIsNamespaceSynced(t *testing.T) {
+	u := newUtil()
+	labeled := func(name string, labels map[string]string) *corev1.Namespace {
+		namespace := newNamespace(name, "")
+		namespace.Labels = labels
+		return namespace
+	}
+	optIn := map[string]string{"athenz.io/sync": "true"}
+	optInDev := map[string]string{"athenz.io/sync": "true", "env": "dev"}
+
+	if !u.IsNamespaceSynced(labeled("team-prod", nil)) {
+		t.Error("All namespaces should be synced without a namespace filter")
+	}
+	if u.IsNamespaceSynced(labeled("acceptance-test", optIn)) {
+		t.Error("Excluded namespaces should not be synced")
+	}
+
+	filter, err := NewNamespaceFilter("athenz.io/sync=true", "env=dev", "team-.*|kube-public", "team-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SetNamespaceFilter(filter)
+	tests := []struct {
+		namespace *corev1.Namespace
+		synced    bool
+	}{
+		{namespace: labeled("team-prod", optIn), synced: true},
+		{namespace: labeled("team-prod", nil), synced: false},
+		{namespace: labeled("team-dev", optInDev), synced: false},
+		{namespace: labeled("payments", optIn), synced: false},
+		// the regex must match the whole name
+		{namespace: labeled("my-team-prod", optIn), synced: false},
+		{namespace: labeled("team-sandbox", optIn), synced: false},
+		{namespace: labeled("acceptance-test", optIn), synced: false},
+		// system namespaces are always synced
+		{namespace: labeled("kube-system", nil), synced: true},
+	}
+	for _, test := range tests {
+		t.Run(test.namespace.Name, func(t *testing.T) {
+			if synced := u.IsNamespaceSynced(test.namespace); synced != test.synced {
+				t.Errorf("Expected synced %t for namespace %s with labels %v, got %t", test.synced, test.namespace.Name, test.namespace.Labels, synced)
+			}
+		})
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{DomainIndexKey: DomainIndexFunc})
+	indexer.Add(labeled("team-prod", nil))
+	if namespaces, _ := u.GetDomainNamespaces(indexer, "team.prod"); len(namespaces) != 0 {
+		t.Errorf("Namespaces not synced should not be mapped to the domain, got %v", namespaces)
+	}
+	u.SetNamespaceFilter(nil)
+	if namespaces, _ := u.GetDomainNamespaces(indexer, "team.prod"); !reflect.DeepEqual(namespaces, []string{"team-prod"}) {
+		t.Errorf("Expected namespace mapped to the domain once the filter is removed, got %v", namespaces)
+	}
+}
@@ -19,31 +19,49 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/AthenZ/athenz/clients/go/zms"
 )
 
 // Util - struct with 2 fields adminDomain and list of system namespaces
 type Util struct {
-	adminDomain       string
+	adminDomain string
+	// lock guards the settings below which can be reloaded while running
+	lock              sync.RWMutex
 	systemNamespaces  []string
 	excludeNamespaces map[string]bool
 	excludeMSDRules   bool
+	namespaceFilter   *NamespaceFilter
 }
 
 // NewUtil - create new Util object
 func NewUtil(adminDomain string, systemNamespaces []string, excludeNamespaces []string, excludeMSDRules bool) *Util {
+	u := &Util{
+		adminDomain: adminDomain,
+	}
+	u.Reload(systemNamespaces, excludeNamespaces, excludeMSDRules)
+	return u
+}
+
+// Reload - replace the system namespaces, the excluded namespaces and the MSD filtering setting
+func (u *Util) Reload(systemNamespaces []string, excludeNamespaces []string, excludeMSDRules bool) {
 	excludedNamespaceMap := make(map[string]bool)
 	for _, ns := range excludeNamespaces {
 		excludedNamespaceMap[ns] = true
 	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.systemNamespaces = append([]string{}, systemNamespaces...)
+	u.excludeNamespaces = excludedNamespaceMap
+	u.excludeMSDRules = excludeMSDRules
+}
 
-	return &Util{
-		adminDomain:       adminDomain,
-		systemNamespaces:  systemNamespaces,
-		excludeNamespaces: excludedNamespaceMap,
-		excludeMSDRules:   excludeMSDRules,
-	}
+// getSystemNamespaces - get the current list of system namespaces
+func (u *Util) getSystemNamespaces() []string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.systemNamespaces
 }
 
 // DomainToNamespace will convert an athenz domain to a kubernetes namespace. Dots are converted to dashes
@@ -70,7 +88,7 @@ func (u *Util) NamespaceToDomain(ns string) (domain string) {
 
 // isSystemNamespace - check if the current namespace is a system namespace
 func (u *Util) isSystemNamespace(ns string) bool {
-	for _, v := range u.systemNamespaces {
+	for _, v := range u.getSystemNamespaces() {
 		if ns == v {
 			return true
 		}
@@ -80,7 +98,7 @@ func (u *Util) isSystemNamespace(ns string) bool {
 
 // IsSystemDomain - check if the current domain is a system domain
 func (u *Util) IsSystemDomain(domain string) bool {
-	for _, ns := range u.systemNamespaces {
+	for _, ns := range u.getSystemNamespaces() {
 		sysDomain := u.NamespaceToDomain(ns)
 		if domain == sysDomain {
 			return true
@@ -91,6 +109,8 @@ func (u *Util) IsSystemDomain(domain string) bool {
 
 // IsNamespaceExcluded - check if the current namespace is in the skip namespaces list
 func (u *Util) IsNamespaceExcluded(ns string) bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
 	if _, ok := u.excludeNamespaces[ns]; ok {
 		return true
 	}
@@ -113,7 +133,7 @@ func (u *Util) GetAdminDomain() string {
 // GetSystemNSDomains - getter func for system ns
 func (u *Util) GetSystemNSDomains() []string {
 	domains := []string{}
-	for _, ns := range u.systemNamespaces {
+	for _, ns := range u.getSystemNamespaces() {
 		domain := u.NamespaceToDomain(ns)
 		domains = append(domains, domain)
 	}
@@ -165,7 +185,10 @@ func filterMSDRules(domain *zms.DomainData) *zms.DomainData {
 }
 
 func (u *Util) FilterMSDRules(domainData *zms.DomainData) *zms.DomainData {
-	if !u.excludeMSDRules {
+	u.lock.RLock()
+	excludeMSDRules := u.excludeMSDRules
+	u.lock.RUnlock()
+	if !excludeMSDRules {
 		return domainData
 	}
 	return filterMSDRules(domainData)
@@ -131,6 +131,26 @@ func TestIsNamespaceExcluded(t *testing.T) {
 	}
 }
 
+// TestReload - test that reloaded settings replace the previous ones
+func TestReload(t *testing.T) {
+	u := newUtil()
+	u.Reload([]string{"kube-system"}, []string{"kube-public"}, true)
+	if u.IsNamespaceExcluded("acceptance-test") || !u.IsNamespaceExcluded("kube-public") {
+		t.Error("Excluded namespaces should be replaced on reload")
+	}
+	if u.IsSystemDomain("admin.domain.kube-test") || !u.IsSystemDomain("admin.domain.kube-system") {
+		t.Error("System namespaces should be replaced on reload")
+	}
+	domain := &zms.DomainData{
+		Name:     "home.domain",
+		Roles:    []*zms.Role{{Name: "home.domain:role.acl.test"}},
+		Policies: &zms.SignedPolicies{Contents: &zms.DomainPolicies{}},
+	}
+	if len(u.FilterMSDRules(domain).Roles) != 0 {
+		t.Error("MSD rules should be filtered once enabled on reload")
+	}
+}
+
 // TestFilterMSDRules - table-driven tests for filtering MSD roles and policies
 func TestFilterMSDRules(t *testing.T) {
 	tests := []struct {
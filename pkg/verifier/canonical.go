@@ -0,0 +1,283 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package verifier
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	"github.com/ardielle/ardielle-go/rdl"
+)
+
+// ZMS does not sign the json it returns. It signs a canonical string built from a fixed
+// set of fields of every object (com.yahoo.athenz.common.utils.SignUtils), so fields that
+// were added to the schema later are not covered and must not be part of the signed input.
+
+// canonicalStruct - object with its keys written in sorted order
+type canonicalStruct map[string]interface{}
+
+// canonicalArray - array written in its original order
+type canonicalArray []interface{}
+
+// CanonicalString - build the string ZMS signs for domain data or domain policies
+func CanonicalString(obj interface{}) (string, error) {
+	var s canonicalStruct
+	switch o := obj.(type) {
+	case *zms.DomainData:
+		s = domainDataStruct(o)
+	case *zms.DomainPolicies:
+		s = domainPoliciesStruct(o)
+	default:
+		return "", fmt.Errorf("no canonical form for type %T", obj)
+	}
+	var b strings.Builder
+	writeCanonical(&b, s)
+	return b.String(), nil
+}
+
+// domainDataStruct - the signed fields of domain data
+func domainDataStruct(d *zms.DomainData) canonicalStruct {
+	s := canonicalStruct{}
+	appendString(s, "account", d.Account)
+	appendBool(s, "auditEnabled", d.AuditEnabled)
+	appendString(s, "certDnsDomain", d.CertDnsDomain)
+	appendBool(s, "enabled", d.Enabled)
+	if len(d.Groups) != 0 {
+		groups := canonicalArray{}
+		for _, group := range d.Groups {
+			groups = append(groups, groupStruct(group))
+		}
+		s["groups"] = groups
+	}
+	appendInt(s, "memberExpiryDays", d.MemberExpiryDays)
+	appendTimestamp(s, "modified", &d.Modified)
+	appendString(s, "name", string(d.Name))
+	if d.Policies != nil {
+		policies := canonicalStruct{}
+		if d.Policies.Contents != nil {
+			policies["contents"] = domainPoliciesStruct(d.Policies.Contents)
+		}
+		appendString(policies, "keyId", d.Policies.KeyId)
+		appendString(policies, "signature", d.Policies.Signature)
+		s["policies"] = policies
+	}
+	appendInt(s, "roleCertExpiryMins", d.RoleCertExpiryMins)
+	roles := canonicalArray{}
+	for _, role := range d.Roles {
+		roles = append(roles, roleStruct(role))
+	}
+	s["roles"] = roles
+	appendInt(s, "serviceCertExpiryMins", d.ServiceCertExpiryMins)
+	appendInt(s, "serviceExpiryDays", d.ServiceExpiryDays)
+	services := canonicalArray{}
+	for _, service := range d.Services {
+		services = append(services, serviceStruct(service))
+	}
+	s["services"] = services
+	appendString(s, "signAlgorithm", d.SignAlgorithm)
+	appendInt(s, "tokenExpiryMins", d.TokenExpiryMins)
+	appendInt(s, "ypmId", d.YpmId)
+	return s
+}
+
+// domainPoliciesStruct - the signed fields of domain policies
+func domainPoliciesStruct(p *zms.DomainPolicies) canonicalStruct {
+	s := canonicalStruct{}
+	appendString(s, "domain", string(p.Domain))
+	policies := canonicalArray{}
+	for _, policy := range p.Policies {
+		policies = append(policies, policyStruct(policy))
+	}
+	s["policies"] = policies
+	return s
+}
+
+// policyStruct - the signed fields of a policy, assertions are left out when there are none
+func policyStruct(p *zms.Policy) canonicalStruct {
+	s := canonicalStruct{}
+	if len(p.Assertions) != 0 {
+		assertions := canonicalArray{}
+		for _, assertion := range p.Assertions {
+			a := canonicalStruct{}
+			appendString(a, "action", assertion.Action)
+			if assertion.Effect != nil {
+				appendString(a, "effect", assertion.Effect.String())
+			}
+			appendString(a, "resource", assertion.Resource)
+			appendString(a, "role", assertion.Role)
+			assertions = append(assertions, a)
+		}
+		s["assertions"] = assertions
+	}
+	appendTimestamp(s, "modified", p.Modified)
+	appendString(s, "name", string(p.Name))
+	return s
+}
+
+// roleStruct - the signed fields of a role
+func roleStruct(r *zms.Role) canonicalStruct {
+	s := canonicalStruct{}
+	appendBool(s, "auditEnabled", r.AuditEnabled)
+	appendInt(s, "certExpiryMins", r.CertExpiryMins)
+	appendInt(s, "memberExpiryDays", r.MemberExpiryDays)
+	appendInt(s, "memberReviewDays", r.MemberReviewDays)
+	if r.Members != nil {
+		members := canonicalArray{}
+		for _, member := range r.Members {
+			members = append(members, string(member))
+		}
+		s["members"] = members
+	}
+	appendTimestamp(s, "modified", r.Modified)
+	appendString(s, "name", string(r.Name))
+	if r.RoleMembers != nil {
+		roleMembers := canonicalArray{}
+		for _, roleMember := range r.RoleMembers {
+			m := canonicalStruct{}
+			appendTimestamp(m, "expiration", roleMember.Expiration)
+			appendString(m, "memberName", string(roleMember.MemberName))
+			appendInt(m, "systemDisabled", roleMember.SystemDisabled)
+			roleMembers = append(roleMembers, m)
+		}
+		s["roleMembers"] = roleMembers
+	}
+	appendBool(s, "selfServe", r.SelfServe)
+	appendInt(s, "serviceExpiryDays", r.ServiceExpiryDays)
+	appendInt(s, "serviceReviewDays", r.ServiceReviewDays)
+	appendString(s, "signAlgorithm", r.SignAlgorithm)
+	appendInt(s, "tokenExpiryMins", r.TokenExpiryMins)
+	appendString(s, "trust", string(r.Trust))
+	return s
+}
+
+// groupStruct - the signed fields of a group
+func groupStruct(g *zms.Group) canonicalStruct {
+	s := canonicalStruct{}
+	appendBool(s, "auditEnabled", g.AuditEnabled)
+	appendInt(s, "memberExpiryDays", g.MemberExpiryDays)
+	if g.GroupMembers != nil {
+		groupMembers := canonicalArray{}
+		for _, groupMember := range g.GroupMembers {
+			m := canonicalStruct{}
+			appendTimestamp(m, "expiration", groupMember.Expiration)
+			appendString(m, "groupName", string(groupMember.GroupName))
+			appendString(m, "memberName", string(groupMember.MemberName))
+			appendInt(m, "systemDisabled", groupMember.SystemDisabled)
+			groupMembers = append(groupMembers, m)
+		}
+		s["groupMembers"] = groupMembers
+	}
+	appendTimestamp(s, "modified", g.Modified)
+	appendString(s, "name", string(g.Name))
+	appendBool(s, "reviewEnabled", g.ReviewEnabled)
+	appendBool(s, "selfServe", g.SelfServe)
+	appendInt(s, "serviceExpiryDays", g.ServiceExpiryDays)
+	return s
+}
+
+// serviceStruct - the signed fields of a service identity, public keys are always present
+func serviceStruct(svc *zms.ServiceIdentity) canonicalStruct {
+	s := canonicalStruct{}
+	appendString(s, "description", svc.Description)
+	appendString(s, "executable", svc.Executable)
+	appendString(s, "group", svc.Group)
+	if svc.Hosts != nil {
+		hosts := canonicalArray{}
+		for _, host := range svc.Hosts {
+			hosts = append(hosts, host)
+		}
+		s["hosts"] = hosts
+	}
+	appendTimestamp(s, "modified", svc.Modified)
+	appendString(s, "name", string(svc.Name))
+	appendString(s, "providerEndpoint", svc.ProviderEndpoint)
+	publicKeys := canonicalArray{}
+	for _, publicKey := range svc.PublicKeys {
+		k := canonicalStruct{}
+		appendString(k, "id", publicKey.Id)
+		appendString(k, "key", publicKey.Key)
+		publicKeys = append(publicKeys, k)
+	}
+	s["publicKeys"] = publicKeys
+	appendString(s, "user", svc.User)
+	return s
+}
+
+// appendString - add the string unless it is empty, the go client can not tell empty from unset
+func appendString(s canonicalStruct, name, value string) {
+	if value != "" {
+		s[name] = value
+	}
+}
+
+func appendBool(s canonicalStruct, name string, value *bool) {
+	if value != nil {
+		s[name] = *value
+	}
+}
+
+func appendInt(s canonicalStruct, name string, value *int32) {
+	if value != nil {
+		s[name] = *value
+	}
+}
+
+// appendTimestamp - add the timestamp in the UTC millisecond form ZMS uses
+func appendTimestamp(s canonicalStruct, name string, value *rdl.Timestamp) {
+	if value != nil && !value.IsZero() {
+		s[name] = rdl.Timestamp{Time: value.UTC()}.String()
+	}
+}
+
+// writeCanonical - write the value the way SignUtils.asCanonicalString does, strings are
+// quoted without any escaping
+func writeCanonical(b *strings.Builder, obj interface{}) {
+	switch o := obj.(type) {
+	case canonicalStruct:
+		names := make([]string, 0, len(o))
+		for name := range o {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b.WriteByte('{')
+		for i, name := range names {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(`"` + name + `":`)
+			writeCanonical(b, o[name])
+		}
+		b.WriteByte('}')
+	case canonicalArray:
+		b.WriteByte('[')
+		for i, item := range o {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			writeCanonical(b, item)
+		}
+		b.WriteByte(']')
+	case string:
+		b.WriteString(`"` + o + `"`)
+	case int32:
+		b.WriteString(strconv.FormatInt(int64(o), 10))
+	case bool:
+		b.WriteString(strconv.FormatBool(o))
+	}
+}
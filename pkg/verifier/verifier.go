@@ -0,0 +1,184 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package verifier
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	"github.com/AthenZ/athenz/libs/go/zmssvctoken"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/zmsclient"
+)
+
+const (
+	// zms signing keys are registered as public keys of the sys.auth.zms service
+	zmsKeyDomain  = "sys.auth"
+	zmsKeyService = "zms"
+	// PEM header holding the key id of each public key in a PEM bundle
+	keyIDHeader = "Key-Id"
+)
+
+// Verifier - verifies the signatures of signed domains returned by ZMS
+type Verifier struct {
+	zmsClient zmsclient.Client
+	// static keys loaded from a PEM bundle, when set ZMS is never asked for keys
+	bundle    map[string]zmssvctoken.Verifier
+	keys      map[string]zmssvctoken.Verifier
+	keysMutex sync.RWMutex
+}
+
+// NewVerifier - create a new signature verifier. Public keys are read from the PEM bundle
+// when keyFile is set, otherwise they are fetched by key id from the sys.auth domain in ZMS.
+func NewVerifier(zmsClient zmsclient.Client, keyFile string) (*Verifier, error) {
+	v := &Verifier{
+		zmsClient: zmsClient,
+		keys:      map[string]zmssvctoken.Verifier{},
+	}
+	if keyFile == "" {
+		return v, nil
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read ZMS public key bundle %s. Error: %v", keyFile, err)
+	}
+	v.bundle, err = parseBundle(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse ZMS public key bundle %s. Error: %v", keyFile, err)
+	}
+	return v, nil
+}
+
+// parseBundle - parse the public keys of a PEM bundle, every block must carry a Key-Id header
+func parseBundle(data []byte) (map[string]zmssvctoken.Verifier, error) {
+	bundle := map[string]zmssvctoken.Verifier{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		keyID := block.Headers[keyIDHeader]
+		if keyID == "" {
+			return nil, fmt.Errorf("public key block is missing the %s header", keyIDHeader)
+		}
+		delete(block.Headers, keyIDHeader)
+		verifier, err := zmssvctoken.NewVerifier(pem.EncodeToMemory(block))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key for key id %s. Error: %v", keyID, err)
+		}
+		bundle[keyID] = verifier
+	}
+	if len(bundle) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+	return bundle, nil
+}
+
+// VerificationError - returned when a signed domain can not be verified
+type VerificationError struct {
+	Domain string
+	Err    error
+}
+
+func (e *VerificationError) Error() string {
+	return e.Err.Error()
+}
+
+// VerifySignedDomain - verify both the domain signature and the signed policies signature
+func (v *Verifier) VerifySignedDomain(signedDomain *zms.SignedDomain) error {
+	if signedDomain == nil || signedDomain.Domain == nil {
+		return &VerificationError{Err: errors.New("signed domain has no domain data")}
+	}
+	domain := string(signedDomain.Domain.Name)
+	if err := v.verify(signedDomain.Domain, signedDomain.Signature, signedDomain.KeyId); err != nil {
+		return &VerificationError{
+			Domain: domain,
+			Err:    fmt.Errorf("Domain signature verification failed for %s. Error: %v", domain, err),
+		}
+	}
+	policies := signedDomain.Domain.Policies
+	if policies == nil {
+		return nil
+	}
+	if err := v.verify(policies.Contents, policies.Signature, policies.KeyId); err != nil {
+		return &VerificationError{
+			Domain: domain,
+			Err:    fmt.Errorf("Policies signature verification failed for %s. Error: %v", domain, err),
+		}
+	}
+	return nil
+}
+
+// verify - verify the signature of the canonical form of the given object
+func (v *Verifier) verify(obj interface{}, signature, keyID string) error {
+	if signature == "" {
+		return errors.New("signature is empty")
+	}
+	if keyID == "" {
+		return errors.New("key id is empty")
+	}
+	input, err := CanonicalString(obj)
+	if err != nil {
+		return err
+	}
+	verifier, err := v.publicKey(keyID)
+	if err != nil {
+		return err
+	}
+	return verifier.Verify(input, signature)
+}
+
+// publicKey - look up the verifier for the key id from the bundle, cache or ZMS
+func (v *Verifier) publicKey(keyID string) (zmssvctoken.Verifier, error) {
+	if v.bundle != nil {
+		verifier, ok := v.bundle[keyID]
+		if !ok {
+			return nil, fmt.Errorf("key id %s not found in public key bundle", keyID)
+		}
+		return verifier, nil
+	}
+	v.keysMutex.RLock()
+	verifier, ok := v.keys[keyID]
+	v.keysMutex.RUnlock()
+	if ok {
+		return verifier, nil
+	}
+	entry, err := v.zmsClient.GetPublicKeyEntry(zmsKeyDomain, zmsKeyService, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch ZMS public key %s. Error: %v", keyID, err)
+	}
+	if entry == nil || entry.Key == "" {
+		return nil, fmt.Errorf("ZMS public key %s is empty", keyID)
+	}
+	keyPEM, err := new(zmssvctoken.YBase64).DecodeString(entry.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode ZMS public key %s. Error: %v", keyID, err)
+	}
+	verifier, err = zmssvctoken.NewVerifier(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ZMS public key %s. Error: %v", keyID, err)
+	}
+	log.Infof("Fetched ZMS public key %s for signature verification", keyID)
+	v.keysMutex.Lock()
+	v.keys[keyID] = verifier
+	v.keysMutex.Unlock()
+	return verifier, nil
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package verifier
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	"github.com/AthenZ/athenz/libs/go/zmssvctoken"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/ardielle/ardielle-go/rdl"
+)
+
+func init() {
+	log.InitLogger("/tmp/log/test.log", "info")
+}
+
+// publicKeyPEM - PEM encode the public key of the given private key
+func publicKeyPEM(t *testing.T, key *rsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// sign - sign the canonical form of obj the same way ZMS does
+func sign(t *testing.T, key *rsa.PrivateKey, obj interface{}) string {
+	input, err := CanonicalString(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return new(zmssvctoken.YBase64).EncodeToString(sig)
+}
+
+// getSignedDomain - create a signed domain with valid domain and policies signatures
+func getSignedDomain(t *testing.T, key *rsa.PrivateKey, keyID string) *zms.SignedDomain {
+	domainName := "home.domain"
+	policies := &zms.DomainPolicies{
+		Domain: zms.DomainName(domainName),
+		Policies: []*zms.Policy{
+			{
+				Name: zms.ResourceName(domainName + ":policy.admin"),
+				Assertions: []*zms.Assertion{
+					{
+						Role:     domainName + ":role.admin",
+						Resource: domainName + ":*",
+						Action:   "*",
+					},
+				},
+			},
+		},
+	}
+	domain := &zms.DomainData{
+		Name: zms.DomainName(domainName),
+		Roles: []*zms.Role{
+			{
+				Name: zms.ResourceName(domainName + ":role.admin"),
+				RoleMembers: []*zms.RoleMember{
+					{MemberName: "user.foo"},
+				},
+			},
+		},
+		Policies: &zms.SignedPolicies{
+			Contents:  policies,
+			Signature: sign(t, key, policies),
+			KeyId:     keyID,
+		},
+		Modified: rdl.TimestampNow(),
+	}
+	return &zms.SignedDomain{
+		Domain:    domain,
+		Signature: sign(t, key, domain),
+		KeyId:     keyID,
+	}
+}
+
+func newKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newBundleVerifier(t *testing.T, keyID string, key *rsa.PrivateKey) *Verifier {
+	block, _ := pem.Decode(publicKeyPEM(t, key))
+	block.Headers = map[string]string{keyIDHeader: keyID}
+	dir, err := ioutil.TempDir("", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	keyFile := filepath.Join(dir, "zms_public_keys.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(nil, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// readSignedDomain - load the signed domain fixture in the form ZMS returns it. The signatures
+// were made over the canonical strings in testdata with the ZMS unit test key zms_private_k1.pem.
+func readSignedDomain(t *testing.T) *zms.SignedDomain {
+	data, err := ioutil.ReadFile("testdata/signed_domain.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signedDomain zms.SignedDomain
+	if err := json.Unmarshal(data, &signedDomain); err != nil {
+		t.Fatal(err)
+	}
+	return &signedDomain
+}
+
+func TestCanonicalString(t *testing.T) {
+	signedDomain := readSignedDomain(t)
+	tests := []struct {
+		obj  interface{}
+		file string
+	}{
+		{signedDomain.Domain, "testdata/canonical_domain.txt"},
+		{signedDomain.Domain.Policies.Contents, "testdata/canonical_policies.txt"},
+	}
+	for _, test := range tests {
+		expected, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := CanonicalString(test.obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != string(expected) {
+			t.Errorf("Expected canonical string %s, got %s", expected, out)
+		}
+	}
+	if _, err := CanonicalString(signedDomain); err == nil {
+		t.Error("Canonical string of an unsupported type should fail")
+	}
+}
+
+func TestVerifySignedDomainFixture(t *testing.T) {
+	v, err := NewVerifier(nil, "testdata/zms_public_keys.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.VerifySignedDomain(readSignedDomain(t)); err != nil {
+		t.Errorf("Signed domain fixture should pass verification. Error: %v", err)
+	}
+
+	// fields outside of the signed set do not change the signed input
+	unsigned := readSignedDomain(t)
+	unsigned.Domain.Description = "changed"
+	unsigned.Domain.Roles[0].Description = "changed"
+	unsigned.Domain.Policies.Contents.Policies[0].Description = "changed"
+	if err := v.VerifySignedDomain(unsigned); err != nil {
+		t.Errorf("Fields ZMS does not sign should not affect verification. Error: %v", err)
+	}
+
+	tampered := readSignedDomain(t)
+	*tampered.Domain.Roles[1].CertExpiryMins = 1440
+	if err := v.VerifySignedDomain(tampered); err == nil {
+		t.Error("Tampered role cert expiry should fail verification")
+	}
+
+	tampered = readSignedDomain(t)
+	deny := zms.DENY
+	tampered.Domain.Policies.Contents.Policies[1].Assertions[0].Effect = &deny
+	if err := v.VerifySignedDomain(tampered); err == nil {
+		t.Error("Tampered assertion effect should fail verification")
+	}
+}
+
+func TestVerifySignedDomainBundle(t *testing.T) {
+	key := newKey(t)
+	v := newBundleVerifier(t, "0", key)
+
+	if err := v.VerifySignedDomain(getSignedDomain(t, key, "0")); err != nil {
+		t.Errorf("Valid signed domain should pass verification. Error: %v", err)
+	}
+
+	tampered := getSignedDomain(t, key, "0")
+	tampered.Domain.Roles[0].RoleMembers[0].MemberName = "user.attacker"
+	err := v.VerifySignedDomain(tampered)
+	if err == nil || !strings.Contains(err.Error(), "Domain signature verification failed") {
+		t.Errorf("Tampered domain data should fail domain signature verification, got %v", err)
+	}
+
+	tampered = getSignedDomain(t, key, "0")
+	tampered.Domain.Policies.Contents.Policies[0].Assertions[0].Action = "delete"
+	// re-sign the domain so that only the policies signature is invalid
+	tampered.Signature = sign(t, key, tampered.Domain)
+	err = v.VerifySignedDomain(tampered)
+	if err == nil || !strings.Contains(err.Error(), "Policies signature verification failed") {
+		t.Errorf("Tampered policies should fail policies signature verification, got %v", err)
+	}
+
+	unknown := getSignedDomain(t, key, "1")
+	if err := v.VerifySignedDomain(unknown); err == nil {
+		t.Error("Signed domain with a key id missing from the bundle should fail verification")
+	}
+
+	unsigned := getSignedDomain(t, key, "0")
+	unsigned.Signature = ""
+	if err := v.VerifySignedDomain(unsigned); err == nil {
+		t.Error("Signed domain without a signature should fail verification")
+	}
+
+	other := getSignedDomain(t, newKey(t), "0")
+	if err := v.VerifySignedDomain(other); err == nil {
+		t.Error("Signed domain signed with a different key should fail verification")
+	}
+}
+
+func TestVerifySignedDomainZMS(t *testing.T) {
+	key := newKey(t)
+	encodedKey := new(zmssvctoken.YBase64).EncodeToString(publicKeyPEM(t, key))
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/domain/sys.auth/service/zms/publickey/zms.0" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":404,"message":"Not Found"}`))
+			return
+		}
+		atomic.AddInt32(&calls, 1)
+		json.NewEncoder(w).Encode(zms.PublicKeyEntry{Key: encodedKey, Id: "zms.0"})
+	}))
+	defer server.Close()
+	zmsClient := zms.NewClient(server.URL, &http.Transport{})
+	v, err := NewVerifier(&zmsClient, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := v.VerifySignedDomain(getSignedDomain(t, key, "zms.0")); err != nil {
+			t.Errorf("Valid signed domain should pass verification. Error: %v", err)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("ZMS public key should be fetched once and cached, fetched %d times", calls)
+	}
+
+	if err := v.VerifySignedDomain(getSignedDomain(t, key, "zms.1")); err == nil {
+		t.Error("Signed domain with an unknown ZMS key id should fail verification")
+	}
+}
+
+func TestNewVerifierInvalidBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "zms_public_keys.pem")
+	// key without a Key-Id header
+	if err := ioutil.WriteFile(keyFile, publicKeyPEM(t, newKey(t)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVerifier(nil, keyFile); err == nil {
+		t.Error("Bundle without key id headers should be rejected")
+	}
+	if _, err := NewVerifier(nil, filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("Missing bundle file should be rejected")
+	}
+}
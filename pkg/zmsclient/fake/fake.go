@@ -0,0 +1,417 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides an in-memory ZMS server for tests. It serves the ZMS REST endpoints used
+// by the syncer so that the real zms client, including its error handling, is exercised.
+package fake
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	"github.com/AthenZ/athenz/libs/go/zmssvctoken"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/verifier"
+	"github.com/ardielle/ardielle-go/rdl"
+	"github.com/mohae/deepcopy"
+)
+
+// signature and key id of the policies of domains served without a signing key
+const (
+	unsignedSignature = "unsigned"
+	unsignedKeyID     = "unsigned"
+)
+
+// calls that faults can be injected into
+const (
+	// CallSignedDomain - GetSignedDomains for a single domain
+	CallSignedDomain = "signed_domain"
+	// CallModifiedDomains - GetSignedDomains listing the domains modified since the etag
+	CallModifiedDomains = "modified_domains"
+	// CallPublicKey - GetPublicKeyEntry
+	CallPublicKey = "public_key"
+)
+
+// Fault - error response returned instead of the regular response
+type Fault struct {
+	// Call the fault applies to
+	Call string
+	// Domain restricts the fault to calls for this domain, all calls fail when empty
+	Domain string
+	// Code is the http status code returned
+	Code int
+	// RetryAfter is the value of the Retry-After header, not set when empty
+	RetryAfter string
+	// Count is the number of calls failed before the fault is cleared, 0 fails every call
+	Count int
+}
+
+// Server - fake ZMS server holding Athenz domains in memory
+type Server struct {
+	*httptest.Server
+	lock     sync.Mutex
+	domains  map[string]*zms.DomainData
+	faults   []*Fault
+	requests map[string]int
+	keyID    string
+	key      *rsa.PrivateKey
+	// last timestamp handed out, modifications and etags are strictly increasing
+	last time.Time
+}
+
+// NewServer - start a fake ZMS server, Close must be called when done
+func NewServer() *Server {
+	s := &Server{
+		domains:  map[string]*zms.DomainData{},
+		requests: map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client - create a zms client talking to the fake server
+func (s *Server) Client() *zms.ZMSClient {
+	client := zms.NewClient(s.URL, &http.Transport{})
+	return &client
+}
+
+// SetSigningKey - sign domains and policies with the key, the public key is served as the sys.auth.zms key id
+func (s *Server) SetSigningKey(keyID string, key *rsa.PrivateKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keyID = keyID
+	s.key = key
+}
+
+// AddDomain - add or replace a domain, the modified timestamp is set to the current time
+func (s *Server) AddDomain(domain *zms.DomainData) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d := deepcopy.Copy(domain).(*zms.DomainData)
+	if d.Policies == nil {
+		d.Policies = &zms.SignedPolicies{}
+	}
+	if d.Policies.Contents == nil {
+		d.Policies.Contents = &zms.DomainPolicies{Domain: d.Name}
+	}
+	d.Modified = s.tick()
+	s.domains[string(d.Name)] = d
+}
+
+// DeleteDomain - remove a domain, later calls for it return an empty domain list
+func (s *Server) DeleteDomain(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.domains, name)
+}
+
+// PutRole - add or replace a role of the domain and update the domain modified timestamp
+func (s *Server) PutRole(domainName string, role *zms.Role) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d, ok := s.domains[domainName]
+	if !ok {
+		return fmt.Errorf("domain %s not found", domainName)
+	}
+	r := deepcopy.Copy(role).(*zms.Role)
+	replaced := false
+	for i, existing := range d.Roles {
+		if existing.Name == r.Name {
+			d.Roles[i] = r
+			replaced = true
+		}
+	}
+	if !replaced {
+		d.Roles = append(d.Roles, r)
+	}
+	d.Modified = s.tick()
+	return nil
+}
+
+// PutPolicy - add or replace a policy of the domain and update the domain modified timestamp
+func (s *Server) PutPolicy(domainName string, policy *zms.Policy) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d, ok := s.domains[domainName]
+	if !ok {
+		return fmt.Errorf("domain %s not found", domainName)
+	}
+	p := deepcopy.Copy(policy).(*zms.Policy)
+	contents := d.Policies.Contents
+	replaced := false
+	for i, existing := range contents.Policies {
+		if existing.Name == p.Name {
+			contents.Policies[i] = p
+			replaced = true
+		}
+	}
+	if !replaced {
+		contents.Policies = append(contents.Policies, p)
+	}
+	d.Modified = s.tick()
+	return nil
+}
+
+// InjectFault - fail matching calls with the fault status code
+func (s *Server) InjectFault(fault Fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f := fault
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults - remove all injected faults
+func (s *Server) ClearFaults() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = nil
+}
+
+// Requests - number of calls received for the call type, including failed ones
+func (s *Server) Requests(call string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[call]
+}
+
+// tick - current time, strictly after any timestamp handed out before
+func (s *Server) tick() rdl.Timestamp {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if !now.After(s.last) {
+		now = s.last.Add(time.Millisecond)
+	}
+	s.last = now
+	return rdl.Timestamp{Time: now}
+}
+
+// fault - find the fault for the call, consuming one of its counts
+func (s *Server) fault(call, domain string) *Fault {
+	for i, f := range s.faults {
+		if f.Call != call || (f.Domain != "" && f.Domain != domain) {
+			continue
+		}
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case r.URL.Path == "/sys/modified_domains":
+		domain := r.URL.Query().Get("domain")
+		if domain != "" {
+			s.serveSignedDomain(w, r, domain)
+		} else {
+			s.serveModifiedDomains(w, r)
+		}
+	case strings.HasPrefix(r.URL.Path, "/domain/") && strings.Contains(r.URL.Path, "/publickey/"):
+		s.servePublicKey(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// serveSignedDomain - respond with the signed data of a single domain
+func (s *Server) serveSignedDomain(w http.ResponseWriter, r *http.Request, domain string) {
+	s.requests[CallSignedDomain]++
+	if f := s.fault(CallSignedDomain, domain); f != nil {
+		writeFault(w, f)
+		return
+	}
+	signedDomains := &zms.SignedDomains{Domains: []*zms.SignedDomain{}}
+	if d, ok := s.domains[domain]; ok {
+		signedDomain, err := s.sign(d)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		signedDomains.Domains = append(signedDomains.Domains, signedDomain)
+	}
+	writeJSON(w, signedDomains)
+}
+
+// serveModifiedDomains - respond with the domains modified since the If-None-Match etag, or 304 when there are none
+func (s *Server) serveModifiedDomains(w http.ResponseWriter, r *http.Request) {
+	s.requests[CallModifiedDomains]++
+	if f := s.fault(CallModifiedDomains, ""); f != nil {
+		writeFault(w, f)
+		return
+	}
+	var since time.Time
+	matchingTag := r.Header.Get("If-None-Match")
+	if matchingTag != "" {
+		timestamp, err := rdl.TimestampParse(strings.Trim(matchingTag, "\""))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid If-None-Match header %s", matchingTag))
+			return
+		}
+		since = timestamp.Time
+	}
+	names := make([]string, 0, len(s.domains))
+	for name, d := range s.domains {
+		if d.Modified.Time.After(since) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	w.Header().Set("ETag", "\""+s.tick().String()+"\"")
+	if matchingTag != "" && len(names) == 0 {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	metaOnly := r.URL.Query().Get("metaonly") == "true"
+	signedDomains := &zms.SignedDomains{Domains: []*zms.SignedDomain{}}
+	for _, name := range names {
+		d := s.domains[name]
+		if metaOnly {
+			signedDomains.Domains = append(signedDomains.Domains, &zms.SignedDomain{
+				Domain: &zms.DomainData{Name: d.Name, Modified: d.Modified},
+			})
+			continue
+		}
+		signedDomain, err := s.sign(d)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		signedDomains.Domains = append(signedDomains.Domains, signedDomain)
+	}
+	writeJSON(w, signedDomains)
+}
+
+// servePublicKey - respond with the public key of the signing key for /domain/sys.auth/service/zms/publickey/{id}
+func (s *Server) servePublicKey(w http.ResponseWriter, r *http.Request) {
+	s.requests[CallPublicKey]++
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 6 {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	domain, service, id := parts[1], parts[3], parts[5]
+	if f := s.fault(CallPublicKey, domain); f != nil {
+		writeFault(w, f)
+		return
+	}
+	if s.key == nil || domain != "sys.auth" || service != "zms" || id != s.keyID {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	writeJSON(w, &zms.PublicKeyEntry{
+		Key: new(zmssvctoken.YBase64).EncodeToString(keyPEM),
+		Id:  id,
+	})
+}
+
+// sign - copy the domain into a signed domain, signed when a signing key is set. The domain is signed in
+// the form the zms client decodes it to, with the defaults it sets, so that the signatures verify.
+func (s *Server) sign(d *zms.DomainData) (*zms.SignedDomain, error) {
+	domain := deepcopy.Copy(d).(*zms.DomainData)
+	// the zms client rejects signed policies without a signature and key id
+	domain.Policies.Signature = unsignedSignature
+	domain.Policies.KeyId = unsignedKeyID
+	domain, err := decode(domain)
+	if err != nil {
+		return nil, err
+	}
+	signedDomain := &zms.SignedDomain{Domain: domain}
+	if s.key == nil {
+		return signedDomain, nil
+	}
+	signature, err := s.signature(domain.Policies.Contents)
+	if err != nil {
+		return nil, err
+	}
+	domain.Policies.Signature = signature
+	domain.Policies.KeyId = s.keyID
+	signedDomain.Signature, err = s.signature(domain)
+	if err != nil {
+		return nil, err
+	}
+	signedDomain.KeyId = s.keyID
+	return signedDomain, nil
+}
+
+// decode - json round trip of the domain through the zms types, which validate it and set their defaults
+func decode(d *zms.DomainData) (*zms.DomainData, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	domain := &zms.DomainData{}
+	if err := json.Unmarshal(data, domain); err != nil {
+		return nil, fmt.Errorf("Invalid domain %s. Error: %v", d.Name, err)
+	}
+	return domain, nil
+}
+
+// signature - sign the canonical form of the object
+func (s *Server) signature(obj interface{}) (string, error) {
+	input, err := verifier.CanonicalString(obj)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return new(zmssvctoken.YBase64).EncodeToString(sig), nil
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+func writeFault(w http.ResponseWriter, f *Fault) {
+	if f.RetryAfter != "" {
+		w.Header().Set("Retry-After", f.RetryAfter)
+	}
+	writeError(w, f.Code, http.StatusText(f.Code))
+}
+
+// writeError - respond with an error body the zms client decodes into a rdl.ResourceError
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(rdl.ResourceError{Code: code, Message: message})
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"testing"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/verifier"
+	"github.com/ardielle/ardielle-go/rdl"
+)
+
+func init() {
+	log.InitLogger("/tmp/log/test.log", "info")
+}
+
+func TestModifiedDomains(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddDomain(&zms.DomainData{Name: "home.a", Roles: []*zms.Role{{Name: "home.a:role.admin"}}})
+	s.AddDomain(&zms.DomainData{Name: "home.b"})
+	client := s.Client()
+	f := false
+
+	res, etag, err := client.GetSignedDomains("", "true", "", &f, &f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Domains) != 2 || res.Domains[0].Domain.Name != "home.a" || res.Domains[1].Domain.Name != "home.b" {
+		t.Errorf("Expected all domains without an etag, got %+v", res.Domains)
+	}
+	// the zms client initializes the lists missing from the meta only response
+	if roles := res.Domains[0].Domain.Roles; roles == nil || len(roles) != 0 {
+		t.Errorf("Meta only call should not return the domain roles, got %v", roles)
+	}
+
+	// nothing was modified since the etag
+	res, next, err := client.GetSignedDomains("", "true", "", &f, &f, etag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != nil {
+		t.Errorf("Expected not modified response, got %+v", res.Domains)
+	}
+
+	if err := s.PutRole("home.b", &zms.Role{Name: "home.b:role.reader"}); err != nil {
+		t.Fatal(err)
+	}
+	res, _, err = client.GetSignedDomains("", "true", "", &f, &f, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Domains) != 1 || res.Domains[0].Domain.Name != "home.b" {
+		t.Errorf("Expected only the modified domain, got %+v", res.Domains)
+	}
+}
+
+func TestSignedDomain(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddDomain(&zms.DomainData{Name: "home.a"})
+	client := s.Client()
+	f := false
+
+	res, _, err := client.GetSignedDomains("home.missing", "", "", &f, &f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Domains) != 0 {
+		t.Errorf("Expected an empty list for a missing domain, got %+v", res.Domains)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetSigningKey("zms.0", key)
+	res, _, err = client.GetSignedDomains("home.a", "", "", &f, &f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Domains) != 1 {
+		t.Fatalf("Expected the domain, got %+v", res.Domains)
+	}
+	v, err := verifier.NewVerifier(client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.VerifySignedDomain(res.Domains[0]); err != nil {
+		t.Errorf("Domain signed by the fake server should pass verification. Error: %v", err)
+	}
+	if s.Requests(CallPublicKey) != 1 {
+		t.Errorf("Expected the public key to be fetched once, fetched %d times", s.Requests(CallPublicKey))
+	}
+}
+
+func TestInjectFault(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddDomain(&zms.DomainData{Name: "home.a"})
+	s.AddDomain(&zms.DomainData{Name: "home.b"})
+	client := s.Client()
+	f := false
+
+	s.InjectFault(Fault{Call: CallSignedDomain, Domain: "home.a", Code: http.StatusTooManyRequests, RetryAfter: "1", Count: 1})
+	_, _, err := client.GetSignedDomains("home.a", "", "", &f, &f, "")
+	rdlErr, ok := err.(rdl.ResourceError)
+	if !ok || rdlErr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 resource error, got %v", err)
+	}
+	if _, _, err := client.GetSignedDomains("home.b", "", "", &f, &f, ""); err != nil {
+		t.Errorf("Fault should only apply to its domain. Error: %v", err)
+	}
+	if _, _, err := client.GetSignedDomains("home.a", "", "", &f, &f, ""); err != nil {
+		t.Errorf("Fault should be cleared once its count is used up. Error: %v", err)
+	}
+
+	s.InjectFault(Fault{Call: CallModifiedDomains, Code: http.StatusServiceUnavailable})
+	for i := 0; i < 2; i++ {
+		if _, _, err := client.GetSignedDomains("", "true", "", &f, &f, ""); err == nil {
+			t.Error("Fault without a count should fail every call")
+		}
+	}
+	s.ClearFaults()
+	if _, _, err := client.GetSignedDomains("", "true", "", &f, &f, ""); err != nil {
+		t.Errorf("Calls should succeed once the faults are cleared. Error: %v", err)
+	}
+	if s.Requests(CallSignedDomain) != 3 || s.Requests(CallModifiedDomains) != 3 {
+		t.Errorf("Expected 3 calls of each type, got %d and %d", s.Requests(CallSignedDomain), s.Requests(CallModifiedDomains))
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package zmsclient
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/metrics"
+	"github.com/ardielle/ardielle-go/rdl"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// MaxRetryAfter - longest pause honored for a Retry-After header, so that a bad value cannot stop the syncer
+	MaxRetryAfter = 5 * time.Minute
+	// defaultRetryDelay - delay before retrying a throttled call when ZMS sent no Retry-After
+	defaultRetryDelay = time.Second
+)
+
+// Limiter - budget of ZMS requests shared by all the ZMS calls of the syncer. Requests wait for a token
+// of a token bucket, and a throttled response with a Retry-After header pauses all requests until then.
+type Limiter struct {
+	bucket      flowcontrol.RateLimiter
+	lock        sync.Mutex
+	pausedUntil time.Time
+}
+
+// NewLimiter - create a limiter allowing qps requests per second with bursts of burst requests,
+// a qps of 0 does not limit the requests and only honors Retry-After
+func NewLimiter(qps float64, burst int) *Limiter {
+	bucket := flowcontrol.NewFakeAlwaysRateLimiter()
+	if qps > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		bucket = flowcontrol.NewTokenBucketRateLimiter(float32(qps), burst)
+	}
+	return &Limiter{bucket: bucket}
+}
+
+// Wait - block until the pause is over and a request is allowed by the budget, or the context is done
+func (l *Limiter) Wait(ctx context.Context) error {
+	for {
+		pause := l.PauseRemaining()
+		if pause <= 0 {
+			break
+		}
+		timer := time.NewTimer(pause)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			metrics.ObserveZMSThrottled(metrics.ThrottleRetryAfter, pause)
+			return ctx.Err()
+		case <-timer.C:
+			metrics.ObserveZMSThrottled(metrics.ThrottleRetryAfter, pause)
+		}
+	}
+	start := time.Now()
+	err := l.bucket.Wait(ctx)
+	if wait := time.Since(start); wait > time.Millisecond {
+		metrics.ObserveZMSThrottled(metrics.ThrottleBudget, wait)
+	}
+	return err
+}
+
+// Pause - hold back all requests for the duration, capped at MaxRetryAfter. A shorter pause than the
+// current one is ignored.
+func (l *Limiter) Pause(d time.Duration) {
+	if d > MaxRetryAfter {
+		d = MaxRetryAfter
+	}
+	until := time.Now().Add(d)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// PauseRemaining - time left until requests are allowed again after a Retry-After, 0 when not paused
+func (l *Limiter) PauseRemaining() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if remaining := time.Until(l.pausedUntil); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// RetryDelay - delay before retrying a throttled call, the remaining pause or a second without Retry-After
+func (l *Limiter) RetryDelay() time.Duration {
+	if l == nil {
+		return defaultRetryDelay
+	}
+	if remaining := l.PauseRemaining(); remaining > 0 {
+		return remaining
+	}
+	return defaultRetryDelay
+}
+
+// Transport - round tripper making every request of the base round tripper wait for the limiter and
+// pausing the limiter on throttled responses with a Retry-After header. The http default transport
+// is used when base is nil.
+func (l *Limiter) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &limitedTransport{limiter: l, base: base}
+}
+
+// limitedTransport - round tripper of Limiter.Transport
+type limitedTransport struct {
+	limiter *Limiter
+	base    http.RoundTripper
+}
+
+// RoundTrip - wait for the limiter, send the request and honor the Retry-After of throttled responses
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !isThrottledCode(resp.StatusCode) {
+		return resp, err
+	}
+	if d, ok := RetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		log.Warnf("ZMS responded %d to %s, pausing all ZMS requests for %s", resp.StatusCode, req.URL.Path, d)
+		metrics.RecordZMSRetryAfter(resp.StatusCode)
+		t.limiter.Pause(d)
+	}
+	return resp, nil
+}
+
+// RetryAfter - parse a Retry-After header value, either a number of seconds or an http date
+func RetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	d := date.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// IsThrottled - check if the error of a ZMS call is a 429 Too Many Requests or 503 Service Unavailable
+func IsThrottled(err error) bool {
+	rdlErr, ok := err.(rdl.ResourceError)
+	return ok && isThrottledCode(rdlErr.Code)
+}
+
+// isThrottledCode - check if the status code asks the client to back off
+func isThrottledCode(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+}
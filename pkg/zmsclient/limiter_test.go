@@ -0,0 +1,130 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package zmsclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AthenZ/athenz/clients/go/zms"
+	"github.com/AthenZ/k8s-athenz-syncer/pkg/log"
+	"github.com/ardielle/ardielle-go/rdl"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{value: "", ok: false},
+		{value: "30", expected: 30 * time.Second, ok: true},
+		{value: "-1", ok: false},
+		{value: "Mon, 01 Jul 2019 12:00:10 GMT", expected: 10 * time.Second, ok: true},
+		{value: "Mon, 01 Jul 2019 11:59:00 GMT", expected: 0, ok: true},
+		{value: "soon", ok: false},
+	}
+	for _, test := range tests {
+		d, ok := RetryAfter(test.value, now)
+		if d != test.expected || ok != test.ok {
+			t.Errorf("Retry-After %q: expected %s %t, got %s %t", test.value, test.expected, test.ok, d, ok)
+		}
+	}
+}
+
+func TestIsThrottled(t *testing.T) {
+	if !IsThrottled(rdl.ResourceError{Code: 429}) || !IsThrottled(rdl.ResourceError{Code: 503}) {
+		t.Error("429 and 503 errors should be throttled")
+	}
+	if IsThrottled(rdl.ResourceError{Code: 404}) || IsThrottled(errors.New("429")) || IsThrottled(nil) {
+		t.Error("Other errors should not be throttled")
+	}
+}
+
+func TestLimiterBudget(t *testing.T) {
+	limiter := NewLimiter(20, 1)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := limiter.Wait(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected 5 requests at 20 qps with a burst of 1 to take 200ms, took %s", elapsed)
+	}
+
+	limiter = NewLimiter(0, 0)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		limiter.Wait(context.TODO())
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected no limit with 0 qps, took %s", elapsed)
+	}
+
+	limiter.Pause(time.Hour)
+	if remaining := limiter.PauseRemaining(); remaining > MaxRetryAfter {
+		t.Errorf("Expected the pause to be capped at %s, got %s", MaxRetryAfter, remaining)
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); err == nil {
+		t.Error("Expected Wait to return when the context is done during a pause")
+	}
+}
+
+func TestLimiterTransport(t *testing.T) {
+	log.InitLogger("/tmp/log/test.log", "info")
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":429,"message":"Too Many Requests"}`))
+			return
+		}
+		w.Write([]byte(`{"domains":[]}`))
+	}))
+	defer server.Close()
+
+	limiter := NewLimiter(0, 0)
+	client := zms.NewClient(server.URL, limiter.Transport(nil))
+	master := false
+	_, _, err := client.GetSignedDomains("home.domain", "", "", &master, &master, "")
+	if !IsThrottled(err) {
+		t.Fatalf("Expected a throttled error, got %v", err)
+	}
+	if remaining := limiter.RetryDelay(); remaining < 900*time.Millisecond || remaining > time.Second {
+		t.Errorf("Expected a retry delay of the Retry-After second, got %s", remaining)
+	}
+	start := time.Now()
+	if _, _, err := client.GetSignedDomains("", "true", "", &master, &master, ""); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Expected the next request to wait for the Retry-After, took %s", elapsed)
+	}
+	if delay := limiter.RetryDelay(); delay != defaultRetryDelay {
+		t.Errorf("Expected the default retry delay once the pause is over, got %s", delay)
+	}
+}
@@ -0,0 +1,33 @@
+/*
+Copyright 2019, Oath Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package zmsclient
+
+import (
+	"github.com/AthenZ/athenz/clients/go/zms"
+)
+
+// Client - the ZMS calls made by the syncer. *zms.ZMSClient implements it, tests and extensions
+// can use the fake package or their own implementation.
+type Client interface {
+	// GetSignedDomains - fetch the signed data of a domain, or the domains modified since matchingTag
+	GetSignedDomains(domain zms.DomainName, metaOnly string, metaAttr zms.SimpleName, master *bool, conditions *bool, matchingTag string) (*zms.SignedDomains, string, error)
+	// GetPublicKeyEntry - fetch a public key of a service
+	GetPublicKeyEntry(domain zms.DomainName, service zms.SimpleName, id string) (*zms.PublicKeyEntry, error)
+	// AddCredentials - set the credentials header sent with every call
+	AddCredentials(header string, token string)
+}
+
+var _ Client = &zms.ZMSClient{}